@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/codecrafters-io/dns-server-starter-go/pkg/dns"
 	"net"
+	"strings"
+	"time"
 )
 
 func main() {
@@ -21,23 +25,109 @@ func main() {
 	}
 	defer udpConn.Close()
 
-	resolverAddress := flag.String("resolver", "", "DNS resolver address.")
+	resolverAddresses := flag.String("resolver", "", "Comma-separated DNS resolver addresses.")
+	strategy := flag.String("strategy", "failover", "Order in which resolvers are tried: failover, round-robin, random or lowest-latency.")
+	udpSize := flag.Uint("udp-size", 1232, "EDNS UDP payload size advertised to clients.")
+	ecs := flag.String("ecs", "strip", "EDNS Client Subnet policy: strip, pass or synthesize.")
+	ecsIPv4Prefix := flag.Uint("ecs-ipv4-prefix", 24, "Longest IPv4 client subnet prefix sent upstream.")
+	ecsIPv6Prefix := flag.Uint("ecs-ipv6-prefix", 56, "Longest IPv6 client subnet prefix sent upstream.")
+	blockedDomains := flag.String("block", "", "Comma-separated domains to refuse queries for.")
+	cookieRotation := flag.Duration("cookie-rotation", 24*time.Hour, "Server cookie secret rotation period, or 0 to disable DNS cookies.")
+	upstreamTransport := flag.String("upstream-transport", "udp", "Transport to the resolver: udp (retrying truncated responses over tcp) or tcp.")
+	upstreamSockets := flag.Int("upstream-sockets", 4, "Number of UDP sockets to each resolver shared by queries to it.")
+	dialTimeout := flag.Duration("dial-timeout", 2*time.Second, "Timeout for connecting to a resolver over TCP.")
+	readTimeout := flag.Duration("read-timeout", 2*time.Second, "Timeout for a resolver to answer one attempt.")
+	queryTimeout := flag.Duration("query-timeout", 5*time.Second, "Overall time budget for forwarding a query, retries included.")
+	retries := flag.Int("retries", 0, "Number of times a query is retried on each resolver that fails to answer it.")
+	retryBackoff := flag.Duration("retry-backoff", 100*time.Millisecond, "Backoff before the first retry, doubled for each next one and jittered.")
+	retryOtherResolver := flag.Bool("retry-other-resolver", true, "Move on to the next resolver before retrying a query, instead of retrying the same one first.")
+	healthCheckInterval := flag.Duration("health-check-interval", 10*time.Second, "Period of the resolver health probes, or 0 to disable them.")
+	healthCheckName := flag.String("health-check-name", ".", "Domain name queried by the resolver health probes.")
+	maxFailures := flag.Int("max-failures", 3, "Consecutive failures after which a resolver is ejected, or 0 to never eject one.")
+	ejectionCooldown := flag.Duration("ejection-cooldown", 30*time.Second, "Time before an ejected resolver is tried again.")
+	logFormat := flag.String("log-format", "text", "Format of logged messages: text or json (RFC 8427).")
 	flag.Parse()
 
-	if *resolverAddress == "" {
+	var resolvers []string
+	for _, address := range strings.Split(*resolverAddresses, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			resolvers = append(resolvers, address)
+		}
+	}
+	if len(resolvers) == 0 {
 		fmt.Println("Error: Resolver address is required.")
 		return
 	}
 
-	forwarder, err := dns.NewForwarder(*resolverAddress)
+	if *logFormat != "text" && *logFormat != "json" {
+		fmt.Println("Error: unknown log format", *logFormat)
+		return
+	}
+
+	ecsPolicy, err := parseECSPolicy(*ecs)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+
+	transport, err := parseTransport(*upstreamTransport)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+
+	selection, err := parseStrategy(*strategy)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+
+	forwarder, err := dns.NewForwarder(
+		resolvers,
+		dns.WithECS(ecsPolicy, uint8(*ecsIPv4Prefix), uint8(*ecsIPv6Prefix)),
+		dns.WithCookies(*cookieRotation > 0),
+		dns.WithTransport(transport),
+		dns.WithStrategy(selection),
+		dns.WithSocketPool(*upstreamSockets),
+		dns.WithTimeouts(*dialTimeout, *readTimeout),
+		dns.WithQueryTimeout(*queryTimeout),
+		dns.WithRetries(*retries, *retryBackoff, *retryOtherResolver),
+		dns.WithCircuitBreaker(*maxFailures, *ejectionCooldown),
+		dns.WithHealthCheck(*healthCheckInterval, *healthCheckName),
+	)
 	if err != nil {
 		fmt.Println("Failed to create forwarder:", err)
 		return
 	}
+	defer forwarder.Close()
 
-	fmt.Printf("Using DNS resolver at address: %s\n", *resolverAddress)
+	var blocklist []dns.Name
+	for _, domain := range strings.Split(*blockedDomains, ",") {
+		if domain = strings.TrimSpace(domain); domain == "" {
+			continue
+		}
+		name, err := dns.ParseName(domain)
+		if err != nil {
+			fmt.Println("Error: invalid blocked domain:", err)
+			return
+		}
+		blocklist = append(blocklist, name)
+	}
 
-	buf := make([]byte, 512)
+	var cookies *dns.ServerCookies
+	if *cookieRotation > 0 {
+		cookies, err = dns.NewServerCookies(*cookieRotation)
+		if err != nil {
+			fmt.Println("Failed to create server cookies:", err)
+			return
+		}
+	}
+
+	fmt.Printf("Using DNS resolvers at addresses: %s\n", strings.Join(resolvers, ", "))
+
+	// Clients may send EDNS queries of any size, so read the largest datagram
+	// UDP can carry.
+	buf := make([]byte, 65535)
 
 	for {
 		size, source, err := udpConn.ReadFromUDP(buf)
@@ -49,20 +139,80 @@ func main() {
 		m, err := dns.RawMessage(buf[:size]).Parse()
 		if err != nil {
 			fmt.Println("Error parsing message:", err)
-			break
+
+			// Never answer responses, so that two servers cannot bounce
+			// errors back and forth.
+			header, err := dns.RawMessage(buf[:size]).ParseHeader()
+			if err != nil || header.Flags.QR == 1 {
+				continue
+			}
+
+			fm := formatError(header)
+			_, err = udpConn.WriteToUDP(fm.Serialize(), source)
+			if err != nil {
+				fmt.Println("Failed to send response:", err)
+			}
+			continue
+		}
+		if m.EDNS != nil && m.EDNS.Version > 0 {
+			// BADVERS (RFC 6891, section 6.1.3)
+			em := errorResponse(m, dns.RcodeBadVers, uint16(*udpSize))
+			_, err = udpConn.WriteToUDP(em.Serialize(), source)
+			if err != nil {
+				fmt.Println("Failed to send response:", err)
+			}
+			continue
 		}
+
+		var cookie *dns.Cookie
+		if cookies != nil {
+			var valid bool
+			cookie, valid = cookies.Check(m, source.IP)
+			if !valid {
+				em := errorResponse(m, dns.RcodeBadCookie, uint16(*udpSize), cookieOption(cookie)...)
+				_, err = udpConn.WriteToUDP(em.Serialize(), source)
+				if err != nil {
+					fmt.Println("Failed to send response:", err)
+				}
+				continue
+			}
+		}
+
 		fmt.Printf("Start processing. ID %d\n", m.Header.ID)
-		fmt.Println("[", m.Header.ID, "]DNS Message: ", buf[:size])
+		logMessage(*logFormat, "Query", m)
 
-		rm, err := forwarder.Forward(m)
+		if blocked(m, blocklist) {
+			fmt.Printf("[ %d ]Refusing blocked query\n", m.Header.ID)
+			em := errorResponse(m, dns.RcodeRefused, uint16(*udpSize), cookieOption(cookie)...)
+			if em.EDNS != nil {
+				em.EDNS.Options = append(em.EDNS.Options, dns.ExtendedError{InfoCode: dns.ExtendedErrorBlocked, ExtraText: "blocked"})
+			}
+			_, err = udpConn.WriteToUDP(em.Serialize(), source)
+			if err != nil {
+				fmt.Println("Failed to send response:", err)
+			}
+			continue
+		}
+
+		rm, err := forwarder.ForwardFrom(context.Background(), m, source.IP)
 		if err != nil {
 			fmt.Println("Error forwarding message:", err)
-			break
+
+			em := errorResponse(m, dns.RcodeServFail, uint16(*udpSize), cookieOption(cookie)...)
+			if em.EDNS != nil {
+				em.EDNS.Options = append(em.EDNS.Options, dns.ForwardingError(err))
+			}
+			_, err = udpConn.WriteToUDP(em.Serialize(), source)
+			if err != nil {
+				fmt.Println("Failed to send response:", err)
+			}
+			continue
 		}
 
-		fmt.Printf("[ %d ]Response Message Header: %+v\n", m.Header.ID, rm.Header)
-		fmt.Printf("[ %d ]Response Message Questions: %+v\n", m.Header.ID, rm.Questions)
-		fmt.Printf("[ %d ]Response Message Answers: %+v\n", m.Header.ID, rm.Answers)
+		logMessage(*logFormat, "Upstream response", rm)
+
+		rm.EDNS = responseEDNS(m, rm, uint16(*udpSize), cookie)
+		rm.Truncate(maxResponseSize(m, uint16(*udpSize)))
 
 		_, err = udpConn.WriteToUDP(rm.Serialize(), source)
 		if err != nil {
@@ -72,3 +222,149 @@ func main() {
 		fmt.Println("Response sent. ID", m.Header.ID)
 	}
 }
+
+// logMessage prints m in presentation format, or as a single line of RFC 8427
+// JSON if format is "json".
+func logMessage(format string, what string, m dns.Message) {
+	if format == "json" {
+		encoded, err := json.Marshal(m)
+		if err != nil {
+			fmt.Printf("[ %d ]Failed to encode %s: %v\n", m.Header.ID, what, err)
+			return
+		}
+		fmt.Printf("[ %d ]%s: %s\n", m.Header.ID, what, encoded)
+		return
+	}
+
+	fmt.Printf("[ %d ]%s:\n%s", m.Header.ID, what, m.String())
+}
+
+// formatError returns the FORMERR response to a query whose header could be
+// read but whose body could not.
+func formatError(header dns.Header) dns.Message {
+	var em dns.Message
+	em.SetReply(&dns.Message{Header: header}).SetRcode(dns.RcodeFormErr)
+	return em
+}
+
+// errorResponse returns a response to query carrying no records and the given
+// 12-bit rcode. It carries an OPT record with the given options if the query
+// had one, or if the rcode does not fit in the header.
+func errorResponse(query dns.Message, rcode dns.Rcode, udpSize uint16, options ...dns.EDNSOption) dns.Message {
+	var em dns.Message
+	em.SetReply(&query)
+	if query.EDNS != nil || rcode > 0x0F {
+		em.SetEDNS(udpSize, false).AddOption(options...)
+	}
+	em.SetRcode(rcode)
+
+	return em
+}
+
+// blocked reports whether any question of query asks for one of the domains
+// in blocklist or a name below it.
+func blocked(query dns.Message, blocklist []dns.Name) bool {
+	for _, question := range query.Questions {
+		for _, domain := range blocklist {
+			if question.NAME.IsSubdomainOf(domain) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func cookieOption(cookie *dns.Cookie) []dns.EDNSOption {
+	if cookie == nil {
+		return nil
+	}
+	return []dns.EDNSOption{*cookie}
+}
+
+// responseEDNS returns the OPT record to send back to the client: none unless
+// the query used EDNS, and otherwise our own payload size and cookie, keeping
+// only the extended RCODE, client subnet and extended errors of the upstream
+// response.
+func responseEDNS(query dns.Message, response dns.Message, udpSize uint16, cookie *dns.Cookie) *dns.EDNS {
+	if query.EDNS == nil {
+		return nil
+	}
+
+	edns := &dns.EDNS{
+		UDPSize: udpSize,
+		DO:      query.EDNS.DO,
+	}
+	if response.EDNS != nil {
+		edns.ExtendedRcode = response.EDNS.ExtendedRcode
+		if subnet := response.EDNS.Option(dns.OptionCodeClientSubnet); subnet != nil {
+			edns.Options = append(edns.Options, subnet)
+		}
+		for _, e := range response.ExtendedErrors() {
+			edns.Options = append(edns.Options, e)
+		}
+	}
+	if cookie != nil {
+		edns.Options = append(edns.Options, *cookie)
+	}
+
+	return edns
+}
+
+// maxResponseSize returns the largest UDP response the client of query can
+// take: 512 octets without EDNS, and otherwise the payload size it advertised,
+// capped at our own (RFC 6891, section 6.2.5).
+func maxResponseSize(query dns.Message, udpSize uint16) int {
+	if query.EDNS == nil {
+		return 512
+	}
+
+	size := int(query.EDNS.UDPSize)
+	if size > int(udpSize) {
+		size = int(udpSize)
+	}
+	if size < 512 {
+		size = 512
+	}
+
+	return size
+}
+
+func parseECSPolicy(policy string) (dns.ECSPolicy, error) {
+	switch policy {
+	case "strip":
+		return dns.ECSStrip, nil
+	case "pass":
+		return dns.ECSPassThrough, nil
+	case "synthesize":
+		return dns.ECSSynthesize, nil
+	default:
+		return 0, fmt.Errorf("unknown ECS policy %q", policy)
+	}
+}
+
+func parseTransport(transport string) (dns.Transport, error) {
+	switch transport {
+	case "udp":
+		return dns.TransportUDP, nil
+	case "tcp":
+		return dns.TransportTCP, nil
+	default:
+		return 0, fmt.Errorf("unknown upstream transport %q", transport)
+	}
+}
+
+func parseStrategy(strategy string) (dns.Strategy, error) {
+	switch strategy {
+	case "failover":
+		return dns.StrategyFailover, nil
+	case "round-robin":
+		return dns.StrategyRoundRobin, nil
+	case "random":
+		return dns.StrategyRandom, nil
+	case "lowest-latency":
+		return dns.StrategyLowestLatency, nil
+	default:
+		return 0, fmt.Errorf("unknown strategy %q", strategy)
+	}
+}
@@ -1,14 +1,18 @@
 package main
 
 import (
-	"encoding/binary"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"github.com/codecrafters-io/dns-server-starter-go/pkg/dns"
 	"net"
 	"os"
-	"strings"
 )
 
 func main() {
+	jsonOutput := flag.Bool("json", false, "Print the reply as RFC 8427 JSON.")
+	flag.Parse()
+
 	serverAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:2053")
 	if err != nil {
 		fmt.Println("Failed to resolve server address:", err)
@@ -22,9 +26,9 @@ func main() {
 	}
 	defer conn.Close()
 
-	dnsRequest := createDNSRequest([]string{"abc.example.com", "def.example.com"})
+	query := dns.NewQuery("abc.example.com", dns.TypeA).AddQuestion(dns.NewQuestion("def.example.com", dns.TypeA, dns.ClassIN))
 
-	_, err = conn.Write(dnsRequest)
+	_, err = conn.Write(query.Serialize())
 	if err != nil {
 		fmt.Println("Failed to send message:", err)
 		return
@@ -36,36 +40,21 @@ func main() {
 		fmt.Println("Failed to read from server:", err)
 		return
 	}
-	fmt.Printf("Server reply: %s\n", string(buf[:n]))
-}
-
-func createDNSRequest(domains []string) []byte {
-	var header [12]byte
-	binary.BigEndian.PutUint16(header[0:2], 1234)                 // ID
-	binary.BigEndian.PutUint16(header[4:6], uint16(len(domains))) // QDCOUNT
 
-	question := make([]byte, 0)
-	for _, domain := range domains {
-		question = append(question, createQuestion(domain, 1, 1)...)
+	reply, err := dns.RawMessage(buf[:n]).Parse()
+	if err != nil {
+		fmt.Println("Failed to parse reply:", err)
+		return
 	}
 
-	return append(header[:], question...)
-}
-
-func createQuestion(domain string, qtype, qclass uint16) []byte {
-	question := make([]byte, 0)
-	for _, part := range strings.Split(domain, ".") {
-		question = append(question, byte(len(part)))
-		question = append(question, part...)
+	if *jsonOutput {
+		encoded, err := json.MarshalIndent(reply, "", "  ")
+		if err != nil {
+			fmt.Println("Failed to encode reply:", err)
+			return
+		}
+		fmt.Println(string(encoded))
+		return
 	}
-	question = append(question, 0)
-	question = appendUint16ToSlice(question, qtype)
-	question = appendUint16ToSlice(question, qclass)
-	return question
-}
-
-func appendUint16ToSlice(slice []byte, value uint16) []byte {
-	bytes := make([]byte, 2)
-	binary.BigEndian.PutUint16(bytes, value)
-	return append(slice, bytes...)
+	fmt.Print(reply.String())
 }
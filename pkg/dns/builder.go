@@ -0,0 +1,132 @@
+package dns
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	mathrand "math/rand"
+)
+
+// defaultUDPSize is the EDNS UDP payload size used when a builder method needs
+// an OPT record the message does not have yet. 1232 octets avoids IP
+// fragmentation on virtually every path (DNS Flag Day 2020).
+const defaultUDPSize = 1232
+
+// The methods below build a message step by step and can be chained:
+//
+//	query := NewQuery("example.com", TypeA).SetEDNS(1232, false)
+//	reply := new(Message).SetReply(query).AddAnswer(record)
+//
+// Each keeps the counts in Header equal to the length of the sections, the
+// OPT record included, so that they never have to be set by hand.
+
+// NewQuery returns a query for name in class IN with a random ID and
+// recursion desired. name is parsed like in NewQuestion.
+func NewQuery(name string, rrType Type) *Message {
+	m := &Message{Header: Header{ID: randomID(), Flags: HeaderFlags{RD: 1}}}
+	return m.SetQuestion(name, rrType)
+}
+
+// SetQuestion replaces the questions with one for name in class IN.
+func (m *Message) SetQuestion(name string, rrType Type) *Message {
+	m.Questions = Questions{NewQuestion(name, rrType, ClassIN)}
+	return m.updateCounts()
+}
+
+// AddQuestion appends questions.
+func (m *Message) AddQuestion(questions ...Question) *Message {
+	m.Questions = append(m.Questions, questions...)
+	return m.updateCounts()
+}
+
+// SetReply turns m into an empty successful response to req: the ID, OPCODE,
+// RD and CD flags and the questions are those of req, and everything else is
+// cleared.
+func (m *Message) SetReply(req *Message) *Message {
+	*m = Message{
+		Header: Header{
+			ID: req.Header.ID,
+			Flags: HeaderFlags{
+				QR:     1,
+				OPCODE: req.Header.Flags.OPCODE,
+				RD:     req.Header.Flags.RD,
+				CD:     req.Header.Flags.CD,
+			},
+		},
+		Questions: append(Questions(nil), req.Questions...),
+	}
+	return m.updateCounts()
+}
+
+// SetRcode sets the 12-bit RCODE. The upper 8 bits are carried by EDNS, so an
+// OPT record is added for a value above 15 if the message has none.
+func (m *Message) SetRcode(rcode Rcode) *Message {
+	m.Header.Flags.RCODE = rcode & 0x0F
+	if rcode > 0x0F && m.EDNS == nil {
+		m.EDNS = &EDNS{UDPSize: defaultUDPSize}
+	}
+	if m.EDNS != nil {
+		m.EDNS.ExtendedRcode = uint8(rcode >> 4)
+	}
+	return m.updateCounts()
+}
+
+// AddAnswer appends records to the answer section.
+func (m *Message) AddAnswer(records ...Answer) *Message {
+	m.Answers = append(m.Answers, records...)
+	return m.updateCounts()
+}
+
+// AddAuthority appends records to the authority section.
+func (m *Message) AddAuthority(records ...Answer) *Message {
+	m.Authority = append(m.Authority, records...)
+	return m.updateCounts()
+}
+
+// AddAdditional appends records to the additional section.
+func (m *Message) AddAdditional(records ...Answer) *Message {
+	m.Additional = append(m.Additional, records...)
+	return m.updateCounts()
+}
+
+// SetEDNS adds an OPT record with the given UDP payload size and DO bit, or
+// updates the existing one, keeping its options and extended RCODE.
+func (m *Message) SetEDNS(udpSize uint16, do bool) *Message {
+	if m.EDNS == nil {
+		m.EDNS = &EDNS{}
+	}
+	m.EDNS.UDPSize = udpSize
+	m.EDNS.DO = do
+	return m.updateCounts()
+}
+
+// AddOption appends EDNS options, adding an OPT record if the message has
+// none.
+func (m *Message) AddOption(options ...EDNSOption) *Message {
+	if m.EDNS == nil {
+		m.EDNS = &EDNS{UDPSize: defaultUDPSize}
+	}
+	m.EDNS.Options = append(m.EDNS.Options, options...)
+	return m.updateCounts()
+}
+
+// updateCounts sets the section counts of the header from the sections.
+func (m *Message) updateCounts() *Message {
+	m.Header.QDCOUNT = m.Questions.Count()
+	m.Header.ANCOUNT = m.Answers.Count()
+	m.Header.NSCOUNT = m.Authority.Count()
+	m.Header.ARCOUNT = m.Additional.Count()
+	if m.EDNS != nil {
+		m.Header.ARCOUNT++
+	}
+	return m
+}
+
+// randomID returns a random message ID, so that responses are hard to spoof
+// (RFC 5452, section 9.2).
+func randomID() uint16 {
+	var b [2]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return uint16(mathrand.Intn(1 << 16))
+	}
+	return binary.BigEndian.Uint16(b[:])
+}
@@ -0,0 +1,82 @@
+package dns
+
+import (
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+)
+
+func TestNewQuery(t *testing.T) {
+	query := NewQuery("example.com", TypeAAAA).AddQuestion(NewQuestion("example.org", TypeA, ClassIN))
+
+	require.Equal(t, HeaderFlags{RD: 1}, query.Header.Flags)
+	require.Equal(t, uint16(2), query.Header.QDCOUNT)
+	require.Equal(t, Questions{NewQuestion("example.com", TypeAAAA, ClassIN), NewQuestion("example.org", TypeA, ClassIN)}, query.Questions)
+
+	ids := map[uint16]bool{}
+	for i := 0; i < 16; i++ {
+		ids[NewQuery("example.com", TypeA).Header.ID] = true
+	}
+	require.Greater(t, len(ids), 1, "IDs should be random")
+}
+
+func TestMessage_SetReply(t *testing.T) {
+	query := NewQuery("example.com", TypeA)
+	query.Header.Flags.CD = 1
+	query.SetEDNS(4096, true)
+
+	record := NewRecord(Name{"example", "com"}, ClassIN, 60, A{A: net.IPv4(192, 0, 2, 1).To4()})
+	reply := new(Message).SetReply(query).AddAnswer(record)
+
+	expected := Message{
+		Header: Header{
+			ID:      query.Header.ID,
+			Flags:   HeaderFlags{QR: 1, RD: 1, CD: 1},
+			QDCOUNT: 1,
+			ANCOUNT: 1,
+		},
+		Questions: query.Questions,
+		Answers:   Answers{record},
+	}
+	require.Equal(t, expected, *reply)
+
+	reply.Questions[0].TYPE = TypeAAAA
+	require.Equal(t, TypeA, query.Questions[0].TYPE, "SetReply should copy the questions")
+}
+
+func TestMessage_SetRcode(t *testing.T) {
+	m := new(Message).SetRcode(RcodeServFail)
+	require.Equal(t, RcodeServFail, m.Header.Flags.RCODE)
+	require.Nil(t, m.EDNS)
+
+	m.SetRcode(RcodeBadCookie)
+	require.Equal(t, RcodeBadCookie, m.Rcode())
+	require.Equal(t, &EDNS{UDPSize: defaultUDPSize, ExtendedRcode: 1}, m.EDNS)
+	require.Equal(t, uint16(1), m.Header.ARCOUNT)
+
+	m.SetRcode(RcodeNoError)
+	require.Equal(t, RcodeNoError, m.Rcode())
+}
+
+func TestMessage_BuilderCounts(t *testing.T) {
+	record := NewRecord(Name{"example", "com"}, ClassIN, 60, NS{Host: Name{"ns", "example", "com"}})
+
+	m := NewQuery("example.com", TypeNS).
+		AddAnswer(record, record).
+		AddAuthority(record).
+		AddAdditional(record).
+		AddOption(Cookie{Client: [8]byte{1}})
+
+	require.Equal(t, uint16(1), m.Header.QDCOUNT)
+	require.Equal(t, uint16(2), m.Header.ANCOUNT)
+	require.Equal(t, uint16(1), m.Header.NSCOUNT)
+	require.Equal(t, uint16(2), m.Header.ARCOUNT)
+	require.Equal(t, uint16(defaultUDPSize), m.EDNS.UDPSize)
+
+	m.SetEDNS(1400, true)
+	require.Equal(t, []EDNSOption{Cookie{Client: [8]byte{1}}}, m.EDNS.Options)
+
+	parsed, err := RawMessage(m.Serialize()).Parse()
+	require.NoError(t, err)
+	require.Equal(t, m.Header, parsed.Header)
+}
@@ -0,0 +1,258 @@
+package dns
+
+import (
+	"fmt"
+	"sync"
+)
+
+// maxPointerOffset is the largest message offset a compression pointer can
+// refer to, since only 14 bits are available for it.
+const maxPointerOffset = 0x3FFF
+
+// compressionTable records the offset of every name suffix written so far, so
+// that later occurrences can be replaced by a pointer (RFC 1035, section
+// 4.1.4). Suffixes are looked up in the message itself rather than kept as
+// keys, so that packing allocates nothing once the table has grown.
+//
+// As the pack methods cannot return errors, the table also keeps the first
+// invalid name met. A nil table disables compression and checking.
+type compressionTable struct {
+	offsets  []int
+	compress bool
+	err      error
+}
+
+// Errors recorded by the table, made once so that packing does not allocate.
+var (
+	// errEmptyLabel is recorded for a name with an empty label, which the
+	// wire format would take as the end of the name.
+	errEmptyLabel  = fmt.Errorf("%w: empty label", ErrInvalidName)
+	errInvalidA    = fmt.Errorf("%w: A record without an IPv4 address", ErrInvalidRDATA)
+	errInvalidAAAA = fmt.Errorf("%w: AAAA record without an IP address", ErrInvalidRDATA)
+)
+
+// compressionTables holds tables for reuse across messages.
+var compressionTables = sync.Pool{
+	New: func() interface{} { return &compressionTable{} },
+}
+
+// reset empties the table for a new message.
+func (ct *compressionTable) reset(compress bool) {
+	ct.offsets = ct.offsets[:0]
+	ct.compress = compress
+	ct.err = nil
+}
+
+// check records an error for a name that does not fit the wire format.
+func (ct *compressionTable) check(n Name) {
+	if ct.err != nil {
+		return
+	}
+
+	length := 1
+	for _, label := range n {
+		if len(label) == 0 {
+			ct.err = errEmptyLabel
+			return
+		}
+		if len(label) > maxLabelLength {
+			ct.err = ErrLabelTooLong
+			return
+		}
+		length += 1 + len(label)
+	}
+	if length > maxNameLength {
+		ct.err = ErrNameTooLong
+	}
+}
+
+// fail records err for RDATA that does not fit the wire format, unless an
+// error was recorded before.
+func (ct *compressionTable) fail(err error) {
+	if ct != nil && ct.err == nil {
+		ct.err = err
+	}
+}
+
+// add records that a name suffix starts at offset, if a pointer can reach it.
+func (ct *compressionTable) add(offset int) {
+	if offset <= maxPointerOffset {
+		ct.offsets = append(ct.offsets, offset)
+	}
+}
+
+// find returns the offset of a suffix already in buf made of the labels of
+// name, or false if there is none.
+func (ct *compressionTable) find(buf []byte, name Name) (int, bool) {
+	for _, offset := range ct.offsets {
+		if nameAt(buf, offset, name) {
+			return offset, true
+		}
+	}
+
+	return 0, false
+}
+
+// findWire is like find for a name in uncompressed wire form.
+func (ct *compressionTable) findWire(buf []byte, wire []byte) (int, bool) {
+	for _, offset := range ct.offsets {
+		if wireNameAt(buf, offset, wire) {
+			return offset, true
+		}
+	}
+
+	return 0, false
+}
+
+// nameAt reports whether the name written at offset in buf, with pointers
+// followed, has exactly the labels of name. buf only holds names written by
+// pack, whose pointers always point backwards, but the name at offset may
+// still be being written, e.g. when a label is repeated, so it may run off
+// the end of buf.
+func nameAt(buf []byte, offset int, name Name) bool {
+	for {
+		if offset >= len(buf) {
+			return false
+		}
+		length := int(buf[offset])
+		if length&0xC0 == 0xC0 {
+			if offset+1 >= len(buf) {
+				return false
+			}
+			offset = int(buf[offset]&0x3F)<<8 | int(buf[offset+1])
+			continue
+		}
+		if len(name) == 0 || length == 0 {
+			return len(name) == 0 && length == 0
+		}
+		if length != len(name[0]) || offset+1+length > len(buf) || string(buf[offset+1:offset+1+length]) != string(name[0]) {
+			return false
+		}
+		offset += 1 + length
+		name = name[1:]
+	}
+}
+
+// wireNameAt is like nameAt for a name in uncompressed wire form.
+func wireNameAt(buf []byte, offset int, wire []byte) bool {
+	for {
+		if offset >= len(buf) {
+			return false
+		}
+		length := int(buf[offset])
+		if length&0xC0 == 0xC0 {
+			if offset+1 >= len(buf) {
+				return false
+			}
+			offset = int(buf[offset]&0x3F)<<8 | int(buf[offset+1])
+			continue
+		}
+		if int(wire[0]) != length || offset+1+length > len(buf) || string(buf[offset+1:offset+1+length]) != string(wire[1:1+length]) {
+			return false
+		}
+		if length == 0 {
+			return true
+		}
+		offset += 1 + length
+		wire = wire[1+length:]
+	}
+}
+
+// pack appends the name to buf, which must hold the message from its first
+// octet so that offsets recorded in ct are correct.
+func (n Name) pack(buf []byte, ct *compressionTable) []byte {
+	if ct != nil {
+		ct.check(n)
+	}
+	// Once a name is invalid, stop compressing: its labels could be taken
+	// for pointers when looking up suffixes.
+	compress := ct != nil && ct.compress && ct.err == nil
+	for i, label := range n {
+		if compress {
+			if pointer, ok := ct.find(buf, n[i:]); ok {
+				return append(buf, 0xC0|byte(pointer>>8), byte(pointer))
+			}
+			ct.add(len(buf))
+		}
+		buf = append(buf, byte(len(label)))
+		buf = append(buf, label...)
+	}
+
+	return append(buf, 0x00)
+}
+
+// packWireName appends a name given in uncompressed wire form, compressing it
+// like Name.pack.
+func packWireName(buf []byte, ct *compressionTable, wire []byte) []byte {
+	for len(wire) > 1 {
+		if pointer, ok := ct.findWire(buf, wire); ok {
+			return append(buf, 0xC0|byte(pointer>>8), byte(pointer))
+		}
+		ct.add(len(buf))
+		length := 1 + int(wire[0])
+		buf = append(buf, wire[:length]...)
+		wire = wire[length:]
+	}
+
+	return append(buf, 0x00)
+}
+
+// packRDATA appends the RDATA of a record of type rrType to buf. Names inside
+// the RDATA of the well-known types listed in compressibleRDATA are compressed
+// as well; the RDATA of any other type is copied verbatim as RFC 3597
+// requires.
+func packRDATA(buf []byte, ct *compressionTable, rrType Type, rdata []byte) []byte {
+	layout, ok := compressibleRDATA[rrType]
+	if !ok || ct == nil || !ct.compress || ct.err != nil {
+		return append(buf, rdata...)
+	}
+
+	// Check all fields first, so that nothing is added to the compression
+	// table for RDATA we end up copying verbatim.
+	var ends [3]int
+	offset := 0
+	for i, size := range layout {
+		if size == 0 {
+			end, ok := uncompressedNameEnd(rdata, offset)
+			if !ok || end-offset > maxNameLength {
+				return append(buf, rdata...)
+			}
+			offset = end
+		} else {
+			offset += size
+		}
+		ends[i] = offset
+	}
+	if offset != len(rdata) {
+		return append(buf, rdata...)
+	}
+
+	offset = 0
+	for i, size := range layout {
+		if size == 0 {
+			buf = packWireName(buf, ct, rdata[offset:ends[i]])
+		} else {
+			buf = append(buf, rdata[offset:ends[i]]...)
+		}
+		offset = ends[i]
+	}
+
+	return buf
+}
+
+// uncompressedNameEnd returns the offset just past the uncompressed name that
+// starts at offset, or false if b does not hold one there.
+func uncompressedNameEnd(b []byte, offset int) (int, bool) {
+	for offset < len(b) {
+		length := int(b[offset])
+		if length == 0 {
+			return offset + 1, true
+		}
+		if length&0xC0 != 0 {
+			return 0, false
+		}
+		offset += 1 + length
+	}
+
+	return 0, false
+}
@@ -0,0 +1,243 @@
+package dns
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// OptionCodeCookie is the OPTION-CODE of the DNS COOKIE option.
+const OptionCodeCookie = 10
+
+const (
+	// serverCookieVersion is the server cookie format of RFC 9018.
+	serverCookieVersion = 1
+
+	// Server cookies are accepted for an hour and from up to five minutes in
+	// the future, and reissued once they are half an hour old (RFC 9018,
+	// section 4.3).
+	serverCookieLifetime = time.Hour
+	serverCookieSkew     = 5 * time.Minute
+	serverCookieRefresh  = 30 * time.Minute
+)
+
+// Cookie is the DNS COOKIE option (RFC 7873).
+type Cookie struct {
+	Client [8]byte
+	// Server is empty or holds 8 to 32 bytes.
+	Server []byte
+}
+
+func (Cookie) Code() uint16 { return OptionCodeCookie }
+
+// String returns the client and server cookies in hexadecimal.
+func (o Cookie) String() string {
+	return hex.EncodeToString(o.Client[:]) + hex.EncodeToString(o.Server)
+}
+
+func (o Cookie) pack(buf []byte) []byte {
+	buf = append(buf, o.Client[:]...)
+	return append(buf, o.Server...)
+}
+
+// parseCookie decodes the data of a COOKIE option. A malformed option is
+// reported as ErrInvalidRDATA, which calls for FORMERR (RFC 7873, section 5.2.2).
+func parseCookie(data []byte) (Cookie, error) {
+	if len(data) != 8 && (len(data) < 16 || len(data) > 40) {
+		return Cookie{}, fmt.Errorf("%w: cookie option length %d", ErrInvalidRDATA, len(data))
+	}
+
+	var o Cookie
+	copy(o.Client[:], data[:8])
+	if len(data) > 8 {
+		o.Server = append([]byte(nil), data[8:]...)
+	}
+
+	return o, nil
+}
+
+// ServerCookies issues and validates server cookies in the interoperable
+// format of RFC 9018, keyed with a secret that rotates periodically. Cookies
+// made with the previous secret stay valid until they expire.
+type ServerCookies struct {
+	mu       sync.Mutex
+	current  [16]byte
+	previous [16]byte
+	rotated  time.Time
+	rotation time.Duration
+
+	now func() time.Time
+}
+
+// NewServerCookies returns a ServerCookies whose secret is replaced every
+// rotation, which must be longer than the lifetime of a cookie (one hour).
+func NewServerCookies(rotation time.Duration) (*ServerCookies, error) {
+	s := &ServerCookies{rotation: rotation, now: time.Now}
+	if err := s.Rotate(); err != nil {
+		return nil, err
+	}
+	s.previous = s.current
+
+	return s, nil
+}
+
+// Rotate replaces the secret by a new random one.
+func (s *ServerCookies) Rotate() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.rotate(s.now())
+}
+
+func (s *ServerCookies) rotate(now time.Time) error {
+	var secret [16]byte
+	if _, err := rand.Read(secret[:]); err != nil {
+		return fmt.Errorf("error generating cookie secret: %w", err)
+	}
+
+	s.previous = s.current
+	s.current = secret
+	s.rotated = now
+
+	return nil
+}
+
+// Check validates the COOKIE option of query, received from clientIP. It
+// returns the option to include in the response, which carries a fresh server
+// cookie when needed, or nil if the query had no COOKIE option. valid is false
+// when the query presented a server cookie that does not validate, which
+// calls for a BADCOOKIE response.
+func (s *ServerCookies) Check(query Message, clientIP net.IP) (option *Cookie, valid bool) {
+	if query.EDNS == nil {
+		return nil, true
+	}
+	cookie, ok := query.EDNS.Option(OptionCodeCookie).(Cookie)
+	if !ok {
+		return nil, true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if s.rotation > 0 && now.Sub(s.rotated) >= s.rotation {
+		// On failure, keep using the current secret rather than fail the query.
+		_ = s.rotate(now)
+	}
+
+	issued, valid := s.validate(cookie, clientIP, now)
+	if valid && now.Sub(issued) < serverCookieRefresh {
+		return &cookie, true
+	}
+
+	return &Cookie{
+		Client: cookie.Client,
+		Server: serverCookie(s.current, cookie.Client, clientIP, now),
+	}, valid || len(cookie.Server) == 0
+}
+
+// validate reports whether the server cookie in cookie was issued to clientIP
+// with the current or previous secret and has not expired, and returns the
+// time it was issued at.
+func (s *ServerCookies) validate(cookie Cookie, clientIP net.IP, now time.Time) (time.Time, bool) {
+	if len(cookie.Server) != 16 || cookie.Server[0] != serverCookieVersion {
+		return time.Time{}, false
+	}
+
+	// The timestamp is compared using serial number arithmetic, so that it
+	// keeps working after it wraps in 2106 (RFC 9018, section 4.3).
+	timestamp := binary.BigEndian.Uint32(cookie.Server[4:8])
+	age := time.Duration(int32(uint32(now.Unix())-timestamp)) * time.Second
+	if age > serverCookieLifetime || age < -serverCookieSkew {
+		return time.Time{}, false
+	}
+	issued := now.Add(-age)
+
+	for _, secret := range [][16]byte{s.current, s.previous} {
+		expected := serverCookie(secret, cookie.Client, clientIP, issued)
+		if string(expected) == string(cookie.Server) {
+			return issued, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// serverCookie returns the server cookie of RFC 9018, section 4: version,
+// three reserved bytes, a timestamp and a SipHash-2-4 over all of those, the
+// client cookie and the client's address.
+func serverCookie(secret [16]byte, client [8]byte, clientIP net.IP, now time.Time) []byte {
+	cookie := make([]byte, 8, 16)
+	cookie[0] = serverCookieVersion
+	binary.BigEndian.PutUint32(cookie[4:8], uint32(now.Unix()))
+
+	input := make([]byte, 0, 8+8+net.IPv6len)
+	input = append(input, client[:]...)
+	input = append(input, cookie...)
+	if ip4 := clientIP.To4(); ip4 != nil {
+		input = append(input, ip4...)
+	} else {
+		input = append(input, clientIP.To16()...)
+	}
+
+	return binary.LittleEndian.AppendUint64(cookie, sipHash24(secret, input))
+}
+
+// clientCookies holds the state of a client speaking DNS cookies to one
+// server: its own cookie and the last server cookie it received.
+type clientCookies struct {
+	mu     sync.Mutex
+	client [8]byte
+	server []byte
+}
+
+// newClientCookies returns the cookie state for talking to server. The client
+// cookie is derived from a random secret and the server's address, so that
+// servers cannot use it to track us across each other (RFC 7873, section 4.1).
+func newClientCookies(server net.Addr) (*clientCookies, error) {
+	var secret [16]byte
+	if _, err := rand.Read(secret[:]); err != nil {
+		return nil, fmt.Errorf("error generating cookie secret: %w", err)
+	}
+
+	c := &clientCookies{}
+	binary.LittleEndian.PutUint64(c.client[:], sipHash24(secret, []byte(server.String())))
+
+	return c, nil
+}
+
+// option returns the COOKIE option to send in the next query.
+func (c *clientCookies) option() Cookie {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return Cookie{Client: c.client, Server: c.server}
+}
+
+// learn checks the COOKIE option of response r. It fails when the option does
+// not echo our client cookie, in which case r must be discarded as spoofed;
+// otherwise the server cookie is remembered for the following queries.
+func (c *clientCookies) learn(r Message) error {
+	if r.EDNS == nil {
+		return nil
+	}
+	cookie, ok := r.EDNS.Option(OptionCodeCookie).(Cookie)
+	if !ok {
+		return nil
+	}
+	if cookie.Client != c.client {
+		return fmt.Errorf("%w: client cookie does not match", ErrResponseMismatch)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(cookie.Server) > 0 {
+		c.server = cookie.Server
+	}
+
+	return nil
+}
@@ -0,0 +1,81 @@
+package dns
+
+import (
+	"encoding/hex"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServerCookie(t *testing.T) {
+	// Test vector from RFC 9018, appendix A.1.
+	var secret [16]byte
+	var client [8]byte
+	hex.Decode(secret[:], []byte("e5e973e5a6b2a43f48e7dc849e37bfcf"))
+	hex.Decode(client[:], []byte("2464c4abcf10c957"))
+
+	actual := serverCookie(secret, client, net.ParseIP("198.51.100.100"), time.Unix(1559731985, 0))
+
+	require.Equal(t, "010000005cf79f111f8130c3eee29480", hex.EncodeToString(actual))
+}
+
+func TestParseCookie(t *testing.T) {
+	client := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	actual, err := parseCookie(client)
+	require.NoError(t, err)
+	require.Equal(t, Cookie{Client: [8]byte{1, 2, 3, 4, 5, 6, 7, 8}}, actual)
+
+	for _, length := range []int{0, 7, 9, 15, 41} {
+		_, err := parseCookie(make([]byte, length))
+		require.ErrorIs(t, err, ErrInvalidRDATA, "Cookie of length %d should be rejected", length)
+	}
+}
+
+func TestServerCookies_Check(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	cookies, err := NewServerCookies(24 * time.Hour)
+	require.NoError(t, err)
+	cookies.now = func() time.Time { return now }
+
+	clientIP := net.ParseIP("192.0.2.1")
+	query := func(cookie *Cookie) Message {
+		m := Message{Questions: Questions{NewQuestion("example.com", TypeA, ClassIN)}}
+		if cookie != nil {
+			m.EDNS = &EDNS{UDPSize: 1232, Options: []EDNSOption{*cookie}}
+		}
+		return m
+	}
+
+	option, valid := cookies.Check(query(nil), clientIP)
+	require.Nil(t, option, "Queries without cookies get no cookie")
+	require.True(t, valid)
+
+	option, valid = cookies.Check(query(&Cookie{Client: [8]byte{1}}), clientIP)
+	require.True(t, valid, "A client cookie alone should be accepted")
+	require.Len(t, option.Server, 16)
+	issued := *option
+
+	now = now.Add(10 * time.Minute)
+	option, valid = cookies.Check(query(&issued), clientIP)
+	require.True(t, valid, "The issued cookie should validate")
+	require.Equal(t, issued, *option, "A recent cookie should not be reissued")
+
+	_, valid = cookies.Check(query(&issued), net.ParseIP("192.0.2.2"))
+	require.False(t, valid, "The cookie should not validate from another address")
+
+	require.NoError(t, cookies.Rotate())
+	_, valid = cookies.Check(query(&issued), clientIP)
+	require.True(t, valid, "Cookies made with the previous secret should still validate")
+
+	now = now.Add(25 * time.Minute)
+	option, valid = cookies.Check(query(&issued), clientIP)
+	require.True(t, valid)
+	require.NotEqual(t, issued.Server, option.Server, "An old cookie should be reissued")
+
+	now = now.Add(time.Hour)
+	option, valid = cookies.Check(query(&issued), clientIP)
+	require.False(t, valid, "An expired cookie should not validate")
+	require.Len(t, option.Server, 16, "A fresh cookie should be sent along with BADCOOKIE")
+}
@@ -0,0 +1,127 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+)
+
+// OptionCodeClientSubnet is the OPTION-CODE of the EDNS Client Subnet option.
+const OptionCodeClientSubnet = 8
+
+// Address families used by ClientSubnet (IANA Address Family Numbers).
+const (
+	FamilyIPv4 = 1
+	FamilyIPv6 = 2
+)
+
+// ClientSubnet is the EDNS Client Subnet option (RFC 7871).
+type ClientSubnet struct {
+	Family       uint16
+	SourcePrefix uint8
+	ScopePrefix  uint8
+	// Address holds the subnet with all bits past SourcePrefix cleared, as a
+	// 4-byte address for FamilyIPv4 and a 16-byte one for FamilyIPv6.
+	Address net.IP
+}
+
+// NewClientSubnet returns the option describing the subnet of ip with the
+// given prefix length, which is capped to the length of the address.
+func NewClientSubnet(ip net.IP, prefix uint8) ClientSubnet {
+	family, bits := uint16(FamilyIPv6), 128
+	if ip4 := ip.To4(); ip4 != nil {
+		family, bits, ip = FamilyIPv4, 32, ip4
+	}
+	if int(prefix) > bits {
+		prefix = uint8(bits)
+	}
+
+	return ClientSubnet{
+		Family:       family,
+		SourcePrefix: prefix,
+		Address:      ip.Mask(net.CIDRMask(int(prefix), bits)),
+	}
+}
+
+func (ClientSubnet) Code() uint16 { return OptionCodeClientSubnet }
+
+// String returns the option as "address/source/scope", e.g. "192.0.2.0/24/0".
+func (o ClientSubnet) String() string {
+	return fmt.Sprintf("%s/%d/%d", o.Address, o.SourcePrefix, o.ScopePrefix)
+}
+
+func (o ClientSubnet) pack(buf []byte) []byte {
+	buf = appendUint16ToSlice(buf, o.Family)
+	buf = append(buf, o.SourcePrefix, o.ScopePrefix)
+
+	address := o.Address.To16()
+	if o.Family == FamilyIPv4 {
+		address = o.Address.To4()
+	}
+	length := (int(o.SourcePrefix) + 7) / 8
+	if length > len(address) {
+		length = len(address)
+	}
+
+	return append(buf, address[:length]...)
+}
+
+// Truncate returns the option with its source prefix shortened to at most
+// prefix bits.
+func (o ClientSubnet) Truncate(prefix uint8) ClientSubnet {
+	if o.SourcePrefix <= prefix {
+		return o
+	}
+
+	truncated := NewClientSubnet(o.Address, prefix)
+	truncated.ScopePrefix = o.ScopePrefix
+	return truncated
+}
+
+// SameSubnet reports whether o and other describe the same source subnet,
+// ignoring the scope prefix. RFC 7871, section 7.3 requires this of a
+// response's option.
+func (o ClientSubnet) SameSubnet(other ClientSubnet) bool {
+	return o.Family == other.Family &&
+		o.SourcePrefix == other.SourcePrefix &&
+		o.Address.Equal(other.Address)
+}
+
+// parseClientSubnet decodes the data of an EDNS Client Subnet option.
+func parseClientSubnet(data []byte) (ClientSubnet, error) {
+	if len(data) < 4 {
+		return ClientSubnet{}, fmt.Errorf("%w: client subnet option length %d", ErrInvalidRDATA, len(data))
+	}
+
+	o := ClientSubnet{
+		Family:       uint16(data[0])<<8 | uint16(data[1]),
+		SourcePrefix: data[2],
+		ScopePrefix:  data[3],
+	}
+
+	var bits int
+	switch o.Family {
+	case FamilyIPv4:
+		bits = 32
+	case FamilyIPv6:
+		bits = 128
+	default:
+		return ClientSubnet{}, fmt.Errorf("%w: client subnet family %d", ErrInvalidRDATA, o.Family)
+	}
+	if int(o.SourcePrefix) > bits || int(o.ScopePrefix) > bits {
+		return ClientSubnet{}, fmt.Errorf("%w: client subnet prefix too long", ErrInvalidRDATA)
+	}
+
+	address := data[4:]
+	if len(address) != (int(o.SourcePrefix)+7)/8 {
+		return ClientSubnet{}, fmt.Errorf("%w: client subnet address length %d", ErrInvalidRDATA, len(address))
+	}
+
+	ip := make(net.IP, bits/8)
+	copy(ip, address)
+	if !ip.Mask(net.CIDRMask(int(o.SourcePrefix), bits)).Equal(ip) {
+		return ClientSubnet{}, fmt.Errorf("%w: client subnet address has bits past its prefix", ErrInvalidRDATA)
+	}
+	o.Address = ip
+
+	return o, nil
+}
@@ -0,0 +1,75 @@
+package dns
+
+import (
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+)
+
+func TestClientSubnet_RoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		option   ClientSubnet
+		expected []byte
+	}{
+		{
+			name:     "IPv4",
+			option:   NewClientSubnet(net.ParseIP("192.0.2.129"), 24),
+			expected: []byte{0x00, 0x01, 24, 0, 192, 0, 2},
+		},
+		{
+			name:     "IPv4 partial octet",
+			option:   NewClientSubnet(net.ParseIP("192.0.2.129"), 25),
+			expected: []byte{0x00, 0x01, 25, 0, 192, 0, 2, 128},
+		},
+		{
+			name:     "IPv6",
+			option:   NewClientSubnet(net.ParseIP("2001:db8:1:2::1"), 48),
+			expected: []byte{0x00, 0x02, 48, 0, 0x20, 0x01, 0x0d, 0xb8, 0x00, 0x01},
+		},
+		{
+			name:     "opt-out",
+			option:   NewClientSubnet(net.ParseIP("192.0.2.1"), 0),
+			expected: []byte{0x00, 0x01, 0, 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expected, tt.option.pack(nil), "Packed option should match expected value")
+
+			actual, err := parseEDNSOption(OptionCodeClientSubnet, tt.expected)
+
+			require.NoError(t, err)
+			require.True(t, tt.option.SameSubnet(actual.(ClientSubnet)), "Parsed option should match the packed one")
+		})
+	}
+}
+
+func TestParseClientSubnet_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"too short", []byte{0x00, 0x01, 24}},
+		{"unknown family", []byte{0x00, 0x03, 8, 0, 10}},
+		{"prefix too long", []byte{0x00, 0x01, 33, 0, 1, 2, 3, 4, 5}},
+		{"address too long", []byte{0x00, 0x01, 8, 0, 10, 0}},
+		{"bits past prefix", []byte{0x00, 0x01, 7, 0, 0x01}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseClientSubnet(tt.data)
+
+			require.ErrorIs(t, err, ErrInvalidRDATA)
+		})
+	}
+}
+
+func TestClientSubnet_Truncate(t *testing.T) {
+	option := NewClientSubnet(net.ParseIP("192.0.2.129"), 32)
+
+	require.Equal(t, NewClientSubnet(net.ParseIP("192.0.2.0"), 24), option.Truncate(24))
+	require.Equal(t, option, option.Truncate(32), "Shorter options should be left alone")
+}
@@ -0,0 +1,133 @@
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// OptionCodeExtendedError is the OPTION-CODE of the Extended DNS Error option.
+const OptionCodeExtendedError = 15
+
+// INFO-CODEs of the Extended DNS Error option (RFC 8914, section 4, and the
+// IANA registry).
+const (
+	ExtendedErrorOther                       = 0
+	ExtendedErrorUnsupportedDNSKEYAlgorithm  = 1
+	ExtendedErrorUnsupportedDSDigestType     = 2
+	ExtendedErrorStaleAnswer                 = 3
+	ExtendedErrorForgedAnswer                = 4
+	ExtendedErrorDNSSECIndeterminate         = 5
+	ExtendedErrorDNSSECBogus                 = 6
+	ExtendedErrorSignatureExpired            = 7
+	ExtendedErrorSignatureNotYetValid        = 8
+	ExtendedErrorDNSKEYMissing               = 9
+	ExtendedErrorRRSIGsMissing               = 10
+	ExtendedErrorNoZoneKeyBitSet             = 11
+	ExtendedErrorNSECMissing                 = 12
+	ExtendedErrorCachedError                 = 13
+	ExtendedErrorNotReady                    = 14
+	ExtendedErrorBlocked                     = 15
+	ExtendedErrorCensored                    = 16
+	ExtendedErrorFiltered                    = 17
+	ExtendedErrorProhibited                  = 18
+	ExtendedErrorStaleNXDOMAINAnswer         = 19
+	ExtendedErrorNotAuthoritative            = 20
+	ExtendedErrorNotSupported                = 21
+	ExtendedErrorNoReachableAuthority        = 22
+	ExtendedErrorNetworkError                = 23
+	ExtendedErrorInvalidData                 = 24
+	ExtendedErrorSignatureExpiredBeforeValid = 25
+	ExtendedErrorTooEarly                    = 26
+	ExtendedErrorUnsupportedNSEC3Iterations  = 27
+	ExtendedErrorUnableToConformToPolicy     = 28
+	ExtendedErrorSynthesized                 = 29
+	ExtendedErrorInvalidQueryType            = 30
+)
+
+var extendedErrorNames = map[uint16]string{
+	ExtendedErrorOther:                       "Other Error",
+	ExtendedErrorUnsupportedDNSKEYAlgorithm:  "Unsupported DNSKEY Algorithm",
+	ExtendedErrorUnsupportedDSDigestType:     "Unsupported DS Digest Type",
+	ExtendedErrorStaleAnswer:                 "Stale Answer",
+	ExtendedErrorForgedAnswer:                "Forged Answer",
+	ExtendedErrorDNSSECIndeterminate:         "DNSSEC Indeterminate",
+	ExtendedErrorDNSSECBogus:                 "DNSSEC Bogus",
+	ExtendedErrorSignatureExpired:            "Signature Expired",
+	ExtendedErrorSignatureNotYetValid:        "Signature Not Yet Valid",
+	ExtendedErrorDNSKEYMissing:               "DNSKEY Missing",
+	ExtendedErrorRRSIGsMissing:               "RRSIGs Missing",
+	ExtendedErrorNoZoneKeyBitSet:             "No Zone Key Bit Set",
+	ExtendedErrorNSECMissing:                 "NSEC Missing",
+	ExtendedErrorCachedError:                 "Cached Error",
+	ExtendedErrorNotReady:                    "Not Ready",
+	ExtendedErrorBlocked:                     "Blocked",
+	ExtendedErrorCensored:                    "Censored",
+	ExtendedErrorFiltered:                    "Filtered",
+	ExtendedErrorProhibited:                  "Prohibited",
+	ExtendedErrorStaleNXDOMAINAnswer:         "Stale NXDOMAIN Answer",
+	ExtendedErrorNotAuthoritative:            "Not Authoritative",
+	ExtendedErrorNotSupported:                "Not Supported",
+	ExtendedErrorNoReachableAuthority:        "No Reachable Authority",
+	ExtendedErrorNetworkError:                "Network Error",
+	ExtendedErrorInvalidData:                 "Invalid Data",
+	ExtendedErrorSignatureExpiredBeforeValid: "Signature Expired before Valid",
+	ExtendedErrorTooEarly:                    "Too Early",
+	ExtendedErrorUnsupportedNSEC3Iterations:  "Unsupported NSEC3 Iterations Value",
+	ExtendedErrorUnableToConformToPolicy:     "Unable to conform to policy",
+	ExtendedErrorSynthesized:                 "Synthesized",
+	ExtendedErrorInvalidQueryType:            "Invalid Query Type",
+}
+
+// ExtendedError is the Extended DNS Error option (RFC 8914).
+type ExtendedError struct {
+	InfoCode uint16
+	// ExtraText is an optional UTF-8 explanation meant for humans.
+	ExtraText string
+}
+
+func (ExtendedError) Code() uint16 { return OptionCodeExtendedError }
+
+func (o ExtendedError) pack(buf []byte) []byte {
+	buf = appendUint16ToSlice(buf, o.InfoCode)
+	return append(buf, o.ExtraText...)
+}
+
+// String describes the error as "22 (No Reachable Authority): upstream timeout".
+func (o ExtendedError) String() string {
+	name, ok := extendedErrorNames[o.InfoCode]
+	if !ok {
+		name = "Unassigned"
+	}
+	if o.ExtraText == "" {
+		return fmt.Sprintf("%d (%s)", o.InfoCode, name)
+	}
+	return fmt.Sprintf("%d (%s): %s", o.InfoCode, name, o.ExtraText)
+}
+
+// parseExtendedError decodes the data of an Extended DNS Error option.
+func parseExtendedError(data []byte) (ExtendedError, error) {
+	if len(data) < 2 {
+		return ExtendedError{}, fmt.Errorf("%w: extended error option length %d", ErrInvalidRDATA, len(data))
+	}
+
+	return ExtendedError{
+		InfoCode:  binary.BigEndian.Uint16(data[0:2]),
+		ExtraText: string(data[2:]),
+	}, nil
+}
+
+// ExtendedErrors returns the Extended DNS Error options of the message.
+func (m *Message) ExtendedErrors() []ExtendedError {
+	if m.EDNS == nil {
+		return nil
+	}
+
+	var errs []ExtendedError
+	for _, option := range m.EDNS.Options {
+		if e, ok := option.(ExtendedError); ok {
+			errs = append(errs, e)
+		}
+	}
+
+	return errs
+}
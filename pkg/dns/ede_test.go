@@ -0,0 +1,49 @@
+package dns
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestExtendedError_RoundTrip(t *testing.T) {
+	option := ExtendedError{InfoCode: ExtendedErrorNoReachableAuthority, ExtraText: "upstream timeout"}
+
+	packed := option.pack(nil)
+	require.Equal(t, append([]byte{0x00, 0x16}, "upstream timeout"...), packed)
+
+	actual, err := parseEDNSOption(OptionCodeExtendedError, packed)
+	require.NoError(t, err)
+	require.Equal(t, option, actual)
+
+	_, err = parseEDNSOption(OptionCodeExtendedError, []byte{0x00})
+	require.ErrorIs(t, err, ErrInvalidRDATA)
+}
+
+func TestExtendedError_String(t *testing.T) {
+	require.Equal(t, "15 (Blocked)", ExtendedError{InfoCode: ExtendedErrorBlocked}.String())
+	require.Equal(t, "3 (Stale Answer): served from cache", ExtendedError{InfoCode: ExtendedErrorStaleAnswer, ExtraText: "served from cache"}.String())
+	require.Equal(t, "49152 (Unassigned)", ExtendedError{InfoCode: 49152}.String())
+}
+
+func TestMessages_MergeKeepsExtendedErrors(t *testing.T) {
+	stale := ExtendedError{InfoCode: ExtendedErrorStaleAnswer}
+	network := ExtendedError{InfoCode: ExtendedErrorNetworkError}
+
+	messages := Messages{
+		Message{
+			Header:    Header{ID: 1234, Flags: HeaderFlags{QR: 1}},
+			Questions: Questions{NewQuestion("abc.com", TypeA, ClassIN)},
+			EDNS:      &EDNS{UDPSize: 1232, Options: []EDNSOption{stale}},
+		},
+		Message{
+			Header:    Header{ID: 1234, Flags: HeaderFlags{QR: 1}},
+			Questions: Questions{NewQuestion("def.com", TypeA, ClassIN)},
+			EDNS:      &EDNS{UDPSize: 1232, Options: []EDNSOption{network}},
+		},
+	}
+
+	merged := messages.Merge()
+
+	require.Equal(t, []ExtendedError{stale, network}, merged.ExtendedErrors())
+	require.Equal(t, []ExtendedError{stale}, messages[0].ExtendedErrors(), "Merge should not modify its input")
+}
@@ -0,0 +1,238 @@
+package dns
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// EDNS holds the contents of the OPT pseudo-record of EDNS(0) (RFC 6891). On a
+// Message it replaces the OPT record of the additional section.
+type EDNS struct {
+	// UDPSize is the largest UDP payload the sender can reassemble.
+	UDPSize uint16
+	// ExtendedRcode holds the upper 8 bits of the 12-bit RCODE, whose lower 4
+	// bits stay in the header.
+	ExtendedRcode uint8
+	Version       uint8
+	// DO is the DNSSEC OK bit (RFC 3225).
+	DO      bool
+	Options []EDNSOption
+}
+
+// EDNSOption is one option carried in the RDATA of an OPT record.
+type EDNSOption interface {
+	// Code returns the OPTION-CODE of the option.
+	Code() uint16
+	// String returns the option data in the form dig shows it.
+	String() string
+
+	pack(buf []byte) []byte
+}
+
+// RawOption holds an option without a dedicated decoder.
+type RawOption struct {
+	OptionCode uint16
+	Data       []byte
+}
+
+// OPT is the RDATA of an OPT record (RFC 6891, section 6.1.2).
+type OPT struct {
+	Options []EDNSOption
+}
+
+func (o RawOption) Code() uint16 { return o.OptionCode }
+
+func (o RawOption) pack(buf []byte) []byte {
+	return append(buf, o.Data...)
+}
+
+func (o RawOption) String() string { return hex.EncodeToString(o.Data) }
+
+func (OPT) Type() Type { return TypeOPT }
+
+// String lists the options, each as "NAME: data".
+func (r OPT) String() string {
+	options := make([]string, len(r.Options))
+	for i, option := range r.Options {
+		options[i] = optionName(option.Code()) + ": " + option.String()
+	}
+	return strings.Join(options, " ")
+}
+
+func (r OPT) pack(buf []byte, _ *compressionTable) []byte {
+	for _, option := range r.Options {
+		buf = appendUint16ToSlice(buf, option.Code())
+		lengthOffset := len(buf)
+		buf = appendUint16ToSlice(buf, 0)
+		buf = option.pack(buf)
+		binary.BigEndian.PutUint16(buf[lengthOffset:], uint16(len(buf)-lengthOffset-2))
+	}
+
+	return buf
+}
+
+// Option returns the first option with the given code, or nil if there is none.
+func (e *EDNS) Option(code uint16) EDNSOption {
+	for _, option := range e.Options {
+		if option.Code() == code {
+			return option
+		}
+	}
+
+	return nil
+}
+
+// String describes e like the OPT pseudo-section of dig, one line per option.
+func (e *EDNS) String() string {
+	var flags string
+	if e.DO {
+		flags = " do"
+	}
+	lines := []string{fmt.Sprintf("; EDNS: version: %d, flags:%s; udp: %d", e.Version, flags, e.UDPSize)}
+	for _, option := range e.Options {
+		lines = append(lines, "; "+optionName(option.Code())+": "+option.String())
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// optionName returns the name dig uses for an option code.
+func optionName(code uint16) string {
+	switch code {
+	case OptionCodeClientSubnet:
+		return "CLIENT-SUBNET"
+	case OptionCodeCookie:
+		return "COOKIE"
+	case OptionCodeExtendedError:
+		return "EDE"
+	default:
+		return fmt.Sprintf("OPT=%d", code)
+	}
+}
+
+// record returns the OPT pseudo-record carrying e.
+func (e *EDNS) record() Answer {
+	return NewRecord(Name{}, Class(e.UDPSize), e.ttl(), OPT{Options: e.Options})
+}
+
+// pack appends the OPT pseudo-record carrying e to buf, without building the
+// record first.
+func (e *EDNS) pack(buf []byte) []byte {
+	buf = append(buf, 0x00)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(TypeOPT))
+	buf = binary.BigEndian.AppendUint16(buf, e.UDPSize)
+	buf = binary.BigEndian.AppendUint32(buf, e.ttl())
+
+	rdLengthOffset := len(buf)
+	buf = binary.BigEndian.AppendUint16(buf, 0)
+	buf = OPT{Options: e.Options}.pack(buf, nil)
+	binary.BigEndian.PutUint16(buf[rdLengthOffset:], uint16(len(buf)-rdLengthOffset-2))
+
+	return buf
+}
+
+// ttl returns the TTL field of the OPT record, which holds the extended RCODE,
+// the version and the flags.
+func (e *EDNS) ttl() uint32 {
+	ttl := uint32(e.ExtendedRcode)<<24 | uint32(e.Version)<<16
+	if e.DO {
+		ttl |= 1 << 15
+	}
+
+	return ttl
+}
+
+// newEDNS returns the EDNS information carried by an OPT pseudo-record.
+func newEDNS(opt Answer) EDNS {
+	edns := EDNS{
+		UDPSize:       uint16(opt.CLASS),
+		ExtendedRcode: uint8(opt.TTL >> 24),
+		Version:       uint8(opt.TTL >> 16),
+		DO:            opt.TTL&(1<<15) != 0,
+	}
+	if data, ok := opt.Data.(OPT); ok {
+		edns.Options = data.Options
+	}
+
+	return edns
+}
+
+// parseAdditional parses the additional section like parseAnswers, except that
+// the OPT pseudo-record is returned as EDNS instead of as a record. The EDNS is
+// decoded into reuse, with the capacity of its options, if it is not nil.
+func (d *decoder) parseAdditional(additional Answers, offset int, count uint16, reuse *EDNS) (Answers, *EDNS, error) {
+	if reuse != nil {
+		d.options = reuse.Options[:0]
+	}
+
+	var edns *EDNS
+	for i := 0; i < int(count); i++ {
+		answer, endOfRecord, err := d.readAnswer(offset)
+		if err != nil {
+			return nil, nil, inSection(err, "additional", i)
+		}
+
+		if answer.TYPE == TypeOPT {
+			if edns != nil {
+				return nil, nil, inSection(errorAt(offset, ErrInvalidOPT), "additional", i)
+			}
+			if len(answer.NAME) != 0 {
+				return nil, nil, inSection(errorAt(offset, ErrInvalidOPT), "additional", i)
+			}
+			edns = reuse
+			if edns == nil {
+				edns = new(EDNS)
+			}
+			*edns = newEDNS(answer)
+		} else {
+			additional = append(additional, answer)
+		}
+
+		offset = endOfRecord
+	}
+
+	return additional, edns, nil
+}
+
+// readOPT decodes the options in the RDATA of an OPT record between offset and
+// end, appending them to the options the decoder was given, if any.
+func (d *decoder) readOPT(offset int, end int) (OPT, error) {
+	opt := OPT{Options: d.options}
+	d.options = nil
+	for offset < end {
+		if offset+4 > end {
+			return OPT{}, errorAt(offset, fmt.Errorf("%w: truncated EDNS option", ErrInvalidRDATA))
+		}
+		code := binary.BigEndian.Uint16(d.msg[offset : offset+2])
+		length := int(binary.BigEndian.Uint16(d.msg[offset+2 : offset+4]))
+		if offset+4+length > end {
+			return OPT{}, errorAt(offset, fmt.Errorf("%w: EDNS option length %d", ErrInvalidRDATA, length))
+		}
+
+		option, err := parseEDNSOption(code, d.msg[offset+4:offset+4+length])
+		if err != nil {
+			return OPT{}, errorAt(offset, err)
+		}
+		opt.Options = append(opt.Options, option)
+
+		offset += 4 + length
+	}
+
+	return opt, nil
+}
+
+// parseEDNSOption decodes the data of an option with the given code.
+func parseEDNSOption(code uint16, data []byte) (EDNSOption, error) {
+	switch code {
+	case OptionCodeClientSubnet:
+		return parseClientSubnet(data)
+	case OptionCodeCookie:
+		return parseCookie(data)
+	case OptionCodeExtendedError:
+		return parseExtendedError(data)
+	default:
+		return RawOption{OptionCode: code, Data: append([]byte(nil), data...)}, nil
+	}
+}
@@ -0,0 +1,94 @@
+package dns
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestMessage_SerializeWithEDNS(t *testing.T) {
+	var expected = []byte{
+		// Header
+		0x04, 0xD2, // ID
+		0x01, 0x00, // Flags
+		0x00, 0x01, // QDCOUNT
+		0x00, 0x00, // ANCOUNT
+		0x00, 0x00, // NSCOUNT
+		0x00, 0x01, // ARCOUNT
+		// Question
+		0x06, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x03, 0x63, 0x6f, 0x6d, 0x0,
+		0x00, 0x01,
+		0x00, 0x01,
+		// OPT
+		0x00,       // root
+		0x00, 0x29, // TYPE OPT
+		0x10, 0x00, // UDP payload size 4096
+		0x01, 0x00, 0x80, 0x00, // extended RCODE 1, version 0, DO
+		0x00, 0x06, // RDLENGTH
+		0xff, 0x00, 0x00, 0x02, 0xab, 0xcd, // option 65280
+	}
+
+	message := Message{
+		Header: Header{
+			ID: 1234,
+			Flags: HeaderFlags{
+				RD: 1,
+			},
+		},
+		Questions: Questions{NewQuestion("google.com", TypeA, ClassIN)},
+		EDNS: &EDNS{
+			UDPSize:       4096,
+			ExtendedRcode: 1,
+			DO:            true,
+			Options:       []EDNSOption{RawOption{OptionCode: 65280, Data: []byte{0xab, 0xcd}}},
+		},
+	}
+
+	require.Equal(t, expected, message.Serialize(), "Serialized message should carry the OPT record")
+
+	actual, err := RawMessage(expected).Parse()
+
+	require.NoError(t, err)
+	require.Equal(t, message.EDNS, actual.EDNS, "Parsed EDNS should match expected value")
+	require.Empty(t, actual.Additional, "OPT record should not be left in the additional section")
+	require.Equal(t, RcodeBadVers, actual.Rcode(), "Extended RCODE should be combined with the header")
+}
+
+func TestRawMessage_ParseRejectsInvalidOPT(t *testing.T) {
+	opt := []byte{
+		0x00,       // root
+		0x00, 0x29, // TYPE OPT
+		0x02, 0x00, // UDP payload size 512
+		0x00, 0x00, 0x00, 0x00, // TTL
+		0x00, 0x00, // RDLENGTH
+	}
+	header := []byte{0x04, 0xd2, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02}
+
+	t.Run("duplicate OPT", func(t *testing.T) {
+		data := append(append(append([]byte{}, header...), opt...), opt...)
+
+		_, err := RawMessage(data).Parse()
+
+		require.ErrorIs(t, err, ErrInvalidOPT)
+	})
+
+	t.Run("non-root owner", func(t *testing.T) {
+		data := append(append([]byte{}, header...), 0x01, 0x61)
+		data = append(data, opt...)
+		data[11] = 1
+
+		_, err := RawMessage(data).Parse()
+
+		require.ErrorIs(t, err, ErrInvalidOPT)
+	})
+
+	t.Run("truncated option", func(t *testing.T) {
+		data := append(append([]byte{}, header...), opt...)
+		data[11] = 1
+		data[len(data)-1] = 3
+		data = append(data, 0x00, 0x08, 0x00)
+
+		_, err := RawMessage(data).Parse()
+
+		require.ErrorIs(t, err, ErrInvalidRDATA)
+	})
+}
@@ -0,0 +1,125 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrTruncatedMessage is reported when a message ends in the middle of a
+	// header, name or record.
+	ErrTruncatedMessage = errors.New("message truncated")
+
+	// ErrLabelTooLong is reported for a label length octet above 63. The
+	// extended label types that once used those values are obsolete (RFC 6891,
+	// section 5).
+	ErrLabelTooLong = errors.New("label longer than 63 octets")
+
+	// ErrNameTooLong is reported for a name longer than 255 octets in wire
+	// form, once compression pointers are followed.
+	ErrNameTooLong = errors.New("name longer than 255 octets")
+
+	// ErrForwardPointer is reported for a compression pointer that does not
+	// point to an earlier part of the message.
+	ErrForwardPointer = errors.New("compression pointer does not point backwards")
+
+	// ErrPointerLoop is reported when compression pointers revisit an offset
+	// or are chained deeper than any valid name needs.
+	ErrPointerLoop = errors.New("compression pointer loop")
+
+	// ErrInvalidRDATA is reported when RDATA does not match the format of its
+	// type or its RDLENGTH.
+	ErrInvalidRDATA = errors.New("invalid RDATA")
+
+	// ErrInvalidOPT is reported for an OPT pseudo-record with a name other
+	// than the root, or for more than one OPT record (RFC 6891, section 6.1.1).
+	ErrInvalidOPT = errors.New("invalid OPT record")
+
+	// ErrMessageTooLarge is reported by Message.Pack for a message longer than
+	// 65535 octets, the most a DNS message can hold over TCP.
+	ErrMessageTooLarge = errors.New("message longer than 65535 octets")
+
+	// ErrInvalidName is reported by ParseName for text that is not a domain
+	// name in presentation format.
+	ErrInvalidName = errors.New("invalid domain name")
+
+	// ErrInvalidRecord is reported by ParseRecord for text that is not a
+	// resource record in presentation format.
+	ErrInvalidRecord = errors.New("invalid resource record")
+
+	// ErrUpstreamTimeout is the kind of ForwardError reported when no
+	// upstream resolver answered in time.
+	ErrUpstreamTimeout = errors.New("upstream timeout")
+
+	// ErrUpstreamUnreachable is the kind of ForwardError reported when the
+	// upstream resolvers could not be reached, e.g. refused the connection.
+	ErrUpstreamUnreachable = errors.New("upstream unreachable")
+
+	// ErrMalformedResponse is the kind of ForwardError reported when an
+	// upstream resolver answered with a message that does not parse or does
+	// not answer the query.
+	ErrMalformedResponse = errors.New("malformed upstream response")
+)
+
+// ForwardError is returned by Forwarder when a query could not be forwarded.
+// errors.Is reports whether it is of a given kind, e.g. ErrUpstreamTimeout.
+type ForwardError struct {
+	// Kind is ErrUpstreamTimeout, ErrUpstreamUnreachable or
+	// ErrMalformedResponse.
+	Kind error
+	// Err is the error of the last attempt.
+	Err error
+}
+
+func (e *ForwardError) Error() string {
+	return fmt.Sprintf("error forwarding query: %v: %v", e.Kind, e.Err)
+}
+
+func (e *ForwardError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ForwardError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// ParseError describes where parsing a message failed.
+type ParseError struct {
+	// Section is the message section being parsed: "header", "question",
+	// "answer", "authority" or "additional".
+	Section string
+	// Index is the position of the offending entry within Section.
+	Index int
+	// Offset is the byte offset in the message at which the problem was found.
+	Offset int
+	Err    error
+}
+
+func (e *ParseError) Error() string {
+	if e.Section == "header" {
+		return fmt.Sprintf("error parsing header at offset %d: %v", e.Offset, e.Err)
+	}
+	return fmt.Sprintf("error parsing %s %d at offset %d: %v", e.Section, e.Index, e.Offset, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// errorAt returns a ParseError for err found at offset. The section and index
+// are filled in by inSection once the error reaches the section parser.
+func errorAt(offset int, err error) *ParseError {
+	return &ParseError{Offset: offset, Err: err}
+}
+
+// inSection records the section and entry index in err, which must have been
+// created by errorAt.
+func inSection(err error, section string, index int) error {
+	var pe *ParseError
+	if !errors.As(err, &pe) {
+		return &ParseError{Section: section, Index: index, Err: err}
+	}
+	pe.Section = section
+	pe.Index = index
+	return pe
+}
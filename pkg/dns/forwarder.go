@@ -1,55 +1,703 @@
 package dns
 
 import (
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"math/rand"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// ErrResponseMismatch is returned when the upstream resolver answers with a
+// message that is not a response to the query, e.g. whose ID or question is
+// not that of the query.
+var ErrResponseMismatch = errors.New("response does not match query")
+
+// upstreamUDPSize is the UDP payload size advertised to upstream resolvers,
+// and therefore the size of the buffer their responses are read into.
+const upstreamUDPSize = 4096
+
+// ECSPolicy selects what the forwarder does with EDNS Client Subnet options.
+type ECSPolicy int
+
+const (
+	// ECSStrip never sends a client subnet upstream.
+	ECSStrip ECSPolicy = iota
+	// ECSPassThrough sends upstream the client's own option, if any.
+	ECSPassThrough
+	// ECSSynthesize sends the client's own option if it has one, and one
+	// derived from the client's source address otherwise.
+	ECSSynthesize
+)
+
+// Transport selects how the forwarder talks to the upstream resolver.
+type Transport int
+
+const (
+	// TransportUDP sends queries over UDP, and retries over TCP when a
+	// response comes back truncated (RFC 7766, section 5).
+	TransportUDP Transport = iota
+	// TransportTCP sends every query over TCP.
+	TransportTCP
+)
+
 type Forwarder struct {
-	udpAddr *net.UDPAddr
+	upstreams []*upstream
+	strategy  Strategy
+	next      atomic.Uint32
+	transport Transport
+
+	ecsPolicy     ECSPolicy
+	ecsIPv4Prefix uint8
+	ecsIPv6Prefix uint8
+
+	useCookies bool
+
+	dialTimeout        time.Duration
+	readTimeout        time.Duration
+	queryTimeout       time.Duration
+	retries            int
+	retryBackoff       time.Duration
+	retryOtherUpstream bool
+
+	pool     *socketPool
+	poolSize int
+
+	maxFailures   int
+	cooldown      time.Duration
+	probeInterval time.Duration
+	probeName     string
+	done          chan struct{}
+	closeOnce     sync.Once
 }
 
-func NewForwarder(resolverAddress string) (*Forwarder, error) {
-	udpAddr, err := net.ResolveUDPAddr("udp", resolverAddress)
-	if err != nil {
-		return nil, fmt.Errorf("error resolving UDP address: %w", err)
+// ForwarderOption configures a Forwarder created by NewForwarder.
+type ForwarderOption func(*Forwarder)
+
+// WithECS sets the EDNS Client Subnet policy. Any subnet sent upstream,
+// whether the client's or synthesized, is truncated to ipv4Prefix or
+// ipv6Prefix bits.
+func WithECS(policy ECSPolicy, ipv4Prefix uint8, ipv6Prefix uint8) ForwarderOption {
+	return func(f *Forwarder) {
+		f.ecsPolicy = policy
+		f.ecsIPv4Prefix = ipv4Prefix
+		f.ecsIPv6Prefix = ipv6Prefix
 	}
-	return &Forwarder{udpAddr: udpAddr}, nil
 }
 
-func (f *Forwarder) Forward(m Message) (Message, error) {
-	conn, err := net.DialUDP("udp", nil, f.udpAddr)
-	if err != nil {
-		return Message{}, fmt.Errorf("error dialing UDP: %w", err)
+// WithCookies enables or disables DNS cookies (RFC 7873) towards the upstream
+// resolver. They are enabled by default.
+func WithCookies(enabled bool) ForwarderOption {
+	return func(f *Forwarder) {
+		f.useCookies = enabled
 	}
-	defer conn.Close()
+}
+
+// WithTransport sets the transport used towards the upstream resolver. It is
+// TransportUDP by default.
+func WithTransport(transport Transport) ForwarderOption {
+	return func(f *Forwarder) {
+		f.transport = transport
+	}
+}
+
+// WithStrategy sets the order in which the upstream resolvers are tried. It is
+// StrategyFailover by default.
+func WithStrategy(strategy Strategy) ForwarderOption {
+	return func(f *Forwarder) {
+		f.strategy = strategy
+	}
+}
+
+// WithTimeouts bounds the time taken to connect to an upstream over TCP, and
+// to wait for its response to one attempt. They are 2 seconds by default.
+func WithTimeouts(dial, read time.Duration) ForwarderOption {
+	return func(f *Forwarder) {
+		f.dialTimeout = dial
+		f.readTimeout = read
+	}
+}
+
+// WithQueryTimeout bounds the time taken to forward one message, retries
+// included, however many questions it has. It is 5 seconds by default.
+func WithQueryTimeout(timeout time.Duration) ForwarderOption {
+	return func(f *Forwarder) {
+		f.queryTimeout = timeout
+	}
+}
+
+// WithRetries sends a query up to retries more times to each upstream that
+// fails to answer it, waiting a jittered backoff that doubles with every
+// retry. If otherUpstream is set, a query moves on to the next upstream
+// before being retried, as it does by default; otherwise each upstream is
+// retried before the next one is tried. There are no retries by default.
+func WithRetries(retries int, backoff time.Duration, otherUpstream bool) ForwarderOption {
+	return func(f *Forwarder) {
+		f.retries = retries
+		f.retryBackoff = backoff
+		f.retryOtherUpstream = otherUpstream
+	}
+}
 
-	messages := Messages{}
-	for _, message := range m.Split() {
-		_, err = conn.Write(message.Serialize())
+// WithSocketPool sets the number of UDP sockets to each upstream resolver
+// shared by all queries to it, each bound to a random port. The sockets are
+// connected, so that a query to an upstream that cannot be reached fails at
+// once. There are 4 by default.
+func WithSocketPool(size int) ForwarderOption {
+	return func(f *Forwarder) {
+		f.poolSize = size
+	}
+}
+
+// NewForwarder returns a forwarder to the upstream resolvers at
+// resolverAddresses, of which there must be at least one. Close must be
+// called to release it.
+func NewForwarder(resolverAddresses []string, opts ...ForwarderOption) (*Forwarder, error) {
+	if len(resolverAddresses) == 0 {
+		return nil, errors.New("no resolver address")
+	}
+
+	f := &Forwarder{
+		ecsPolicy:     ECSStrip,
+		ecsIPv4Prefix: 24,
+		ecsIPv6Prefix: 56,
+		useCookies:    true,
+
+		dialTimeout:        2 * time.Second,
+		readTimeout:        2 * time.Second,
+		queryTimeout:       5 * time.Second,
+		retryBackoff:       100 * time.Millisecond,
+		retryOtherUpstream: true,
+
+		poolSize: 4,
+
+		maxFailures: 3,
+		cooldown:    30 * time.Second,
+		done:        make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+
+	var probeName Name
+	if f.probeInterval > 0 {
+		var err error
+		probeName, err = ParseName(f.probeName)
 		if err != nil {
-			return Message{}, fmt.Errorf("error sending DNS request: %w", err)
+			return nil, fmt.Errorf("error parsing health check name: %w", err)
 		}
+	}
 
-		err = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, address := range resolverAddresses {
+		udpAddr, err := net.ResolveUDPAddr("udp", address)
 		if err != nil {
-			return Message{}, fmt.Errorf("error setting read deadline: %w", err)
+			return nil, fmt.Errorf("error resolving UDP address: %w", err)
 		}
 
-		buffer := make([]byte, 1024)
-		length, _, err := conn.ReadFromUDP(buffer)
+		u := &upstream{addr: udpAddr}
+		if f.useCookies {
+			u.cookies, err = newClientCookies(udpAddr)
+			if err != nil {
+				return nil, err
+			}
+		}
+		f.upstreams = append(f.upstreams, u)
+	}
+
+	if f.transport == TransportUDP {
+		if f.poolSize < 1 {
+			return nil, errors.New("empty socket pool")
+		}
+		var err error
+		f.pool, err = newSocketPool(f.poolSize, f.upstreams)
 		if err != nil {
-			return Message{}, fmt.Errorf("error reading UDP response: %w", err)
+			return nil, err
+		}
+	}
+
+	if f.probeInterval > 0 {
+		go f.probe(probeName)
+	}
+
+	return f, nil
+}
+
+// Close stops the health probes and closes the sockets of the forwarder, which
+// cannot be used afterwards.
+func (f *Forwarder) Close() {
+	f.closeOnce.Do(func() {
+		close(f.done)
+		if f.pool != nil {
+			f.pool.close()
 		}
+	})
+}
 
-		resMessage, err := RawMessage(buffer[:length]).Parse()
+// Forward forwards m, as ForwardFrom does for an unknown client.
+func (f *Forwarder) Forward(ctx context.Context, m Message) (Message, error) {
+	return f.ForwardFrom(ctx, m, nil)
+}
+
+// ForwardMessage forwards m without a context.
+//
+// Deprecated: Use Forward, which can be cancelled.
+func (f *Forwarder) ForwardMessage(m Message) (Message, error) {
+	return f.Forward(context.Background(), m)
+}
+
+// ForwardFrom forwards m on behalf of the client at address client, which is
+// used to synthesize an EDNS Client Subnet option. client may be nil.
+//
+// Each question is sent upstream in a query of its own, all at once and
+// within a shared deadline, the query timeout or that of ctx if earlier. A
+// question that cannot be answered gets SERVFAIL in the merged response, and
+// an error is only returned if none can: a *ForwardError, or the error of ctx
+// if it was cancelled. A message without a question gets FORMERR.
+func (f *Forwarder) ForwardFrom(ctx context.Context, m Message, client net.IP) (Message, error) {
+	// There is nothing to ask upstream for a message without a question, and
+	// merging no responses would not make a response.
+	if len(m.Questions) == 0 {
+		return *new(Message).SetReply(&m).SetRcode(RcodeFormErr), nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, f.queryTimeout)
+	defer cancel()
+
+	clientSubnet, hasClientSubnet := queryClientSubnet(m)
+	upstreamSubnet, hasUpstreamSubnet := f.upstreamClientSubnet(m, client)
+
+	queries := m.Split()
+	results := make([]forwardResult, len(queries))
+	var wg sync.WaitGroup
+	for i := range queries {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			query := queries[i]
+			query.EDNS = &EDNS{UDPSize: upstreamUDPSize}
+			if hasUpstreamSubnet {
+				query.EDNS.Options = []EDNSOption{upstreamSubnet}
+			}
+			results[i] = f.forward(ctx, query)
+		}(i)
+	}
+	wg.Wait()
+
+	messages := make(Messages, len(queries))
+	var firstErr error
+	failed := 0
+	for i, result := range results {
+		err := result.err
+		if err == nil && hasUpstreamSubnet {
+			if subnet, ok := queryClientSubnet(result.response); ok && subnet.ScopePrefix > clientSubnet.ScopePrefix {
+				clientSubnet.ScopePrefix = subnet.ScopePrefix
+			}
+		}
 		if err != nil {
-			return Message{}, fmt.Errorf("error parsing UDP response: %w", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			failed++
+			messages[i] = failedResponse(queries[i], err)
+			continue
 		}
 
-		messages = append(messages, resMessage)
+		messages[i] = result.response
+	}
+	if failed > 0 && failed == len(queries) {
+		return Message{}, firstErr
+	}
+
+	rm := messages.Merge()
+	rm.Header.ID = m.Header.ID
+
+	// The upstream's client subnet describes the subnet we sent, and its
+	// cookie is ours, so neither is meant for the client. The client gets its
+	// own subnet back, carrying the scope the upstream returned.
+	if rm.EDNS != nil {
+		edns := *rm.EDNS
+		edns.Options = nil
+		for _, option := range rm.EDNS.Options {
+			if option.Code() != OptionCodeClientSubnet && option.Code() != OptionCodeCookie {
+				edns.Options = append(edns.Options, option)
+			}
+		}
+		rm.EDNS = &edns
+	}
+	if hasClientSubnet && f.ecsPolicy != ECSStrip {
+		if rm.EDNS == nil {
+			rm.EDNS = &EDNS{UDPSize: upstreamUDPSize}
+		}
+		rm.EDNS.Options = append(rm.EDNS.Options, clientSubnet)
+	}
+
+	return rm, nil
+}
+
+// forwardResult is the outcome of forwarding one of the queries of Split.
+type forwardResult struct {
+	response Message
+	err      error
+}
+
+// forward sends query to the upstreams in the order of the strategy,
+// retrying as configured, until one of them answers before ctx is done, and
+// returns the response. Upstreams whose circuit is open are skipped, unless
+// all of them are.
+func (f *Forwarder) forward(ctx context.Context, query Message) forwardResult {
+	var err error
+	attempts := f.attempts(f.order())
+	for _, force := range []bool{false, true} {
+		tried := make(map[*upstream]bool)
+		retries := 0
+		for _, u := range attempts {
+			// Only a trial claimed here is given back when the query is
+			// given up on; one claimed by another query is not ours.
+			trial := false
+			if !force {
+				var allowed bool
+				if allowed, trial = u.allow(time.Now(), f.cooldown); !allowed {
+					continue
+				}
+			}
+			if tried[u] {
+				retries++
+				if !sleep(ctx, f.backoff(retries)) {
+					if trial {
+						u.abandon()
+					}
+					break
+				}
+			}
+			tried[u] = true
+
+			start := time.Now()
+			attemptCtx, cancel := context.WithTimeout(ctx, f.readTimeout)
+			var response Message
+			response, err = f.forwardTo(attemptCtx, u, query)
+			cancel()
+			if errors.Is(ctx.Err(), context.Canceled) {
+				// The upstream is not to blame for the client giving up.
+				if trial {
+					u.abandon()
+				}
+				return forwardResult{err: fmt.Errorf("error forwarding query: %w", ctx.Err())}
+			}
+			u.observe(f.rttSample(time.Since(start), err))
+			u.report(time.Now(), err, f.maxFailures)
+			if err == nil {
+				return forwardResult{response: response}
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		if len(tried) > 0 {
+			break
+		}
+	}
+
+	return forwardResult{err: newForwardError(err)}
+}
+
+// attempts returns the upstreams to send a query to, in order, each of them
+// once plus once per retry.
+func (f *Forwarder) attempts(upstreams []*upstream) []*upstream {
+	attempts := make([]*upstream, 0, len(upstreams)*(1+f.retries))
+	if f.retryOtherUpstream {
+		for i := 0; i <= f.retries; i++ {
+			attempts = append(attempts, upstreams...)
+		}
+		return attempts
+	}
+	for _, u := range upstreams {
+		for i := 0; i <= f.retries; i++ {
+			attempts = append(attempts, u)
+		}
+	}
+	return attempts
+}
+
+// backoff returns the time to wait before the nth retry of a query: the
+// retry backoff doubled n-1 times, less a random jitter of up to half of it.
+func (f *Forwarder) backoff(n int) time.Duration {
+	backoff := f.retryBackoff << (n - 1)
+	if backoff <= 0 {
+		return 0
+	}
+	return backoff - time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// sleep waits for d and reports true, or reports false as soon as ctx is
+// done or right away if its deadline would pass first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Add(d).Before(deadline) {
+		return false
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// forwardTo sends query to upstream u and returns the response, retrying if
+// our server cookie was rejected. A BADCOOKIE response is never returned.
+func (f *Forwarder) forwardTo(ctx context.Context, u *upstream, query Message) (Message, error) {
+	response, err := f.exchange(ctx, u, query, f.transport)
+	if err != nil || u.cookies == nil || response.Rcode() != RcodeBadCookie {
+		return response, err
+	}
+
+	// The upstream rejected our server cookie and sent a fresh one along, so
+	// retry once with it, and then over TCP, which the upstream should serve
+	// without a valid cookie (RFC 7873, section 5.3).
+	response, err = f.exchange(ctx, u, query, f.transport)
+	if err == nil && response.Rcode() == RcodeBadCookie && f.transport == TransportUDP {
+		response, err = f.exchange(ctx, u, query, TransportTCP)
+	}
+	if err == nil && response.Rcode() == RcodeBadCookie {
+		return Message{}, errors.New("error forwarding query: upstream keeps rejecting the cookie")
+	}
+
+	return response, err
+}
+
+// failedResponse returns the SERVFAIL response standing for query in the
+// merged response when it could not be forwarded.
+func failedResponse(query Message, err error) Message {
+	response := new(Message).SetReply(&query).SetRcode(RcodeServFail).AddOption(ForwardingError(err))
+	return *response
+}
+
+// ForwardingError returns the extended error (RFC 8914) describing why a
+// query could not be forwarded, without revealing anything of the upstream.
+func ForwardingError(err error) ExtendedError {
+	switch forwardErrorKind(err) {
+	case ErrUpstreamTimeout:
+		return ExtendedError{InfoCode: ExtendedErrorNoReachableAuthority, ExtraText: "upstream timeout"}
+	case ErrMalformedResponse:
+		return ExtendedError{InfoCode: ExtendedErrorInvalidData, ExtraText: "malformed upstream response"}
+	default:
+		return ExtendedError{InfoCode: ExtendedErrorNetworkError, ExtraText: "upstream unreachable"}
+	}
+}
+
+// newForwardError returns err as a *ForwardError, unless it already is one
+// or tells that the query was cancelled.
+func newForwardError(err error) error {
+	var forwardErr *ForwardError
+	if errors.As(err, &forwardErr) || errors.Is(err, context.Canceled) {
+		return err
+	}
+	return &ForwardError{Kind: forwardErrorKind(err), Err: err}
+}
+
+// forwardErrorKind returns ErrUpstreamTimeout, ErrMalformedResponse or
+// ErrUpstreamUnreachable, depending on what err forwarding a query tells.
+func forwardErrorKind(err error) error {
+	var forwardErr *ForwardError
+	if errors.As(err, &forwardErr) {
+		return forwardErr.Kind
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrUpstreamTimeout
+	}
+	var parseErr *ParseError
+	if errors.As(err, &parseErr) || errors.Is(err, ErrResponseMismatch) {
+		return ErrMalformedResponse
+	}
+	return ErrUpstreamUnreachable
+}
+
+// exchange sends query to upstream u under a random ID of its own, unrelated
+// to the client's, adding our cookie to it, and returns the parsed response.
+// With TransportUDP, query is sent from a socket of the pool first and only
+// over TCP if the response is truncated.
+func (f *Forwarder) exchange(ctx context.Context, u *upstream, query Message, transport Transport) (Message, error) {
+	if u.cookies != nil {
+		edns := *query.EDNS
+		edns.Options = append(append([]EDNSOption(nil), edns.Options...), u.cookies.option())
+		query.EDNS = &edns
+	}
+
+	var response []byte
+	var err error
+	if transport == TransportUDP {
+		response, query, err = f.pool.pick(u).exchange(ctx, query)
+		if err != nil {
+			return Message{}, err
+		}
+		// A truncated response may not even parse, so only its header is
+		// looked at before retrying over TCP.
+		header, err := RawMessage(response).ParseHeader()
+		if err == nil && header.Flags.TC == 1 {
+			response = nil
+		}
+	}
+	if response == nil {
+		query.Header.ID = randomID()
+		response, err = exchangeTCP(ctx, u, query, query.Serialize(), f.dialTimeout)
+		if err != nil {
+			return Message{}, err
+		}
+	}
+
+	resMessage, err := RawMessage(response).Parse()
+	if err != nil {
+		return Message{}, fmt.Errorf("error parsing response: %w", err)
+	}
+	// Keep the question of an error response that left it out, so that it is
+	// not lost from the merged response.
+	if len(resMessage.Questions) == 0 {
+		resMessage.Questions = query.Questions
+	}
+
+	if sent, ok := queryClientSubnet(query); ok {
+		if err := checkClientSubnet(resMessage, sent); err != nil {
+			u.mismatches.Add(1)
+			return Message{}, err
+		}
+	}
+	if u.cookies != nil {
+		if err := u.cookies.learn(resMessage); err != nil {
+			u.mismatches.Add(1)
+			return Message{}, err
+		}
+	}
+
+	return resMessage, nil
+}
+
+// exchangeTCP sends packed, the wire form of query, over a new TCP connection
+// to upstream u, made within dialTimeout, and returns the response, both
+// framed by a two-octet length (RFC 1035, section 4.2.2). A response that does
+// not answer query is counted as a mismatch.
+func exchangeTCP(ctx context.Context, u *upstream, query Message, packed []byte, dialTimeout time.Duration) ([]byte, error) {
+	dialer := net.Dialer{Timeout: dialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", u.addr.String())
+	if err != nil {
+		return nil, fmt.Errorf("error dialing TCP: %w", err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		err = conn.SetDeadline(deadline)
+		if err != nil {
+			return nil, fmt.Errorf("error setting deadline: %w", err)
+		}
+	}
+
+	// Unblock the exchange as soon as ctx is cancelled.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	framed := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(packed)), uint16(len(packed)))
+	_, err = conn.Write(append(framed, packed...))
+	if err != nil {
+		return nil, fmt.Errorf("error sending DNS request over TCP: %w", err)
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, fmt.Errorf("error reading TCP response: %w", err)
+	}
+	response := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, fmt.Errorf("error reading TCP response: %w", err)
+	}
+	if !answers(response, query) {
+		u.mismatches.Add(1)
+		return nil, fmt.Errorf("error reading TCP response: %w", ErrResponseMismatch)
+	}
+
+	return response, nil
+}
+
+// answers reports whether response is a response, with the ID and the
+// question of query, which is one of the single-question queries of Split.
+// An error response may leave the question out, e.g. FORMERR or NOTIMP.
+// Names are compared case-insensitively (RFC 4343).
+func answers(response []byte, query Message) bool {
+	var p Parser
+	header, err := p.Start(response)
+	if err != nil || header.Flags.QR != 1 || header.ID != query.Header.ID {
+		return false
+	}
+	if header.QDCOUNT == 0 && header.Flags.RCODE != 0 {
+		return true
+	}
+	if header.QDCOUNT != 1 {
+		return false
+	}
+
+	question, err := p.Question()
+	if err != nil {
+		return false
+	}
+	expected := query.Questions[0]
+	return question.TYPE == expected.TYPE && question.CLASS == expected.CLASS && question.NAME.Equal(expected.NAME)
+}
+
+// upstreamClientSubnet returns the EDNS Client Subnet option to send upstream
+// for query m from client, according to the forwarder's policy.
+func (f *Forwarder) upstreamClientSubnet(m Message, client net.IP) (ClientSubnet, bool) {
+	if f.ecsPolicy == ECSStrip {
+		return ClientSubnet{}, false
+	}
+
+	subnet, ok := queryClientSubnet(m)
+	if !ok {
+		if f.ecsPolicy != ECSSynthesize || client == nil {
+			return ClientSubnet{}, false
+		}
+		subnet = NewClientSubnet(client, 128)
+	}
+
+	// Never send more of the client's address than configured, and never a
+	// scope, which is only meaningful in responses.
+	subnet.ScopePrefix = 0
+	if subnet.Family == FamilyIPv4 {
+		return subnet.Truncate(f.ecsIPv4Prefix), true
+	}
+	return subnet.Truncate(f.ecsIPv6Prefix), true
+}
+
+// queryClientSubnet returns the EDNS Client Subnet option of m, if any.
+func queryClientSubnet(m Message) (ClientSubnet, bool) {
+	if m.EDNS == nil {
+		return ClientSubnet{}, false
+	}
+	subnet, ok := m.EDNS.Option(OptionCodeClientSubnet).(ClientSubnet)
+	return subnet, ok
+}
+
+// checkClientSubnet checks the EDNS Client Subnet option of response r to a
+// query that carried sent. A response without the option applies to all
+// clients, and one describing another subnet must be rejected (RFC 7871,
+// section 7.3).
+func checkClientSubnet(r Message, sent ClientSubnet) error {
+	subnet, ok := queryClientSubnet(r)
+	if ok && !subnet.SameSubnet(sent) {
+		return fmt.Errorf("%w: client subnet %s/%d does not match query", ErrResponseMismatch, subnet.Address, subnet.SourcePrefix)
 	}
 
-	return messages.Merge(), nil
+	return nil
 }
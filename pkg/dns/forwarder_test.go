@@ -0,0 +1,872 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startUpstream starts a UDP resolver on a local port that answers every query
+// with the message returned by handle, called concurrently, and returns its
+// address.
+func startUpstream(t *testing.T, handle func(query Message) Message) string {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			size, source, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			query, err := RawMessage(buf[:size]).Parse()
+			if err != nil {
+				continue
+			}
+			go func() {
+				response := handle(query)
+				conn.WriteToUDP(response.Serialize(), source)
+			}()
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+// startTCPUpstream starts a TCP resolver listening on address that answers
+// every query with the message returned by handle, and returns its address.
+func startTCPUpstream(t *testing.T, address string, handle func(query Message) Message) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", address)
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var length [2]byte
+				if _, err := io.ReadFull(conn, length[:]); err != nil {
+					return
+				}
+				buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					return
+				}
+				query, err := RawMessage(buf).Parse()
+				if err != nil {
+					return
+				}
+				response := handle(query)
+				packed := response.Serialize()
+				conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(packed))), packed...))
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+// largeTXTResponse answers query with a TXT record too large for UDP.
+func largeTXTResponse(query Message) Message {
+	var text []string
+	for i := 0; i < 40; i++ {
+		text = append(text, string(make([]byte, 200)))
+	}
+
+	response := Message{Header: query.Header, Questions: query.Questions}
+	response.Header.Flags.QR = 1
+	response.Answers = Answers{NewRecord(query.Questions[0].NAME, ClassIN, 60, TXT{Text: text})}
+	return response
+}
+
+func TestForwarder_ForwardAdvertisesUDPSize(t *testing.T) {
+	var text []string
+	for i := 0; i < 10; i++ {
+		text = append(text, string(make([]byte, 200)))
+	}
+
+	address := startUpstream(t, func(query Message) Message {
+		response := Message{
+			Header:    query.Header,
+			Questions: query.Questions,
+			EDNS:      &EDNS{UDPSize: 4096},
+		}
+		response.Header.Flags.QR = 1
+		if query.EDNS == nil || query.EDNS.UDPSize < 4096 {
+			response.Header.Flags.TC = 1
+			return response
+		}
+		response.Answers = Answers{NewRecord(query.Questions[0].NAME, ClassIN, 60, TXT{Text: text})}
+		return response
+	})
+
+	forwarder, err := NewForwarder([]string{address})
+	require.NoError(t, err)
+	t.Cleanup(forwarder.Close)
+
+	response, err := forwarder.Forward(context.Background(), Message{
+		Header:    Header{ID: 1234, Flags: HeaderFlags{RD: 1}, QDCOUNT: 1},
+		Questions: Questions{NewQuestion("example.com", TypeTXT, ClassIN)},
+	})
+
+	require.NoError(t, err)
+	require.Equal(t, uint16(0), response.Header.Flags.TC, "Response should not be truncated")
+	require.Len(t, response.Answers, 1)
+	require.Equal(t, TXT{Text: text}, response.Answers[0].Data)
+}
+
+func TestForwarder_ForwardFromClientSubnet(t *testing.T) {
+	clientSubnet := NewClientSubnet(net.ParseIP("198.51.100.77"), 32)
+
+	tests := []struct {
+		name      string
+		policy    ECSPolicy
+		query     *EDNS
+		sent      *ClientSubnet
+		responded *ClientSubnet
+	}{
+		{
+			name:   "strip",
+			policy: ECSStrip,
+			query:  &EDNS{UDPSize: 1232, Options: []EDNSOption{clientSubnet}},
+		},
+		{
+			name:      "pass through with truncation",
+			policy:    ECSPassThrough,
+			query:     &EDNS{UDPSize: 1232, Options: []EDNSOption{clientSubnet}},
+			sent:      &ClientSubnet{Family: FamilyIPv4, SourcePrefix: 24, Address: net.IP{198, 51, 100, 0}},
+			responded: &ClientSubnet{Family: FamilyIPv4, SourcePrefix: 32, ScopePrefix: 20, Address: net.IP{198, 51, 100, 77}},
+		},
+		{
+			name:   "pass through without client option",
+			policy: ECSPassThrough,
+		},
+		{
+			name:   "synthesize",
+			policy: ECSSynthesize,
+			sent:   &ClientSubnet{Family: FamilyIPv4, SourcePrefix: 24, Address: net.IP{203, 0, 113, 0}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queries := make(chan Message, 1)
+			address := startUpstream(t, func(query Message) Message {
+				queries <- query
+				response := Message{Header: query.Header, Questions: query.Questions, EDNS: &EDNS{UDPSize: 4096}}
+				response.Header.Flags.QR = 1
+				if subnet, ok := queryClientSubnet(query); ok {
+					subnet.ScopePrefix = 20
+					response.EDNS.Options = []EDNSOption{subnet}
+				}
+				return response
+			})
+
+			forwarder, err := NewForwarder([]string{address}, WithECS(tt.policy, 24, 56))
+			require.NoError(t, err)
+			t.Cleanup(forwarder.Close)
+
+			response, err := forwarder.ForwardFrom(context.Background(), Message{
+				Header:    Header{ID: 1234, Flags: HeaderFlags{RD: 1}, QDCOUNT: 1},
+				Questions: Questions{NewQuestion("example.com", TypeA, ClassIN)},
+				EDNS:      tt.query,
+			}, net.ParseIP("203.0.113.9"))
+			require.NoError(t, err)
+
+			sent, ok := queryClientSubnet(<-queries)
+			if tt.sent == nil {
+				require.False(t, ok, "No client subnet should be sent upstream")
+			} else {
+				require.True(t, ok, "A client subnet should be sent upstream")
+				require.True(t, tt.sent.SameSubnet(sent), "Sent %v should match %v", sent, *tt.sent)
+			}
+
+			var responded EDNSOption
+			if response.EDNS != nil {
+				responded = response.EDNS.Option(OptionCodeClientSubnet)
+			}
+			if tt.responded == nil {
+				require.Nil(t, responded, "No client subnet should be returned to the client")
+			} else {
+				require.True(t, tt.responded.SameSubnet(responded.(ClientSubnet)))
+				require.Equal(t, tt.responded.ScopePrefix, responded.(ClientSubnet).ScopePrefix)
+			}
+		})
+	}
+}
+
+func TestForwarder_ForwardFromRejectsMismatchedClientSubnet(t *testing.T) {
+	address := startUpstream(t, func(query Message) Message {
+		response := Message{Header: query.Header, Questions: query.Questions}
+		response.Header.Flags.QR = 1
+		response.EDNS = &EDNS{UDPSize: 4096, Options: []EDNSOption{NewClientSubnet(net.ParseIP("192.0.2.0"), 24)}}
+		return response
+	})
+
+	forwarder, err := NewForwarder([]string{address}, WithECS(ECSSynthesize, 24, 56))
+	require.NoError(t, err)
+	t.Cleanup(forwarder.Close)
+
+	_, err = forwarder.ForwardFrom(context.Background(), Message{
+		Header:    Header{ID: 1234, QDCOUNT: 1},
+		Questions: Questions{NewQuestion("example.com", TypeA, ClassIN)},
+	}, net.ParseIP("203.0.113.9"))
+
+	var forwardErr *ForwardError
+	require.ErrorAs(t, err, &forwardErr)
+	require.ErrorIs(t, err, ErrMalformedResponse)
+	require.ErrorIs(t, err, ErrResponseMismatch)
+	require.Equal(t, uint64(1), forwarder.Upstreams()[0].Mismatches)
+
+	// The query moves on to an upstream that gets the subnet right.
+	good := startUpstream(t, func(query Message) Message {
+		response := *new(Message).SetReply(&query)
+		response.EDNS = query.EDNS
+		return response
+	})
+	forwarder, err = NewForwarder([]string{address, good}, WithECS(ECSSynthesize, 24, 56))
+	require.NoError(t, err)
+	t.Cleanup(forwarder.Close)
+
+	_, err = forwarder.ForwardFrom(context.Background(), Message{
+		Header:    Header{ID: 1234, QDCOUNT: 1},
+		Questions: Questions{NewQuestion("example.com", TypeA, ClassIN)},
+	}, net.ParseIP("203.0.113.9"))
+	require.NoError(t, err)
+}
+
+func TestForwarder_ForwardRetriesOnBadCookie(t *testing.T) {
+	serverCookie := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	queries := make(chan Cookie, 2)
+
+	address := startUpstream(t, func(query Message) Message {
+		cookie := query.EDNS.Option(OptionCodeCookie).(Cookie)
+		queries <- cookie
+
+		response := Message{Header: query.Header, Questions: query.Questions}
+		response.Header.Flags.QR = 1
+		response.EDNS = &EDNS{UDPSize: 4096, Options: []EDNSOption{Cookie{Client: cookie.Client, Server: serverCookie}}}
+		if string(cookie.Server) != string(serverCookie) {
+			response.Header.Flags.RCODE = RcodeBadCookie & 0x0F
+			response.EDNS.ExtendedRcode = uint8(RcodeBadCookie >> 4)
+			return response
+		}
+		response.Answers = Answers{NewRecord(query.Questions[0].NAME, ClassIN, 60, A{A: net.IP{1, 2, 3, 4}})}
+		return response
+	})
+
+	forwarder, err := NewForwarder([]string{address})
+	require.NoError(t, err)
+	t.Cleanup(forwarder.Close)
+
+	response, err := forwarder.Forward(context.Background(), Message{
+		Header:    Header{ID: 1234, QDCOUNT: 1},
+		Questions: Questions{NewQuestion("example.com", TypeA, ClassIN)},
+	})
+
+	require.NoError(t, err)
+	require.Equal(t, RcodeNoError, response.Rcode())
+	require.Len(t, response.Answers, 1)
+	require.Nil(t, response.EDNS.Option(OptionCodeCookie), "Upstream cookies should not be returned")
+
+	first, second := <-queries, <-queries
+	require.Empty(t, first.Server, "The first query should carry only a client cookie")
+	require.Equal(t, first.Client, second.Client, "The client cookie should be stable")
+	require.Equal(t, serverCookie, second.Server, "The retry should carry the server cookie")
+}
+
+// badCookieResponse answers query with BADCOOKIE and a fresh server cookie.
+func badCookieResponse(query Message) Message {
+	cookie := query.EDNS.Option(OptionCodeCookie).(Cookie)
+	response := Message{Header: query.Header, Questions: query.Questions}
+	response.Header.Flags.QR = 1
+	response.Header.Flags.RCODE = RcodeBadCookie & 0x0F
+	response.EDNS = &EDNS{UDPSize: 4096, ExtendedRcode: uint8(RcodeBadCookie >> 4), Options: []EDNSOption{Cookie{Client: cookie.Client, Server: []byte{1, 2, 3, 4, 5, 6, 7, 8}}}}
+	return response
+}
+
+func TestForwarder_ForwardRetriesBadCookieOverTCP(t *testing.T) {
+	address := startUpstream(t, badCookieResponse)
+	startTCPUpstream(t, address, func(query Message) Message {
+		return *new(Message).SetReply(&query).AddAnswer(NewRecord(query.Questions[0].NAME, ClassIN, 60, A{A: net.IP{1, 2, 3, 4}}))
+	})
+
+	forwarder, err := NewForwarder([]string{address})
+	require.NoError(t, err)
+	t.Cleanup(forwarder.Close)
+
+	response, err := forwarder.Forward(context.Background(), Message{
+		Header:    Header{ID: 1234, QDCOUNT: 1},
+		Questions: Questions{NewQuestion("example.com", TypeA, ClassIN)},
+	})
+
+	require.NoError(t, err)
+	require.Equal(t, RcodeNoError, response.Rcode())
+	require.Len(t, response.Answers, 1)
+}
+
+func TestForwarder_ForwardNeverRelaysBadCookie(t *testing.T) {
+	address := startUpstream(t, badCookieResponse)
+	startTCPUpstream(t, address, badCookieResponse)
+
+	forwarder, err := NewForwarder([]string{address})
+	require.NoError(t, err)
+	t.Cleanup(forwarder.Close)
+
+	_, err = forwarder.Forward(context.Background(), Message{
+		Header:    Header{ID: 1234, QDCOUNT: 1},
+		Questions: Questions{NewQuestion("example.com", TypeA, ClassIN)},
+	})
+
+	var forwardErr *ForwardError
+	require.ErrorAs(t, err, &forwardErr)
+}
+
+func TestForwarder_ForwardRejectsForeignClientCookie(t *testing.T) {
+	address := startUpstream(t, func(query Message) Message {
+		response := Message{Header: query.Header, Questions: query.Questions}
+		response.Header.Flags.QR = 1
+		response.EDNS = &EDNS{UDPSize: 4096, Options: []EDNSOption{Cookie{Client: [8]byte{9}}}}
+		return response
+	})
+
+	forwarder, err := NewForwarder([]string{address})
+	require.NoError(t, err)
+	t.Cleanup(forwarder.Close)
+
+	_, err = forwarder.Forward(context.Background(), Message{
+		Header:    Header{ID: 1234, QDCOUNT: 1},
+		Questions: Questions{NewQuestion("example.com", TypeA, ClassIN)},
+	})
+
+	require.ErrorIs(t, err, ErrMalformedResponse)
+	require.ErrorIs(t, err, ErrResponseMismatch)
+	require.Equal(t, uint16(ExtendedErrorInvalidData), ForwardingError(err).InfoCode)
+	require.Equal(t, uint64(1), forwarder.Upstreams()[0].Mismatches)
+}
+
+func TestForwarder_ForwardFallsBackToTCP(t *testing.T) {
+	udpQueries := make(chan Message, 2)
+	address := startUpstream(t, func(query Message) Message {
+		udpQueries <- query
+		response := largeTXTResponse(query)
+		response.Answers = nil
+		response.Header.Flags.TC = 1
+		return response
+	})
+	startTCPUpstream(t, address, largeTXTResponse)
+
+	forwarder, err := NewForwarder([]string{address})
+	require.NoError(t, err)
+	t.Cleanup(forwarder.Close)
+
+	response, err := forwarder.Forward(context.Background(), Message{
+		Header:    Header{ID: 1234, Flags: HeaderFlags{RD: 1}, QDCOUNT: 1},
+		Questions: Questions{NewQuestion("example.com", TypeTXT, ClassIN)},
+	})
+
+	require.NoError(t, err)
+	require.Len(t, udpQueries, 1, "The query should be sent over UDP first")
+	require.Equal(t, uint16(0), response.Header.Flags.TC)
+	require.Len(t, response.Answers, 1)
+	require.Len(t, response.Answers[0].Data.(TXT).Text, 40)
+}
+
+func TestForwarder_ForwardTCPOnly(t *testing.T) {
+	address := startTCPUpstream(t, "127.0.0.1:0", largeTXTResponse)
+
+	forwarder, err := NewForwarder([]string{address}, WithTransport(TransportTCP))
+	require.NoError(t, err)
+	t.Cleanup(forwarder.Close)
+
+	response, err := forwarder.Forward(context.Background(), Message{
+		Header:    Header{ID: 1234, Flags: HeaderFlags{RD: 1}, QDCOUNT: 1},
+		Questions: Questions{NewQuestion("example.com", TypeTXT, ClassIN), NewQuestion("example.org", TypeTXT, ClassIN)},
+	})
+
+	require.NoError(t, err)
+	require.Len(t, response.Answers, 2)
+	require.Equal(t, Name{"example", "org"}, response.Answers[1].NAME)
+}
+
+func TestForwarder_ForwardConcurrently(t *testing.T) {
+	address := startUpstream(t, func(query Message) Message {
+		time.Sleep(200 * time.Millisecond)
+		response := query
+		response.Header.Flags.QR = 1
+		response.Answers = Answers{NewRecord(query.Questions[0].NAME, ClassIN, 60, A{A: net.IP{192, 0, 2, 1}})}
+		return response
+	})
+
+	forwarder, err := NewForwarder([]string{address}, WithCookies(false))
+	require.NoError(t, err)
+	t.Cleanup(forwarder.Close)
+
+	start := time.Now()
+	response, err := forwarder.Forward(context.Background(), Message{
+		Header: Header{ID: 1234, Flags: HeaderFlags{RD: 1}},
+		Questions: Questions{
+			NewQuestion("a.example.com", TypeA, ClassIN),
+			NewQuestion("b.example.com", TypeA, ClassIN),
+			NewQuestion("c.example.com", TypeA, ClassIN),
+		},
+	})
+	require.NoError(t, err)
+	require.Less(t, time.Since(start), 500*time.Millisecond, "Questions should be forwarded concurrently")
+
+	require.Equal(t, uint16(1234), response.Header.ID, "The client's ID should be restored")
+	require.Len(t, response.Answers, 3)
+	for i, name := range []string{"a", "b", "c"} {
+		require.Equal(t, Name{Label(name), "example", "com"}, response.Answers[i].NAME, "Answers should follow the order of the questions")
+	}
+}
+
+func TestForwarder_ForwardIgnoresMismatchedResponses(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 65535)
+		size, source, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		query, err := RawMessage(buf[:size]).Parse()
+		if err != nil {
+			return
+		}
+
+		forged := new(Message).SetReply(&query)
+		forged.Header.ID++
+		forged.AddAnswer(NewRecord(query.Questions[0].NAME, ClassIN, 60, A{A: net.IP{6, 6, 6, 6}}))
+		conn.WriteToUDP(forged.Serialize(), source)
+
+		otherQuestion := new(Message).SetReply(&query)
+		otherQuestion.Questions[0].NAME = Name{"other", "example"}
+		otherQuestion.AddAnswer(NewRecord(Name{"other", "example"}, ClassIN, 60, A{A: net.IP{6, 6, 6, 6}}))
+		conn.WriteToUDP(otherQuestion.Serialize(), source)
+
+		// Only an error response may leave the question out.
+		noQuestion := Message{Header: Header{ID: query.Header.ID, Flags: HeaderFlags{QR: 1}}}
+		conn.WriteToUDP(noQuestion.Serialize(), source)
+
+		// The query itself, as reflected by an attacker, is no response.
+		conn.WriteToUDP(buf[:size], source)
+
+		genuine := new(Message).SetReply(&query)
+		genuine.AddAnswer(NewRecord(query.Questions[0].NAME, ClassIN, 60, A{A: net.IP{192, 0, 2, 1}}))
+		conn.WriteToUDP(genuine.Serialize(), source)
+	}()
+
+	forwarder, err := NewForwarder([]string{conn.LocalAddr().String()}, WithCookies(false))
+	require.NoError(t, err)
+	t.Cleanup(forwarder.Close)
+
+	response, err := forwarder.Forward(context.Background(), Message{
+		Header:    Header{ID: 1234, Flags: HeaderFlags{RD: 1}},
+		Questions: Questions{NewQuestion("EXAMPLE.com", TypeA, ClassIN)},
+	})
+	require.NoError(t, err)
+	require.Len(t, response.Answers, 1)
+	require.Equal(t, A{A: net.IP{192, 0, 2, 1}}, response.Answers[0].Data)
+	require.Equal(t, uint64(4), forwarder.Upstreams()[0].Mismatches)
+}
+
+func TestForwarder_ForwardErrorWithoutQuestion(t *testing.T) {
+	address := startUpstream(t, func(query Message) Message {
+		return Message{Header: Header{ID: query.Header.ID, Flags: HeaderFlags{QR: 1, RCODE: RcodeNotImp}}}
+	})
+
+	forwarder, err := NewForwarder([]string{address}, WithCookies(false))
+	require.NoError(t, err)
+	t.Cleanup(forwarder.Close)
+
+	response, err := forwarder.Forward(context.Background(), Message{
+		Header:    Header{ID: 1234, Flags: HeaderFlags{RD: 1}},
+		Questions: Questions{NewQuestion("example.com", TypeA, ClassIN)},
+	})
+
+	require.NoError(t, err)
+	require.Equal(t, RcodeNotImp, response.Rcode())
+	require.Equal(t, Questions{NewQuestion("example.com", TypeA, ClassIN)}, response.Questions)
+}
+
+func TestForwarder_ForwardRandomizesIDs(t *testing.T) {
+	ids := make(chan uint16, 10)
+	address := startUpstream(t, func(query Message) Message {
+		ids <- query.Header.ID
+		return *new(Message).SetReply(&query)
+	})
+
+	forwarder, err := NewForwarder([]string{address})
+	require.NoError(t, err)
+	t.Cleanup(forwarder.Close)
+
+	for i := 0; i < 3; i++ {
+		response, err := forwarder.Forward(context.Background(), Message{
+			Header:    Header{ID: 1234, Flags: HeaderFlags{RD: 1}},
+			Questions: Questions{NewQuestion("example.com", TypeA, ClassIN)},
+		})
+		require.NoError(t, err)
+		require.Equal(t, uint16(1234), response.Header.ID)
+	}
+
+	seen := make(map[uint16]bool)
+	for i := 0; i < 3; i++ {
+		seen[<-ids] = true
+	}
+	require.Greater(t, len(seen), 1, "Each upstream query should get an ID of its own")
+}
+
+func TestForwarder_ForwardPartialFailure(t *testing.T) {
+	address := startTCPUpstream(t, "127.0.0.1:0", func(query Message) Message {
+		response := *new(Message).SetReply(&query)
+		if query.Questions[0].NAME.Equal(Name{"broken", "example"}) {
+			response.Questions[0].NAME = Name{"elsewhere", "example"}
+			return response
+		}
+		return *response.AddAnswer(NewRecord(query.Questions[0].NAME, ClassIN, 60, A{A: net.IP{192, 0, 2, 1}}))
+	})
+
+	forwarder, err := NewForwarder([]string{address}, WithTransport(TransportTCP), WithCookies(false))
+	require.NoError(t, err)
+	t.Cleanup(forwarder.Close)
+
+	response, err := forwarder.Forward(context.Background(), Message{
+		Header:    Header{ID: 1234, Flags: HeaderFlags{RD: 1}},
+		Questions: Questions{NewQuestion("working.example", TypeA, ClassIN), NewQuestion("broken.example", TypeA, ClassIN)},
+	})
+	require.NoError(t, err)
+	require.Equal(t, RcodeServFail, response.Rcode())
+	require.Len(t, response.Questions, 2)
+	require.Len(t, response.Answers, 1)
+	require.Equal(t, []ExtendedError{{InfoCode: ExtendedErrorInvalidData, ExtraText: "malformed upstream response"}}, response.ExtendedErrors())
+
+	_, err = forwarder.Forward(context.Background(), Message{
+		Header:    Header{ID: 1234, Flags: HeaderFlags{RD: 1}},
+		Questions: Questions{NewQuestion("broken.example", TypeA, ClassIN)},
+	})
+	require.ErrorIs(t, err, ErrResponseMismatch, "An error should be returned when no question can be answered")
+	require.ErrorIs(t, err, ErrMalformedResponse)
+}
+
+// deadUpstream returns the address of a local UDP port nothing listens on.
+func deadUpstream(t *testing.T) string {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	address := conn.LocalAddr().String()
+	require.NoError(t, conn.Close())
+
+	return address
+}
+
+func TestNewForwarder_RequiresResolver(t *testing.T) {
+	_, err := NewForwarder(nil)
+	require.Error(t, err)
+}
+
+func TestForwarder_ForwardFailsOver(t *testing.T) {
+	address := startUpstream(t, func(query Message) Message {
+		return *new(Message).SetReply(&query).AddAnswer(NewRecord(query.Questions[0].NAME, ClassIN, 60, A{A: net.IP{192, 0, 2, 1}}))
+	})
+
+	for _, strategy := range []Strategy{StrategyFailover, StrategyRoundRobin, StrategyRandom, StrategyLowestLatency} {
+		forwarder, err := NewForwarder([]string{deadUpstream(t), address}, WithStrategy(strategy))
+		require.NoError(t, err)
+		t.Cleanup(forwarder.Close)
+
+		for i := 0; i < 3; i++ {
+			response, err := forwarder.Forward(context.Background(), Message{
+				Header:    Header{ID: 1234, Flags: HeaderFlags{RD: 1}},
+				Questions: Questions{NewQuestion("example.com", TypeA, ClassIN)},
+			})
+			require.NoError(t, err, "strategy %d", strategy)
+			require.Len(t, response.Answers, 1)
+		}
+	}
+}
+
+func TestForwarder_ForwardPrefersLiveUpstream(t *testing.T) {
+	address := startUpstream(t, func(query Message) Message {
+		return *new(Message).SetReply(&query)
+	})
+
+	forwarder, err := NewForwarder([]string{deadUpstream(t), address}, WithStrategy(StrategyLowestLatency))
+	require.NoError(t, err)
+	t.Cleanup(forwarder.Close)
+
+	for i := 0; i < 5; i++ {
+		_, err := forwarder.Forward(context.Background(), Message{
+			Header:    Header{ID: 1234, Flags: HeaderFlags{RD: 1}},
+			Questions: Questions{NewQuestion("example.com", TypeA, ClassIN)},
+		})
+		require.NoError(t, err)
+	}
+	require.Equal(t, address, forwarder.order()[0].addr.String(), "A dead upstream that fails fast should not be preferred")
+}
+
+// silentUpstream returns the address of a local UDP port that never answers.
+func silentUpstream(t *testing.T) string {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return conn.LocalAddr().String()
+}
+
+func TestForwarder_attempts(t *testing.T) {
+	upstreams := testUpstreams(2)
+	a, b := upstreams[0], upstreams[1]
+
+	f := &Forwarder{retries: 2, retryOtherUpstream: true}
+	require.Equal(t, []*upstream{a, b, a, b, a, b}, f.attempts(upstreams))
+
+	f.retryOtherUpstream = false
+	require.Equal(t, []*upstream{a, a, a, b, b, b}, f.attempts(upstreams))
+
+	f.retries = 0
+	require.Equal(t, []*upstream{a, b}, f.attempts(upstreams))
+}
+
+func TestForwarder_backoff(t *testing.T) {
+	f := &Forwarder{retryBackoff: 100 * time.Millisecond}
+	for i := 0; i < 100; i++ {
+		backoff := f.backoff(1)
+		require.GreaterOrEqual(t, backoff, 50*time.Millisecond)
+		require.LessOrEqual(t, backoff, 100*time.Millisecond)
+
+		backoff = f.backoff(3)
+		require.GreaterOrEqual(t, backoff, 200*time.Millisecond)
+		require.LessOrEqual(t, backoff, 400*time.Millisecond)
+	}
+
+	f.retryBackoff = 0
+	require.Zero(t, f.backoff(1))
+}
+
+func TestForwarder_ForwardRetries(t *testing.T) {
+	queries := make(chan struct{}, 10)
+	address := startUpstream(t, func(query Message) Message {
+		queries <- struct{}{}
+		response := *new(Message).SetReply(&query)
+		if len(queries) == 1 {
+			// Drop the first query, as a lost datagram would be.
+			response.Header.ID++
+		}
+		return response
+	})
+
+	forwarder, err := NewForwarder(
+		[]string{address},
+		WithTimeouts(time.Second, 100*time.Millisecond),
+		WithRetries(2, 10*time.Millisecond, false),
+	)
+	require.NoError(t, err)
+	t.Cleanup(forwarder.Close)
+
+	response, err := forwarder.Forward(context.Background(), Message{
+		Header:    Header{ID: 1234, Flags: HeaderFlags{RD: 1}},
+		Questions: Questions{NewQuestion("example.com", TypeA, ClassIN)},
+	})
+	require.NoError(t, err)
+	require.Equal(t, RcodeNoError, response.Rcode())
+	require.Len(t, queries, 2)
+}
+
+func TestForwarder_ForwardQueryTimeout(t *testing.T) {
+	forwarder, err := NewForwarder(
+		[]string{silentUpstream(t), silentUpstream(t)},
+		WithTimeouts(time.Second, time.Second),
+		WithQueryTimeout(150*time.Millisecond),
+		WithRetries(3, 10*time.Millisecond, true),
+	)
+	require.NoError(t, err)
+	t.Cleanup(forwarder.Close)
+
+	start := time.Now()
+	_, err = forwarder.Forward(context.Background(), Message{
+		Header:    Header{ID: 1234, Flags: HeaderFlags{RD: 1}},
+		Questions: Questions{NewQuestion("example.com", TypeA, ClassIN)},
+	})
+	require.Error(t, err)
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	require.True(t, netErr.Timeout())
+	require.Less(t, time.Since(start), 500*time.Millisecond)
+}
+
+// stalledTCPUpstream returns the address of a local TCP listener that accepts
+// connections but never answers.
+func stalledTCPUpstream(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		var conns []net.Conn
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				for _, conn := range conns {
+					conn.Close()
+				}
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestForwarder_ForwardCancelled(t *testing.T) {
+	for _, transport := range []Transport{TransportUDP, TransportTCP} {
+		address := silentUpstream(t)
+		if transport == TransportTCP {
+			address = stalledTCPUpstream(t)
+		}
+		forwarder, err := NewForwarder([]string{address}, WithTransport(transport), WithTimeouts(time.Second, 5*time.Second))
+		require.NoError(t, err)
+		t.Cleanup(forwarder.Close)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+
+		start := time.Now()
+		_, err = forwarder.Forward(ctx, Message{
+			Header:    Header{ID: 1234, Flags: HeaderFlags{RD: 1}},
+			Questions: Questions{NewQuestion("example.com", TypeA, ClassIN)},
+		})
+		require.ErrorIs(t, err, context.Canceled, "transport %d", transport)
+		require.Less(t, time.Since(start), time.Second)
+		require.Zero(t, forwarder.Upstreams()[0].ConsecutiveFailures, "A cancelled query should not count against the upstream")
+
+		// Eject the upstream long enough ago for the next query to be its
+		// trial, and cancel that query.
+		u := forwarder.upstreams[0]
+		u.report(time.Now().Add(-time.Hour), errors.New("timeout"), 1)
+		ctx, cancel = context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+
+		_, err = forwarder.Forward(ctx, Message{
+			Header:    Header{ID: 1234, Flags: HeaderFlags{RD: 1}},
+			Questions: Questions{NewQuestion("example.com", TypeA, ClassIN)},
+		})
+		require.ErrorIs(t, err, context.Canceled)
+		status := forwarder.Upstreams()[0]
+		require.Equal(t, CircuitOpen, status.State, "A cancelled trial should not leave the circuit half-open")
+		require.Equal(t, 1, status.ConsecutiveFailures)
+		_, trial := u.allow(time.Now(), forwarder.cooldown)
+		require.True(t, trial, "The next query should be let through as the trial")
+
+		// A query forced through while that trial is in flight must not
+		// give it back when cancelled.
+		ctx, cancel = context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+
+		_, err = forwarder.Forward(ctx, Message{
+			Header:    Header{ID: 1234, Flags: HeaderFlags{RD: 1}},
+			Questions: Questions{NewQuestion("example.com", TypeA, ClassIN)},
+		})
+		require.ErrorIs(t, err, context.Canceled)
+		require.Equal(t, CircuitHalfOpen, forwarder.Upstreams()[0].State, "Only the query holding the trial may give it back")
+	}
+}
+
+func TestForwarder_ForwardErrors(t *testing.T) {
+	broken, _ := startResettingUpstream(t)
+	tests := []struct {
+		name      string
+		address   string
+		transport Transport
+		kind      error
+	}{
+		{"udp timeout", silentUpstream(t), TransportUDP, ErrUpstreamTimeout},
+		{"udp unreachable", deadUpstream(t), TransportUDP, ErrUpstreamUnreachable},
+		{"tcp timeout", stalledTCPUpstream(t), TransportTCP, ErrUpstreamTimeout},
+		{"tcp unreachable", broken, TransportTCP, ErrUpstreamUnreachable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forwarder, err := NewForwarder([]string{tt.address}, WithTransport(tt.transport))
+			require.NoError(t, err)
+			t.Cleanup(forwarder.Close)
+
+			// The deadline of the context prevails over the longer query timeout.
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			_, err = forwarder.Forward(ctx, Message{
+				Header:    Header{ID: 1234, Flags: HeaderFlags{RD: 1}},
+				Questions: Questions{NewQuestion("example.com", TypeA, ClassIN)},
+			})
+			var forwardErr *ForwardError
+			require.ErrorAs(t, err, &forwardErr)
+			require.Equal(t, tt.kind, forwardErr.Kind)
+			require.ErrorIs(t, err, tt.kind)
+		})
+	}
+}
+
+func TestForwarder_ForwardMessage(t *testing.T) {
+	address := startUpstream(t, func(query Message) Message {
+		return *new(Message).SetReply(&query)
+	})
+	forwarder, err := NewForwarder([]string{address})
+	require.NoError(t, err)
+	t.Cleanup(forwarder.Close)
+
+	response, err := forwarder.ForwardMessage(Message{
+		Header:    Header{ID: 1234, Flags: HeaderFlags{RD: 1}},
+		Questions: Questions{NewQuestion("example.com", TypeA, ClassIN)},
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint16(1234), response.Header.ID)
+}
+
+func TestForwardingError(t *testing.T) {
+	require.Equal(t, uint16(ExtendedErrorNoReachableAuthority), ForwardingError(&ForwardError{Kind: ErrUpstreamTimeout, Err: context.DeadlineExceeded}).InfoCode)
+	require.Equal(t, uint16(ExtendedErrorNoReachableAuthority), ForwardingError(context.DeadlineExceeded).InfoCode)
+	require.Equal(t, uint16(ExtendedErrorInvalidData), ForwardingError(ErrResponseMismatch).InfoCode)
+	require.Equal(t, uint16(ExtendedErrorNetworkError), ForwardingError(errors.New("connection refused")).InfoCode)
+}
+
+func TestForwarder_ForwardWithoutQuestion(t *testing.T) {
+	queries := make(chan struct{}, 1)
+	address := startUpstream(t, func(query Message) Message {
+		queries <- struct{}{}
+		return *new(Message).SetReply(&query)
+	})
+	forwarder, err := NewForwarder([]string{address})
+	require.NoError(t, err)
+	t.Cleanup(forwarder.Close)
+
+	response, err := forwarder.Forward(context.Background(), Message{Header: Header{ID: 1234, Flags: HeaderFlags{RD: 1}}})
+	require.NoError(t, err)
+	require.Equal(t, uint16(1234), response.Header.ID)
+	require.Equal(t, uint16(1), response.Header.Flags.QR)
+	require.Equal(t, RcodeFormErr, response.Rcode())
+	require.Empty(t, queries, "Nothing should be sent upstream")
+}
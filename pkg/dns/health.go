@@ -0,0 +1,194 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CircuitState is the state of the circuit breaker of an upstream resolver.
+type CircuitState int
+
+const (
+	// CircuitClosed lets queries through to a healthy upstream.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen ejects an upstream that failed too many times in a row.
+	CircuitOpen
+	// CircuitHalfOpen lets a single trial query through to an upstream
+	// whose cooldown has elapsed, to find out whether it recovered.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("CircuitState(%d)", int(s))
+	}
+}
+
+// UpstreamStatus describes the health of an upstream resolver.
+type UpstreamStatus struct {
+	Address string
+	State   CircuitState
+
+	// RTT is the smoothed round-trip time, or 0 until the first exchange.
+	RTT time.Duration
+
+	// ConsecutiveFailures counts the exchanges that failed since the last
+	// successful one, and LastError is the error of the latest of them.
+	ConsecutiveFailures int
+	LastError           error
+
+	// Mismatches counts the responses dropped for not answering the query
+	// they were received for, e.g. spoofed ones.
+	Mismatches uint64
+}
+
+// WithCircuitBreaker ejects an upstream once maxFailures exchanges with it
+// have failed in a row, and lets a trial query through after cooldown. A
+// successful exchange, whether a query or a health probe, brings it back. By
+// default, 3 failures eject an upstream for 30 seconds; a maxFailures of 0
+// never ejects any.
+func WithCircuitBreaker(maxFailures int, cooldown time.Duration) ForwarderOption {
+	return func(f *Forwarder) {
+		f.maxFailures = maxFailures
+		f.cooldown = cooldown
+	}
+}
+
+// WithHealthCheck probes every upstream each interval with an NS query for
+// name, e.g. ".", so that one that recovers is brought back without waiting
+// for client queries. Probes run until Close is called.
+func WithHealthCheck(interval time.Duration, name string) ForwarderOption {
+	return func(f *Forwarder) {
+		f.probeInterval = interval
+		f.probeName = name
+	}
+}
+
+// Upstreams returns the status of every upstream resolver, in the order they
+// were given to NewForwarder.
+func (f *Forwarder) Upstreams() []UpstreamStatus {
+	statuses := make([]UpstreamStatus, len(f.upstreams))
+	for i, u := range f.upstreams {
+		u.mu.Lock()
+		statuses[i] = UpstreamStatus{
+			Address:             u.addr.String(),
+			State:               u.state,
+			RTT:                 u.rtt,
+			ConsecutiveFailures: u.failures,
+			LastError:           u.lastErr,
+			Mismatches:          u.mismatches.Load(),
+		}
+		u.mu.Unlock()
+	}
+
+	return statuses
+}
+
+// allow reports whether a query may be sent to u at now, and whether it is
+// the trial of an open circuit whose cooldown has elapsed. The trial turns the
+// circuit half-open, turning away all other queries until it is reported.
+func (u *upstream) allow(now time.Time, cooldown time.Duration) (allowed, trial bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	switch u.state {
+	case CircuitOpen:
+		if now.Before(u.openedAt.Add(cooldown)) {
+			return false, false
+		}
+		u.state = CircuitHalfOpen
+		return true, true
+	case CircuitHalfOpen:
+		return false, false
+	default:
+		return true, false
+	}
+}
+
+// report records the outcome of an exchange with u that ended at now,
+// opening its circuit after maxFailures consecutive failures or after a
+// failed trial.
+func (u *upstream) report(now time.Time, err error, maxFailures int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if err == nil {
+		u.state = CircuitClosed
+		u.failures = 0
+		u.lastErr = nil
+		return
+	}
+
+	u.failures++
+	u.lastErr = err
+	if u.state != CircuitClosed || (maxFailures > 0 && u.failures >= maxFailures) {
+		u.state = CircuitOpen
+		u.openedAt = now
+	}
+}
+
+// abandon records that the trial let through by allow was given up on by the
+// client, which tells nothing of u: the circuit goes back to waiting, so that
+// the next query is let through as the trial instead.
+func (u *upstream) abandon() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.state == CircuitHalfOpen {
+		u.state = CircuitOpen
+	}
+}
+
+// probe sends a health probe to every upstream each probe interval until the
+// forwarder is closed.
+func (f *Forwarder) probe(name Name) {
+	ticker := time.NewTicker(f.probeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-ticker.C:
+			var wg sync.WaitGroup
+			for _, u := range f.upstreams {
+				wg.Add(1)
+				go func(u *upstream) {
+					defer wg.Done()
+					f.probeUpstream(u, name)
+				}(u)
+			}
+			wg.Wait()
+		}
+	}
+}
+
+// probeUpstream sends an NS query for name to u and records the outcome. A
+// SERVFAIL response counts as a failure, as the upstream cannot resolve.
+func (f *Forwarder) probeUpstream(u *upstream, name Name) {
+	query := Message{
+		Header:    Header{Flags: HeaderFlags{RD: 1}},
+		Questions: Questions{{NAME: name, TYPE: TypeNS, CLASS: ClassIN}},
+		EDNS:      &EDNS{UDPSize: upstreamUDPSize},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), f.readTimeout)
+	defer cancel()
+
+	start := time.Now()
+	response, err := f.forwardTo(ctx, u, query)
+	if err == nil && response.Rcode() == RcodeServFail {
+		err = fmt.Errorf("error probing upstream: %s", RcodeServFail)
+	}
+	u.observe(f.rttSample(time.Since(start), err))
+	u.report(time.Now(), err, f.maxFailures)
+}
@@ -0,0 +1,167 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstream_circuitBreaker(t *testing.T) {
+	u := testUpstreams(1)[0]
+	now := time.Unix(0, 0)
+	errTimeout := errors.New("timeout")
+
+	u.report(now, errTimeout, 2)
+	require.Equal(t, CircuitClosed, u.state)
+	allowed, trial := u.allow(now, time.Minute)
+	require.True(t, allowed)
+	require.False(t, trial)
+
+	u.report(now, errTimeout, 2)
+	require.Equal(t, CircuitOpen, u.state, "The circuit should open at the failure threshold")
+	allowed, _ = u.allow(now.Add(time.Second), time.Minute)
+	require.False(t, allowed)
+
+	allowed, trial = u.allow(now.Add(time.Minute), time.Minute)
+	require.True(t, allowed, "The circuit should let a trial through after the cooldown")
+	require.True(t, trial)
+	require.Equal(t, CircuitHalfOpen, u.state)
+	allowed, _ = u.allow(now.Add(time.Minute), time.Minute)
+	require.False(t, allowed, "Only one trial should be in flight")
+
+	u.report(now.Add(time.Minute), errTimeout, 2)
+	require.Equal(t, CircuitOpen, u.state, "A failed trial should open the circuit again")
+	allowed, _ = u.allow(now.Add(90*time.Second), time.Minute)
+	require.False(t, allowed)
+
+	allowed, trial = u.allow(now.Add(2*time.Minute), time.Minute)
+	require.True(t, allowed)
+	require.True(t, trial)
+	u.report(now.Add(2*time.Minute), nil, 2)
+	require.Equal(t, CircuitClosed, u.state)
+	require.Equal(t, 0, u.failures)
+	require.NoError(t, u.lastErr)
+}
+
+func TestUpstream_circuitBreakerDisabled(t *testing.T) {
+	u := testUpstreams(1)[0]
+	for i := 0; i < 10; i++ {
+		u.report(time.Unix(0, 0), errors.New("timeout"), 0)
+	}
+	require.Equal(t, CircuitClosed, u.state)
+	require.Equal(t, 10, u.failures)
+}
+
+func TestCircuitState_String(t *testing.T) {
+	require.Equal(t, "closed", CircuitClosed.String())
+	require.Equal(t, "open", CircuitOpen.String())
+	require.Equal(t, "half-open", CircuitHalfOpen.String())
+	require.Equal(t, "CircuitState(7)", CircuitState(7).String())
+}
+
+// startResettingUpstream starts a TCP listener that closes every connection
+// right away, and returns its address and a channel receiving a value per
+// connection.
+func startResettingUpstream(t *testing.T) (string, <-chan struct{}) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	accepted := make(chan struct{}, 100)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+			accepted <- struct{}{}
+		}
+	}()
+
+	return listener.Addr().String(), accepted
+}
+
+func TestForwarder_ForwardSkipsEjectedUpstream(t *testing.T) {
+	broken, accepted := startResettingUpstream(t)
+	address := startTCPUpstream(t, "127.0.0.1:0", func(query Message) Message {
+		return *new(Message).SetReply(&query).AddAnswer(NewRecord(query.Questions[0].NAME, ClassIN, 60, A{A: net.IP{192, 0, 2, 1}}))
+	})
+
+	forwarder, err := NewForwarder([]string{broken, address}, WithTransport(TransportTCP), WithCircuitBreaker(1, time.Minute))
+	require.NoError(t, err)
+	t.Cleanup(forwarder.Close)
+
+	for i := 0; i < 3; i++ {
+		response, err := forwarder.Forward(context.Background(), Message{
+			Header:    Header{ID: 1234, Flags: HeaderFlags{RD: 1}},
+			Questions: Questions{NewQuestion("example.com", TypeA, ClassIN)},
+		})
+		require.NoError(t, err)
+		require.Len(t, response.Answers, 1)
+	}
+	require.Len(t, accepted, 1, "The broken upstream should be ejected after its first failure")
+
+	statuses := forwarder.Upstreams()
+	require.Len(t, statuses, 2)
+	require.Equal(t, broken, statuses[0].Address)
+	require.Equal(t, CircuitOpen, statuses[0].State)
+	require.Equal(t, 1, statuses[0].ConsecutiveFailures)
+	require.Error(t, statuses[0].LastError)
+	require.Equal(t, CircuitClosed, statuses[1].State)
+	require.NotZero(t, statuses[1].RTT)
+}
+
+func TestForwarder_ForwardTriesEjectedUpstreamsAsLastResort(t *testing.T) {
+	broken, accepted := startResettingUpstream(t)
+
+	forwarder, err := NewForwarder([]string{broken}, WithTransport(TransportTCP), WithCircuitBreaker(1, time.Minute))
+	require.NoError(t, err)
+	t.Cleanup(forwarder.Close)
+
+	for i := 0; i < 2; i++ {
+		_, err := forwarder.Forward(context.Background(), Message{
+			Header:    Header{ID: 1234, Flags: HeaderFlags{RD: 1}},
+			Questions: Questions{NewQuestion("example.com", TypeA, ClassIN)},
+		})
+		require.Error(t, err)
+	}
+	require.Len(t, accepted, 2)
+}
+
+func TestForwarder_HealthCheck(t *testing.T) {
+	probed := make(chan Question, 100)
+	address := startUpstream(t, func(query Message) Message {
+		probed <- query.Questions[0]
+		return *new(Message).SetReply(&query)
+	})
+
+	forwarder, err := NewForwarder([]string{address}, WithHealthCheck(10*time.Millisecond, "example.com"))
+	require.NoError(t, err)
+	defer forwarder.Close()
+
+	// Eject the upstream as if it had failed, for the probes to bring back.
+	u := forwarder.upstreams[0]
+	for i := 0; i < 3; i++ {
+		u.report(time.Now(), errors.New("timeout"), forwarder.maxFailures)
+	}
+	require.Equal(t, CircuitOpen, forwarder.Upstreams()[0].State)
+
+	require.Eventually(t, func() bool {
+		return forwarder.Upstreams()[0].State == CircuitClosed
+	}, time.Second, 10*time.Millisecond)
+
+	question := <-probed
+	require.Equal(t, NewQuestion("example.com", TypeNS, ClassIN), question)
+}
+
+func TestNewForwarder_RejectsInvalidHealthCheckName(t *testing.T) {
+	_, err := NewForwarder([]string{"127.0.0.1:53"}, WithHealthCheck(time.Second, "a..b"))
+	require.Error(t, err)
+}
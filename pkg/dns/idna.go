@@ -0,0 +1,241 @@
+package dns
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+// idnaPrefix marks a label holding an internationalized name in Punycode
+// (RFC 5890, section 2.3.2.1).
+const idnaPrefix = "xn--"
+
+// Parameters of Punycode (RFC 3492, section 5).
+const (
+	punycodeBase        = 36
+	punycodeTMin        = 1
+	punycodeTMax        = 26
+	punycodeSkew        = 38
+	punycodeDamp        = 700
+	punycodeInitialBias = 72
+	punycodeInitialN    = 128
+
+	// punycodeMaxDelta keeps the arithmetic of the decoder well inside int.
+	punycodeMaxDelta = 1<<31 - 1
+)
+
+var errInvalidPunycode = errors.New("invalid punycode")
+
+// labelToASCII converts a label holding non-ASCII text to its IDNA form
+// ("xn--" followed by Punycode). ASCII labels are returned unchanged. Only
+// case folding is applied to the text; the full mapping of UTS #46 is not.
+func labelToASCII(label string) (string, error) {
+	ascii := true
+	for i := 0; i < len(label); i++ {
+		if label[i] >= utf8.RuneSelf {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return label, nil
+	}
+	if !utf8.ValidString(label) {
+		return "", errInvalidPunycode
+	}
+
+	encoded, err := punycodeEncode([]rune(strings.ToLower(label)))
+	if err != nil {
+		return "", err
+	}
+
+	return idnaPrefix + encoded, nil
+}
+
+// labelToUnicode decodes a label in IDNA form. Any other label, or one that
+// does not decode, is returned unchanged.
+func labelToUnicode(label string) string {
+	if len(label) <= len(idnaPrefix) || !strings.EqualFold(label[:len(idnaPrefix)], idnaPrefix) {
+		return label
+	}
+
+	// An IDNA label must decode to text that is not plain ASCII.
+	decoded, err := punycodeDecode(label[len(idnaPrefix):])
+	if err != nil || !containsNonASCII(decoded) {
+		return label
+	}
+
+	return string(decoded)
+}
+
+func containsNonASCII(runes []rune) bool {
+	for _, r := range runes {
+		if r >= utf8.RuneSelf {
+			return true
+		}
+	}
+
+	return false
+}
+
+// punycodeEncode implements the encoding procedure of RFC 3492, section 6.3.
+func punycodeEncode(input []rune) (string, error) {
+	var out []byte
+	for _, r := range input {
+		if r < punycodeInitialN {
+			out = append(out, byte(r))
+		}
+	}
+	basic := len(out)
+	handled := basic
+	if basic > 0 {
+		out = append(out, '-')
+	}
+
+	n, delta, bias := rune(punycodeInitialN), 0, punycodeInitialBias
+	for handled < len(input) {
+		m := rune(utf8.MaxRune + 1)
+		for _, r := range input {
+			if r >= n && r < m {
+				m = r
+			}
+		}
+		if int(m-n) > (punycodeMaxDelta-delta)/(handled+1) {
+			return "", errInvalidPunycode
+		}
+		delta += int(m-n) * (handled + 1)
+		n = m
+
+		for _, r := range input {
+			if r < n {
+				delta++
+			}
+			if r != n {
+				continue
+			}
+			q := delta
+			for k := punycodeBase; ; k += punycodeBase {
+				t := punycodeThreshold(k, bias)
+				if q < t {
+					break
+				}
+				out = append(out, punycodeDigit(t+(q-t)%(punycodeBase-t)))
+				q = (q - t) / (punycodeBase - t)
+			}
+			out = append(out, punycodeDigit(q))
+			bias = punycodeAdapt(delta, handled+1, handled == basic)
+			delta = 0
+			handled++
+		}
+		delta++
+		n++
+	}
+
+	return string(out), nil
+}
+
+// punycodeDecode implements the decoding procedure of RFC 3492, section 6.2.
+func punycodeDecode(s string) ([]rune, error) {
+	var output []rune
+	start := 0
+	if delimiter := strings.LastIndexByte(s, '-'); delimiter >= 0 {
+		for i := 0; i < delimiter; i++ {
+			if s[i] >= utf8.RuneSelf {
+				return nil, errInvalidPunycode
+			}
+			output = append(output, rune(s[i]))
+		}
+		start = delimiter + 1
+	}
+
+	n, i, bias := rune(punycodeInitialN), 0, punycodeInitialBias
+	for in := start; in < len(s); {
+		oldi, w := i, 1
+		for k := punycodeBase; ; k += punycodeBase {
+			if in >= len(s) {
+				return nil, errInvalidPunycode
+			}
+			digit := punycodeDigitValue(s[in])
+			in++
+			if digit < 0 || digit > (punycodeMaxDelta-i)/w {
+				return nil, errInvalidPunycode
+			}
+			i += digit * w
+			t := punycodeThreshold(k, bias)
+			if digit < t {
+				break
+			}
+			if w > punycodeMaxDelta/(punycodeBase-t) {
+				return nil, errInvalidPunycode
+			}
+			w *= punycodeBase - t
+		}
+
+		length := len(output) + 1
+		bias = punycodeAdapt(i-oldi, length, oldi == 0)
+		if i/length > utf8.MaxRune-int(n) {
+			return nil, errInvalidPunycode
+		}
+		n += rune(i / length)
+		i %= length
+		if n < punycodeInitialN || !utf8.ValidRune(n) {
+			return nil, errInvalidPunycode
+		}
+
+		output = append(output, 0)
+		copy(output[i+1:], output[i:])
+		output[i] = n
+		i++
+	}
+
+	return output, nil
+}
+
+// punycodeAdapt is the bias adaptation function of RFC 3492, section 6.1.
+func punycodeAdapt(delta, numPoints int, first bool) int {
+	if first {
+		delta /= punycodeDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+
+	k := 0
+	for delta > ((punycodeBase-punycodeTMin)*punycodeTMax)/2 {
+		delta /= punycodeBase - punycodeTMin
+		k += punycodeBase
+	}
+
+	return k + (punycodeBase-punycodeTMin+1)*delta/(delta+punycodeSkew)
+}
+
+func punycodeThreshold(k, bias int) int {
+	switch {
+	case k <= bias:
+		return punycodeTMin
+	case k >= bias+punycodeTMax:
+		return punycodeTMax
+	default:
+		return k - bias
+	}
+}
+
+func punycodeDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+func punycodeDigitValue(c byte) int {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c-'0') + 26
+	case c >= 'a' && c <= 'z':
+		return int(c - 'a')
+	case c >= 'A' && c <= 'Z':
+		return int(c - 'A')
+	default:
+		return -1
+	}
+}
@@ -0,0 +1,52 @@
+package dns
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestPunycode(t *testing.T) {
+	tests := []struct {
+		unicode  string
+		punycode string
+	}{
+		{"bücher", "bcher-kva"},
+		{"münchen", "mnchen-3ya"},
+		{"españa", "espaa-rta"},
+		{"правда", "80aafi6cg"},
+		{"日本語", "wgv71a119e"},
+		{"ü", "tda"},
+		// RFC 3492, section 7.1, (L).
+		{"3年B組金八先生", "3B-ww4c5e180e575a65lsy2b"},
+	}
+
+	for _, test := range tests {
+		encoded, err := punycodeEncode([]rune(test.unicode))
+		require.NoError(t, err)
+		require.Equal(t, test.punycode, encoded)
+
+		decoded, err := punycodeDecode(test.punycode)
+		require.NoError(t, err)
+		require.Equal(t, test.unicode, string(decoded))
+	}
+}
+
+func TestPunycode_DecodeErrors(t *testing.T) {
+	for _, s := range []string{"bcher-kv", "a-!", "zzzzzzzzzzzzzz", "ü-tda"} {
+		_, err := punycodeDecode(s)
+		require.ErrorIs(t, err, errInvalidPunycode, s)
+	}
+}
+
+func TestLabelToASCII(t *testing.T) {
+	label, err := labelToASCII("Bücher")
+	require.NoError(t, err)
+	require.Equal(t, "xn--bcher-kva", label)
+
+	label, err = labelToASCII("Plain")
+	require.NoError(t, err)
+	require.Equal(t, "Plain", label)
+
+	require.Equal(t, "bücher", labelToUnicode("XN--bcher-kva"))
+	require.Equal(t, "plain", labelToUnicode("plain"))
+}
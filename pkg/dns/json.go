@@ -0,0 +1,309 @@
+package dns
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// jsonMessage is the JSON representation of a message defined by RFC 8427.
+type jsonMessage struct {
+	ID      uint16 `json:"ID"`
+	QR      bool   `json:"QR"`
+	Opcode  Opcode `json:"Opcode"`
+	AA      bool   `json:"AA"`
+	TC      bool   `json:"TC"`
+	RD      bool   `json:"RD"`
+	RA      bool   `json:"RA"`
+	AD      bool   `json:"AD"`
+	CD      bool   `json:"CD"`
+	RCODE   Rcode  `json:"RCODE"`
+	QDCOUNT uint16 `json:"QDCOUNT"`
+	ANCOUNT uint16 `json:"ANCOUNT"`
+	NSCOUNT uint16 `json:"NSCOUNT"`
+	ARCOUNT uint16 `json:"ARCOUNT"`
+
+	QuestionRRs   []jsonQuestion `json:"questionRRs,omitempty"`
+	AnswerRRs     []jsonRR       `json:"answerRRs,omitempty"`
+	AuthorityRRs  []jsonRR       `json:"authorityRRs,omitempty"`
+	AdditionalRRs []jsonRR       `json:"additionalRRs,omitempty"`
+
+	MessageOctetsHEX string `json:"messageOctetsHEX,omitempty"`
+}
+
+type jsonQuestion struct {
+	NAME      string `json:"NAME"`
+	TYPE      Type   `json:"TYPE"`
+	TYPEname  string `json:"TYPEname,omitempty"`
+	CLASS     Class  `json:"CLASS"`
+	CLASSname string `json:"CLASSname,omitempty"`
+}
+
+// jsonRR is a resource record. Besides RDATAHEX, the RDATA of the types with
+// a decoder is given in presentation format in the matching rdata member.
+type jsonRR struct {
+	NAME      string `json:"NAME"`
+	TYPE      Type   `json:"TYPE"`
+	TYPEname  string `json:"TYPEname,omitempty"`
+	CLASS     Class  `json:"CLASS"`
+	CLASSname string `json:"CLASSname,omitempty"`
+	TTL       uint32 `json:"TTL"`
+	RDLENGTH  uint16 `json:"RDLENGTH"`
+	RDATAHEX  string `json:"RDATAHEX,omitempty"`
+
+	RdataA     string `json:"rdataA,omitempty"`
+	RdataAAAA  string `json:"rdataAAAA,omitempty"`
+	RdataNS    string `json:"rdataNS,omitempty"`
+	RdataCNAME string `json:"rdataCNAME,omitempty"`
+	RdataSOA   string `json:"rdataSOA,omitempty"`
+	RdataPTR   string `json:"rdataPTR,omitempty"`
+	RdataMX    string `json:"rdataMX,omitempty"`
+	RdataTXT   string `json:"rdataTXT,omitempty"`
+	RdataSRV   string `json:"rdataSRV,omitempty"`
+}
+
+// MarshalJSON encodes the message as the JSON object of RFC 8427. The OPT
+// pseudo-record is listed in additionalRRs like any other record, and the
+// counts are those Serialize would write.
+func (m Message) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.jsonMessage())
+}
+
+// MarshalJSONWithOctets is like MarshalJSON, but also includes the wire form
+// of the message as messageOctetsHEX.
+func (m Message) MarshalJSONWithOctets() ([]byte, error) {
+	jm := m.jsonMessage()
+	jm.MessageOctetsHEX = hex.EncodeToString(m.Serialize())
+	return json.Marshal(jm)
+}
+
+// UnmarshalJSON decodes the JSON object of RFC 8427. If the object carries
+// messageOctetsHEX, the message is parsed from it and the other members are
+// ignored. Otherwise an OPT record in additionalRRs becomes EDNS.
+func (m *Message) UnmarshalJSON(data []byte) error {
+	var jm jsonMessage
+	if err := json.Unmarshal(data, &jm); err != nil {
+		return err
+	}
+
+	if jm.MessageOctetsHEX != "" {
+		octets, err := hex.DecodeString(jm.MessageOctetsHEX)
+		if err != nil {
+			return fmt.Errorf("error decoding messageOctetsHEX: %w", err)
+		}
+		parsed, err := RawMessage(octets).Parse()
+		if err != nil {
+			return err
+		}
+		*m = parsed
+		return nil
+	}
+
+	msg := Message{
+		Header: Header{
+			ID: jm.ID,
+			Flags: HeaderFlags{
+				QR:     boolToUint16(jm.QR),
+				OPCODE: jm.Opcode,
+				AA:     boolToUint16(jm.AA),
+				TC:     boolToUint16(jm.TC),
+				RD:     boolToUint16(jm.RD),
+				RA:     boolToUint16(jm.RA),
+				AD:     boolToUint16(jm.AD),
+				CD:     boolToUint16(jm.CD),
+				RCODE:  jm.RCODE,
+			},
+			QDCOUNT: jm.QDCOUNT,
+			ANCOUNT: jm.ANCOUNT,
+			NSCOUNT: jm.NSCOUNT,
+			ARCOUNT: jm.ARCOUNT,
+		},
+	}
+
+	for _, q := range jm.QuestionRRs {
+		name, err := parseName(q.NAME)
+		if err != nil {
+			return err
+		}
+		msg.Questions = append(msg.Questions, Question{NAME: name, TYPE: q.TYPE, CLASS: q.CLASS})
+	}
+
+	var err error
+	if msg.Answers, err = answersFromJSON(jm.AnswerRRs); err != nil {
+		return err
+	}
+	if msg.Authority, err = answersFromJSON(jm.AuthorityRRs); err != nil {
+		return err
+	}
+	additional, err := answersFromJSON(jm.AdditionalRRs)
+	if err != nil {
+		return err
+	}
+	for _, answer := range additional {
+		if answer.TYPE != TypeOPT {
+			msg.Additional = append(msg.Additional, answer)
+			continue
+		}
+		if msg.EDNS != nil || len(answer.NAME) != 0 {
+			return ErrInvalidOPT
+		}
+		edns := newEDNS(answer)
+		msg.EDNS = &edns
+	}
+
+	*m = msg
+	return nil
+}
+
+func (m Message) jsonMessage() jsonMessage {
+	flags := m.Header.Flags
+	jm := jsonMessage{
+		ID:      m.Header.ID,
+		QR:      flags.QR != 0,
+		Opcode:  flags.OPCODE,
+		AA:      flags.AA != 0,
+		TC:      flags.TC != 0,
+		RD:      flags.RD != 0,
+		RA:      flags.RA != 0,
+		AD:      flags.AD != 0,
+		CD:      flags.CD != 0,
+		RCODE:   flags.RCODE,
+		QDCOUNT: m.Questions.Count(),
+		ANCOUNT: m.Answers.Count(),
+		NSCOUNT: m.Authority.Count(),
+		ARCOUNT: m.Additional.Count(),
+	}
+
+	for _, q := range m.Questions {
+		jm.QuestionRRs = append(jm.QuestionRRs, jsonQuestion{
+			NAME:      q.NAME.String(),
+			TYPE:      q.TYPE,
+			TYPEname:  typeNames[q.TYPE],
+			CLASS:     q.CLASS,
+			CLASSname: classNames[q.CLASS],
+		})
+	}
+	jm.AnswerRRs = answersToJSON(m.Answers)
+	jm.AuthorityRRs = answersToJSON(m.Authority)
+	jm.AdditionalRRs = answersToJSON(m.Additional)
+	if m.EDNS != nil {
+		jm.ARCOUNT++
+		jm.AdditionalRRs = append(jm.AdditionalRRs, newJSONRR(m.EDNS.record()))
+	}
+
+	return jm
+}
+
+func newJSONRR(a Answer) jsonRR {
+	data := a.data()
+	rdata := data.pack(nil, nil)
+
+	r := jsonRR{
+		NAME:      a.NAME.String(),
+		TYPE:      a.TYPE,
+		TYPEname:  typeNames[a.TYPE],
+		CLASS:     a.CLASS,
+		CLASSname: classNames[a.CLASS],
+		TTL:       a.TTL,
+		RDLENGTH:  uint16(len(rdata)),
+		RDATAHEX:  hex.EncodeToString(rdata),
+	}
+	if a.TYPE == TypeOPT {
+		r.CLASSname = ""
+	}
+	if field := r.rdataField(a.TYPE); field != nil {
+		*field = data.String()
+	}
+
+	return r
+}
+
+// answer returns the record described by r. RDATAHEX takes precedence over
+// the rdata member when both are present.
+func (r jsonRR) answer() (Answer, error) {
+	name, err := parseName(r.NAME)
+	if err != nil {
+		return Answer{}, err
+	}
+
+	field := r.rdataField(r.TYPE)
+
+	var data RData
+	if r.RDATAHEX != "" || field == nil || *field == "" {
+		rdata, err := hex.DecodeString(r.RDATAHEX)
+		if err != nil {
+			return Answer{}, fmt.Errorf("error decoding RDATAHEX: %w", err)
+		}
+		data, err = (&decoder{msg: rdata}).readRData(r.TYPE, 0, len(rdata), rdata)
+		if err != nil {
+			return Answer{}, err
+		}
+	} else {
+		tokens, err := tokenize(*field)
+		if err != nil {
+			return Answer{}, err
+		}
+		data, err = parseRData(r.TYPE, tokens)
+		if err != nil {
+			return Answer{}, err
+		}
+	}
+
+	return NewRecord(name, r.CLASS, r.TTL, data), nil
+}
+
+// rdataField returns the rdata member for records of type rrType, or nil if
+// the type has none.
+func (r *jsonRR) rdataField(rrType Type) *string {
+	switch rrType {
+	case TypeA:
+		return &r.RdataA
+	case TypeNS:
+		return &r.RdataNS
+	case TypeCNAME:
+		return &r.RdataCNAME
+	case TypeSOA:
+		return &r.RdataSOA
+	case TypePTR:
+		return &r.RdataPTR
+	case TypeMX:
+		return &r.RdataMX
+	case TypeTXT:
+		return &r.RdataTXT
+	case TypeAAAA:
+		return &r.RdataAAAA
+	case TypeSRV:
+		return &r.RdataSRV
+	default:
+		return nil
+	}
+}
+
+func answersToJSON(answers Answers) []jsonRR {
+	var rrs []jsonRR
+	for _, answer := range answers {
+		rrs = append(rrs, newJSONRR(answer))
+	}
+
+	return rrs
+}
+
+func answersFromJSON(rrs []jsonRR) (Answers, error) {
+	var answers Answers
+	for _, rr := range rrs {
+		answer, err := rr.answer()
+		if err != nil {
+			return nil, err
+		}
+		answers = append(answers, answer)
+	}
+
+	return answers, nil
+}
+
+func boolToUint16(b bool) uint16 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,81 @@
+package dns
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+)
+
+func TestMessage_MarshalJSON(t *testing.T) {
+	m := Message{
+		Header:    Header{ID: 1234, Flags: HeaderFlags{QR: 1, RD: 1, RA: 1, AD: 1}},
+		Questions: Questions{NewQuestion("example.com", TypeA, ClassIN)},
+		Answers:   Answers{NewRecord(Name{"example", "com"}, ClassIN, 60, A{A: net.IPv4(192, 0, 2, 1)})},
+		EDNS:      &EDNS{UDPSize: 1232},
+	}
+
+	actual, err := json.Marshal(m)
+	require.NoError(t, err)
+
+	expected := `{
+		"ID": 1234, "QR": true, "Opcode": 0, "AA": false, "TC": false, "RD": true, "RA": true,
+		"AD": true, "CD": false, "RCODE": 0,
+		"QDCOUNT": 1, "ANCOUNT": 1, "NSCOUNT": 0, "ARCOUNT": 1,
+		"questionRRs": [{"NAME": "example.com.", "TYPE": 1, "TYPEname": "A", "CLASS": 1, "CLASSname": "IN"}],
+		"answerRRs": [{
+			"NAME": "example.com.", "TYPE": 1, "TYPEname": "A", "CLASS": 1, "CLASSname": "IN",
+			"TTL": 60, "RDLENGTH": 4, "RDATAHEX": "c0000201", "rdataA": "192.0.2.1"
+		}],
+		"additionalRRs": [{"NAME": ".", "TYPE": 41, "TYPEname": "OPT", "CLASS": 1232, "TTL": 0, "RDLENGTH": 0}]
+	}`
+	require.JSONEq(t, expected, string(actual))
+}
+
+func TestMessage_UnmarshalJSON(t *testing.T) {
+	m := Message{
+		Header:    Header{ID: 1234, Flags: HeaderFlags{QR: 1, RD: 1, CD: 1}, QDCOUNT: 1, ANCOUNT: 2, NSCOUNT: 1, ARCOUNT: 2},
+		Questions: Questions{NewQuestion("example", TypeMX, ClassIN)},
+		Answers: Answers{
+			NewRecord(Name{"example"}, ClassIN, 60, MX{Preference: 10, Exchange: Name{"mail", "example"}}),
+			NewRecord(Name{"example"}, ClassIN, 60, RawRData{RRType: 65280, Data: []byte{1, 2}}),
+		},
+		Authority:  Answers{NewRecord(Name{"example"}, ClassIN, 60, NS{Host: Name{"ns", "example"}})},
+		Additional: Answers{NewRecord(Name{"mail", "example"}, ClassIN, 60, AAAA{AAAA: net.ParseIP("2001:db8::1")})},
+		EDNS:       &EDNS{UDPSize: 1232, DO: true, Options: []EDNSOption{ExtendedError{InfoCode: ExtendedErrorBlocked}}},
+	}
+
+	encoded, err := json.Marshal(m)
+	require.NoError(t, err)
+
+	var actual Message
+	require.NoError(t, json.Unmarshal(encoded, &actual))
+	require.Equal(t, m, actual)
+
+	withOctets, err := m.MarshalJSONWithOctets()
+	require.NoError(t, err)
+
+	var fromOctets Message
+	require.NoError(t, json.Unmarshal(withOctets, &fromOctets))
+	require.Equal(t, m, fromOctets)
+}
+
+func TestMessage_UnmarshalJSONPresentationRData(t *testing.T) {
+	encoded := `{
+		"ID": 1, "QR": true, "RCODE": 0,
+		"answerRRs": [
+			{"NAME": "example.com.", "TYPE": 16, "CLASS": 1, "TTL": 60, "rdataTXT": "\"hello world\""},
+			{"NAME": "example.com.", "TYPE": 15, "CLASS": 1, "TTL": 60, "rdataMX": "10 mail.example.com."}
+		]
+	}`
+
+	var actual Message
+	require.NoError(t, json.Unmarshal([]byte(encoded), &actual))
+	require.Equal(t, Answers{
+		NewRecord(Name{"example", "com"}, ClassIN, 60, TXT{Text: []string{"hello world"}}),
+		NewRecord(Name{"example", "com"}, ClassIN, 60, MX{Preference: 10, Exchange: Name{"mail", "example", "com"}}),
+	}, actual.Answers)
+
+	invalid := `{"answerRRs": [{"NAME": "example.com.", "TYPE": 1, "CLASS": 1, "rdataA": "not an address"}]}`
+	require.ErrorIs(t, json.Unmarshal([]byte(invalid), &actual), ErrInvalidRecord)
+}
@@ -1,20 +1,18 @@
 package dns
 
-import (
-	"bytes"
-	"encoding/binary"
-	"strings"
-)
+import "encoding/binary"
 
 type HeaderFlags struct {
 	QR     uint16
-	OPCODE uint16
+	OPCODE Opcode
 	AA     uint16
 	TC     uint16
 	RD     uint16
 	RA     uint16
 	Z      uint16
-	RCODE  uint16
+	AD     uint16
+	CD     uint16
+	RCODE  Rcode
 }
 
 type Header struct {
@@ -30,35 +28,45 @@ type Label string
 
 type Name []Label
 
-type LabelOffset struct {
-	value                    int
-	labelEndOffset           int
-	compressionPointerOffset int
-}
-
 type Question struct {
 	NAME  Name
-	TYPE  uint16
-	CLASS uint16
+	TYPE  Type
+	CLASS Class
 }
 
 type Questions []Question
 
 type Answer struct {
 	NAME    Name
-	TYPE    uint16
-	CLASS   uint16
+	TYPE    Type
+	CLASS   Class
 	TTL     uint32
 	RDLENGH uint16
 	RDATA   []byte
+
+	// Data is the decoded form of RDATA. When set, it takes precedence over
+	// RDATA on serialization.
+	Data RData
 }
 
 type Answers []Answer
 
 type Message struct {
-	Header    Header
-	Questions Questions
-	Answers   Answers
+	Header     Header
+	Questions  Questions
+	Answers    Answers
+	Authority  Answers
+	Additional Answers
+
+	// EDNS holds the OPT pseudo-record, which is serialized at the end of the
+	// additional section. It is nil if the message does not use EDNS.
+	EDNS *EDNS
+
+	// DisableCompression makes Serialize write every name in full, as needed
+	// for canonical forms such as DNSSEC signing input.
+	DisableCompression bool
+	// buffers keeps the storage of the last Unpack for the next one.
+	buffers unpackBuffers
 }
 
 type Messages []Message
@@ -67,28 +75,32 @@ func (f *HeaderFlags) toInt16() uint16 {
 	var flags uint16 = 0
 
 	flags |= f.QR << 15
-	flags |= f.OPCODE << 11
+	flags |= uint16(f.OPCODE) << 11
 	flags |= f.AA << 10
 	flags |= f.TC << 9
 	flags |= f.RD << 8
 	flags |= f.RA << 7
-	flags |= f.Z << 4
-	flags |= f.RCODE
+	flags |= f.Z << 6
+	flags |= f.AD << 5
+	flags |= f.CD << 4
+	flags |= uint16(f.RCODE)
 
 	return flags
 }
 
 func (h Header) serialize() []byte {
-	res := make([]byte, 12)
+	return h.pack(make([]byte, 0, headerLength))
+}
 
-	binary.BigEndian.PutUint16(res[0:], h.ID)
-	binary.BigEndian.PutUint16(res[2:], h.Flags.toInt16())
-	binary.BigEndian.PutUint16(res[4:], h.QDCOUNT)
-	binary.BigEndian.PutUint16(res[6:], h.ANCOUNT)
-	binary.BigEndian.PutUint16(res[8:], h.NSCOUNT)
-	binary.BigEndian.PutUint16(res[10:], h.ARCOUNT)
+func (h Header) pack(buf []byte) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, h.ID)
+	buf = binary.BigEndian.AppendUint16(buf, h.Flags.toInt16())
+	buf = binary.BigEndian.AppendUint16(buf, h.QDCOUNT)
+	buf = binary.BigEndian.AppendUint16(buf, h.ANCOUNT)
+	buf = binary.BigEndian.AppendUint16(buf, h.NSCOUNT)
+	buf = binary.BigEndian.AppendUint16(buf, h.ARCOUNT)
 
-	return res
+	return buf
 }
 
 func (l Label) serialize() []byte {
@@ -97,14 +109,12 @@ func (l Label) serialize() []byte {
 	return append([]byte{length}, []byte(l)...)
 }
 
-func (qs Questions) serialize() []byte {
-	var serializedQuestions []byte
-
+func (qs Questions) pack(buf []byte, ct *compressionTable) []byte {
 	for _, question := range qs {
-		serializedQuestions = append(serializedQuestions, question.serialize()...)
+		buf = question.pack(buf, ct)
 	}
 
-	return serializedQuestions
+	return buf
 }
 
 func (qs Questions) answer(ttl uint32, rdata []byte) Answers {
@@ -122,25 +132,19 @@ func (qs Questions) Count() uint16 {
 }
 
 func (n Name) serialize() []byte {
-	var sequence []byte
-
-	for _, label := range n {
-		sequence = append(sequence, label.serialize()...)
-	}
-
-	sequence = append(sequence, 0x00)
-
-	return sequence
+	return n.pack(nil, nil)
 }
 
 func (q Question) serialize() []byte {
-	var serializedQuestion []byte
+	return q.pack(nil, nil)
+}
 
-	serializedQuestion = append(serializedQuestion, q.NAME.serialize()...)
-	serializedQuestion = appendUint16ToSlice(serializedQuestion, q.TYPE)
-	serializedQuestion = appendUint16ToSlice(serializedQuestion, q.CLASS)
+func (q Question) pack(buf []byte, ct *compressionTable) []byte {
+	buf = q.NAME.pack(buf, ct)
+	buf = appendUint16ToSlice(buf, uint16(q.TYPE))
+	buf = appendUint16ToSlice(buf, uint16(q.CLASS))
 
-	return serializedQuestion
+	return buf
 }
 
 func (q Question) answer(ttl uint32, rdata []byte) Answer {
@@ -149,42 +153,151 @@ func (q Question) answer(ttl uint32, rdata []byte) Answer {
 }
 
 func (a Answer) serialize() []byte {
-	var buffer bytes.Buffer
-
-	buffer.Write(a.NAME.serialize())
-
-	binary.Write(&buffer, binary.BigEndian, a.TYPE)
-	binary.Write(&buffer, binary.BigEndian, a.CLASS)
-	binary.Write(&buffer, binary.BigEndian, a.TTL)
-	binary.Write(&buffer, binary.BigEndian, a.RDLENGH)
+	return a.pack(nil, nil)
+}
 
-	buffer.Write(a.RDATA)
+// pack appends the record to buf. RDLENGTH is computed from the RDATA actually
+// written, which may be shorter than RDLENGH once names in it are compressed.
+func (a Answer) pack(buf []byte, ct *compressionTable) []byte {
+	buf = a.NAME.pack(buf, ct)
+	buf = appendUint16ToSlice(buf, uint16(a.TYPE))
+	buf = appendUint16ToSlice(buf, uint16(a.CLASS))
+	buf = binary.BigEndian.AppendUint32(buf, a.TTL)
+
+	rdLengthOffset := len(buf)
+	buf = appendUint16ToSlice(buf, 0)
+	if a.Data != nil {
+		buf = a.Data.pack(buf, ct)
+	} else {
+		buf = packRDATA(buf, ct, a.TYPE, a.RDATA)
+	}
+	binary.BigEndian.PutUint16(buf[rdLengthOffset:], uint16(len(buf)-rdLengthOffset-2))
 
-	return buffer.Bytes()
+	return buf
 }
 
-func (as Answers) serialize() []byte {
-	var serializedAnswers []byte
-
+func (as Answers) pack(buf []byte, ct *compressionTable) []byte {
 	for _, answer := range as {
-		serializedAnswers = append(serializedAnswers, answer.serialize()...)
+		buf = answer.pack(buf, ct)
 	}
 
-	return serializedAnswers
+	return buf
 }
 
 func (as Answers) Count() uint16 {
 	return uint16(len(as))
 }
 
+// Serialize returns the wire form of the message. Names are compressed across
+// all sections unless DisableCompression is set. The section counts are taken
+// from the sections themselves rather than from Header.
+//
+// Unlike Pack, Serialize does not report invalid names or addresses; they are
+// written as they are.
 func (m *Message) Serialize() []byte {
-	var buffer bytes.Buffer
+	ct := compressionTables.Get().(*compressionTable)
+	defer compressionTables.Put(ct)
+	ct.reset(!m.DisableCompression)
+
+	return m.pack(nil, ct)
+}
+
+// Pack writes the wire form of the message into buf, reusing its capacity,
+// and returns the resulting slice, like Serialize. It reports empty labels,
+// labels and names that are too long, A and AAAA records without a valid
+// address, and messages longer than 65535 octets. Once buf is large enough,
+// Pack does not allocate.
+func (m *Message) Pack(buf []byte) ([]byte, error) {
+	ct := compressionTables.Get().(*compressionTable)
+	defer compressionTables.Put(ct)
+	ct.reset(!m.DisableCompression)
+
+	buf = m.pack(buf[:0], ct)
+	if ct.err != nil {
+		return nil, ct.err
+	}
+	if len(buf) > maxMessageLength {
+		return nil, ErrMessageTooLarge
+	}
+
+	return buf, nil
+}
+
+func (m *Message) pack(buf []byte, ct *compressionTable) []byte {
+	header := m.Header
+	header.QDCOUNT = m.Questions.Count()
+	header.ANCOUNT = m.Answers.Count()
+	header.NSCOUNT = m.Authority.Count()
+	header.ARCOUNT = m.Additional.Count()
+	if m.EDNS != nil {
+		header.ARCOUNT++
+	}
 
-	buffer.Write(m.Header.serialize())
-	buffer.Write(m.Questions.serialize())
-	buffer.Write(m.Answers.serialize())
+	buf = header.pack(buf)
+	buf = m.Questions.pack(buf, ct)
+	buf = m.Answers.pack(buf, ct)
+	buf = m.Authority.pack(buf, ct)
+	buf = m.Additional.pack(buf, ct)
+	if m.EDNS != nil {
+		buf = m.EDNS.pack(buf)
+	}
 
-	return buffer.Bytes()
+	return buf
+}
+
+// Rcode returns the full 12-bit RCODE, combining the header with the extended
+// bits of EDNS.
+func (m *Message) Rcode() Rcode {
+	if m.EDNS == nil {
+		return m.Header.Flags.RCODE
+	}
+	return Rcode(m.EDNS.ExtendedRcode)<<4 | m.Header.Flags.RCODE
+}
+
+// Truncate makes the message fit in maxSize octets, as needed for a response
+// sent over UDP. Whole RRsets are dropped from the end of the additional
+// section, then of the authority section, then of the answer section, so that
+// no record is ever cut in half; the questions and the OPT record are kept.
+// TC is set once answer or authority records are dropped, but not for
+// additional records alone (RFC 2181, section 9).
+func (m *Message) Truncate(maxSize int) {
+	ct := compressionTables.Get().(*compressionTable)
+	defer compressionTables.Put(ct)
+
+	var buf []byte
+	fits := func() bool {
+		ct.reset(!m.DisableCompression)
+		buf = m.pack(buf[:0], ct)
+		return len(buf) <= maxSize
+	}
+
+	defer m.updateCounts()
+	if fits() {
+		return
+	}
+	for _, section := range []*Answers{&m.Additional, &m.Authority, &m.Answers} {
+		for len(*section) > 0 {
+			*section = (*section)[:(*section).lastRRset()]
+			if section != &m.Additional {
+				m.Header.Flags.TC = 1
+			}
+			if fits() {
+				return
+			}
+		}
+	}
+}
+
+// lastRRset returns the index of the first record of the RRset at the end of
+// as, i.e. of the records sharing the name, type and class of the last one.
+func (as Answers) lastRRset() int {
+	last := as[len(as)-1]
+	i := len(as) - 1
+	for i > 0 && as[i-1].TYPE == last.TYPE && as[i-1].CLASS == last.CLASS && as[i-1].NAME.Equal(last.NAME) {
+		i--
+	}
+
+	return i
 }
 
 func (m *Message) Split() Messages {
@@ -208,24 +321,28 @@ func (m *Message) Split() Messages {
 	return messages
 }
 
+// Respond returns the response answering every question of m with the same
+// RDATA and RCODE NOTIMP, keeping the rest of the header of m.
+// Use SetReply and AddAnswer to build any other response.
 func (m *Message) Respond(ttl uint32, rdata []byte) Message {
-	rm := Message{
-		Header:    m.Header,
-		Questions: m.Questions,
-		Answers:   m.Questions.answer(ttl, rdata),
-	}
-
+	rm := Message{Header: m.Header, Questions: m.Questions}
 	rm.Header.Flags.QR = 1
-	rm.Header.Flags.RCODE = 4
-	rm.Header.QDCOUNT = rm.Questions.Count()
-	rm.Header.ANCOUNT = rm.Answers.Count()
-	rm.Header.NSCOUNT = 0
-	rm.Header.ARCOUNT = 0
+	rm.SetRcode(RcodeNotImp).AddAnswer(m.Questions.answer(ttl, rdata)...)
 
 	return rm
 }
 
+// Merge combines the responses to the messages returned by Split into one
+// response, keeping the sections in the order of ms. The header is that of the
+// first message, except that TC is set if any message has it and the RCODE is
+// the first one in ms that is not NOERROR, so that a failed part, e.g. a
+// SERVFAIL for one question, is never hidden by the others. Merging no
+// messages returns an empty message.
 func (ms Messages) Merge() Message {
+	if len(ms) == 0 {
+		return Message{}
+	}
+
 	qs := Questions{}
 	for _, m := range ms {
 		qs = append(qs, m.Questions...)
@@ -234,19 +351,74 @@ func (ms Messages) Merge() Message {
 	for _, m := range ms {
 		as = append(as, m.Answers...)
 	}
+	var ns Answers
+	for _, m := range ms {
+		ns = append(ns, m.Authority...)
+	}
+	var ar Answers
+	for _, m := range ms {
+		ar = append(ar, m.Additional...)
+	}
+
+	flags := ms[0].Header.Flags
+	rcode := RcodeNoError
+	for _, m := range ms {
+		if m.Header.Flags.TC == 1 {
+			flags.TC = 1
+		}
+		if rcode == RcodeNoError {
+			rcode = m.Rcode()
+		}
+	}
+	flags.RCODE = rcode & 0x0F
+
+	// Extended errors describe the response as a whole, so keep those of
+	// every message along with the OPT record of the first.
+	edns := ms[0].EDNS
+	for _, m := range ms[1:] {
+		errs := m.ExtendedErrors()
+		if len(errs) == 0 {
+			continue
+		}
+		if edns == nil {
+			edns = &EDNS{UDPSize: m.EDNS.UDPSize}
+		} else {
+			copied := *edns
+			copied.Options = append([]EDNSOption(nil), edns.Options...)
+			edns = &copied
+		}
+		for _, e := range errs {
+			edns.Options = append(edns.Options, e)
+		}
+	}
+	if extended := uint8(rcode >> 4); extended != 0 || (edns != nil && edns.ExtendedRcode != extended) {
+		if edns == nil {
+			edns = &EDNS{UDPSize: defaultUDPSize}
+		} else {
+			copied := *edns
+			edns = &copied
+		}
+		edns.ExtendedRcode = extended
+	}
+
 	return Message{
 		Header: Header{
 			ID:      ms[0].Header.ID,
-			Flags:   ms[0].Header.Flags,
+			Flags:   flags,
 			QDCOUNT: uint16(len(qs)),
 			ANCOUNT: uint16(len(as)),
+			NSCOUNT: uint16(len(ns)),
+			ARCOUNT: uint16(len(ar)),
 		},
-		Questions: qs,
-		Answers:   as,
+		Questions:  qs,
+		Answers:    as,
+		Authority:  ns,
+		Additional: ar,
+		EDNS:       edns,
 	}
 }
 
-func NewAnswer(name Name, qType uint16, qClass uint16, ttl uint32, rdlength uint16, rdata []byte) Answer {
+func NewAnswer(name Name, qType Type, qClass Class, ttl uint32, rdlength uint16, rdata []byte) Answer {
 	return Answer{
 		NAME:    name,
 		TYPE:    qType,
@@ -257,27 +429,22 @@ func NewAnswer(name Name, qType uint16, qClass uint16, ttl uint32, rdlength uint
 	}
 }
 
-func parseDomainName(n string) Name {
-	labels := strings.Split(n, ".")
-	name := make(Name, len(labels))
-
-	for i, label := range labels {
-		name[i] = Label(label)
+// NewQuestion returns a question for the name n in presentation format, as
+// parsed by ParseName. It panics if n is not a valid name, so names that do
+// not come from the program itself should go through ParseName first.
+func NewQuestion(n string, t Type, c Class) Question {
+	name, err := ParseName(n)
+	if err != nil {
+		panic(err)
 	}
 
-	return name
-}
-
-func NewQuestion(n string, t uint16, c uint16) Question {
 	return Question{
-		NAME:  parseDomainName(n),
+		NAME:  name,
 		TYPE:  t,
 		CLASS: c,
 	}
 }
 
 func appendUint16ToSlice(slice []byte, value uint16) []byte {
-	bytes := make([]byte, 2)
-	binary.BigEndian.PutUint16(bytes, value)
-	return append(slice, bytes...)
+	return binary.BigEndian.AppendUint16(slice, value)
 }
@@ -3,6 +3,7 @@ package dns
 import (
 	"github.com/stretchr/testify/require"
 	"net"
+	"strings"
 	"testing"
 )
 
@@ -30,6 +31,18 @@ func TestHeader_Serialize(t *testing.T) {
 	require.Equal(t, expected, header.serialize(), "Serialized headers should match expected value")
 }
 
+func TestHeaderFlags_ADAndCD(t *testing.T) {
+	flags := HeaderFlags{QR: 1, OPCODE: OpcodeNotify, RD: 1, AD: 1, CD: 1, RCODE: RcodeNXDomain}
+	header := Header{ID: 1234, Flags: flags}
+
+	data := header.serialize()
+	require.Equal(t, []byte{0xA1, 0x33}, data[2:4], "AD and CD should be bits 5 and 4 of the second flags octet")
+
+	actual, err := RowHeader(data).parse()
+	require.NoError(t, err)
+	require.Equal(t, header, actual)
+}
+
 func TestLabel_Serialize(t *testing.T) {
 	var expected = []byte{
 		0x06, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65,
@@ -57,17 +70,17 @@ func TestQuestion_Serialize(t *testing.T) {
 		0x00, 0x01,
 	}
 
-	question := NewQuestion("google.com", 1, 1)
+	question := NewQuestion("google.com", TypeA, ClassIN)
 
 	require.Equal(t, expected, question.serialize(), "Serialized question should match expected value")
 }
 
 func TestQuestion_answer(t *testing.T) {
-	q := NewQuestion("google.com", 1, 1)
+	q := NewQuestion("google.com", TypeA, ClassIN)
 	rdata := net.ParseIP("8.8.8.8").To4()
 	a := q.answer(60, rdata)
 
-	expected := NewAnswer(Name{"google", "com"}, 1, 1, 60, uint16(len(rdata)), rdata)
+	expected := NewAnswer(Name{"google", "com"}, TypeA, ClassIN, 60, uint16(len(rdata)), rdata)
 
 	require.Equal(t, expected, a, "Answer should match expected value")
 }
@@ -86,7 +99,7 @@ func TestMessage_Serialize(t *testing.T) {
 		0x00, 0x01,
 		0x00, 0x01,
 		// Answer
-		0x06, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x03, 0x63, 0x6f, 0x6d, 0x0,
+		0xc0, 0x0c, // pointer to google.com
 		0x00, 0x01,
 		0x00, 0x01,
 		0x00, 0x00, 0x00, 0x01,
@@ -107,16 +120,125 @@ func TestMessage_Serialize(t *testing.T) {
 			ARCOUNT: 0,
 		},
 		Questions: Questions{
-			NewQuestion("google.com", 1, 1),
+			NewQuestion("google.com", TypeA, ClassIN),
 		},
 		Answers: Answers{
-			NewAnswer(Name{"google", "com"}, 1, 1, 1, uint16(len(rdata)), rdata),
+			NewAnswer(Name{"google", "com"}, TypeA, ClassIN, 1, uint16(len(rdata)), rdata),
 		},
 	}
 
 	require.Equal(t, expected, message.Serialize(), "Serialized headers should match expected value")
 }
 
+func TestMessage_SerializeWithoutCompression(t *testing.T) {
+	var expected = []byte{
+		// Header
+		0x04, 0xD2, // ID
+		0x80, 0x00, // Flags
+		0x00, 0x01, // QDCOUNT
+		0x00, 0x01, // ANCOUNT
+		0x00, 0x00, // NSCOUNT
+		0x00, 0x00, // ARCOUNT
+		// Question
+		0x06, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x03, 0x63, 0x6f, 0x6d, 0x0,
+		0x00, 0x01,
+		0x00, 0x01,
+		// Answer
+		0x06, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x03, 0x63, 0x6f, 0x6d, 0x0,
+		0x00, 0x01,
+		0x00, 0x01,
+		0x00, 0x00, 0x00, 0x01,
+		0x00, 0x04,
+		0x08, 0x08, 0x08, 0x08,
+	}
+
+	rdata := net.ParseIP("8.8.8.8").To4()
+	message := Message{
+		Header: Header{
+			ID: 1234,
+			Flags: HeaderFlags{
+				QR: 1,
+			},
+			QDCOUNT: 1,
+			ANCOUNT: 1,
+		},
+		Questions: Questions{
+			NewQuestion("google.com", TypeA, ClassIN),
+		},
+		Answers: Answers{
+			NewAnswer(Name{"google", "com"}, TypeA, ClassIN, 1, uint16(len(rdata)), rdata),
+		},
+		DisableCompression: true,
+	}
+
+	require.Equal(t, expected, message.Serialize(), "Serialized message should not be compressed")
+}
+
+func TestMessage_SerializeCompressesRDATA(t *testing.T) {
+	var expected = []byte{
+		// Header
+		0x04, 0xD2, // ID
+		0x80, 0x00, // Flags
+		0x00, 0x01, // QDCOUNT
+		0x00, 0x02, // ANCOUNT
+		0x00, 0x00, // NSCOUNT
+		0x00, 0x00, // ARCOUNT
+		// Question
+		0x03, 0x77, 0x77, 0x77, // www
+		0x06, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x03, 0x63, 0x6f, 0x6d, 0x0, // google.com
+		0x00, 0x05,
+		0x00, 0x01,
+		// Answer 1
+		0xc0, 0x0c, // pointer to www.google.com
+		0x00, 0x05,
+		0x00, 0x01,
+		0x00, 0x00, 0x00, 0x3c,
+		0x00, 0x05,
+		0x02, 0x67, 0x6f, 0xc0, 0x10, // go + pointer to google.com
+		// Answer 2
+		0xc0, 0x10, // pointer to google.com
+		0x00, 0x10,
+		0x00, 0x01,
+		0x00, 0x00, 0x00, 0x3c,
+		0x00, 0x0c,
+		0x0b, 0x06, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x03, 0x63, 0x6f, 0x6d, // TXT is copied verbatim
+	}
+
+	cname := Name{"go", "google", "com"}.serialize()
+	txt := append([]byte{0x0b}, []byte("\x06google\x03com")...)
+	message := Message{
+		Header: Header{
+			ID: 1234,
+			Flags: HeaderFlags{
+				QR: 1,
+			},
+			QDCOUNT: 1,
+			ANCOUNT: 2,
+		},
+		Questions: Questions{
+			NewQuestion("www.google.com", TypeCNAME, ClassIN),
+		},
+		Answers: Answers{
+			NewAnswer(Name{"www", "google", "com"}, TypeCNAME, ClassIN, 60, uint16(len(cname)), cname),
+			NewAnswer(Name{"google", "com"}, TypeTXT, ClassIN, 60, uint16(len(txt)), txt),
+		},
+	}
+
+	require.Equal(t, expected, message.Serialize(), "Names in CNAME RDATA should be compressed")
+}
+
+func TestMessage_SerializeRepeatedLabels(t *testing.T) {
+	name := Name{"www", "www", "example", "com"}
+	m := *NewQuery("www.www.example.com", TypeA)
+	m.AddAnswer(NewRecord(name, ClassIN, 60, CNAME{Target: Name{"www", "www", "www", "example", "com"}}))
+	m.AddAnswer(NewRecord(name, ClassIN, 60, MX{Preference: 10, Exchange: Name{"mx", "mx", "example", "com"}}))
+
+	parsed, err := RawMessage(m.Serialize()).Parse()
+	require.NoError(t, err)
+	require.Equal(t, name, parsed.Questions[0].NAME)
+	require.Equal(t, m.Answers, parsed.Answers)
+}
+
 func TestMessage_Respond(t *testing.T) {
 	rdata := net.ParseIP("8.8.8.8").To4()
 	rdlen := uint16(len(rdata))
@@ -132,8 +254,8 @@ func TestMessage_Respond(t *testing.T) {
 			NSCOUNT: 0,
 			ARCOUNT: 0,
 		},
-		Questions: Questions{NewQuestion("google.com", 1, 1)},
-		Answers:   Answers{NewAnswer(Name{"google", "com"}, 1, 1, 1, rdlen, rdata)},
+		Questions: Questions{NewQuestion("google.com", TypeA, ClassIN)},
+		Answers:   Answers{NewAnswer(Name{"google", "com"}, TypeA, ClassIN, 1, rdlen, rdata)},
 	}
 
 	message := Message{
@@ -147,7 +269,7 @@ func TestMessage_Respond(t *testing.T) {
 			NSCOUNT: 0,
 			ARCOUNT: 0,
 		},
-		Questions: Questions{NewQuestion("google.com", 1, 1)},
+		Questions: Questions{NewQuestion("google.com", TypeA, ClassIN)},
 	}
 
 	require.Equal(t, expected, message.Respond(1, rdata), "Responded message should match expected value")
@@ -166,7 +288,7 @@ func TestMessage_Split(t *testing.T) {
 				NSCOUNT: 0,
 				ARCOUNT: 0,
 			},
-			Questions: Questions{NewQuestion("google.com", 1, 1)},
+			Questions: Questions{NewQuestion("google.com", TypeA, ClassIN)},
 			Answers:   Answers{},
 		},
 		Message{
@@ -180,7 +302,7 @@ func TestMessage_Split(t *testing.T) {
 				NSCOUNT: 0,
 				ARCOUNT: 0,
 			},
-			Questions: Questions{NewQuestion("google.com", 1, 1)},
+			Questions: Questions{NewQuestion("google.com", TypeA, ClassIN)},
 			Answers:   Answers{},
 		},
 	}
@@ -196,7 +318,7 @@ func TestMessage_Split(t *testing.T) {
 			NSCOUNT: 0,
 			ARCOUNT: 0,
 		},
-		Questions: Questions{NewQuestion("google.com", 1, 1), NewQuestion("google.com", 1, 1)},
+		Questions: Questions{NewQuestion("google.com", TypeA, ClassIN), NewQuestion("google.com", TypeA, ClassIN)},
 	}
 
 	require.Equal(t, expected, message.Split(), "Split messages should match expected value")
@@ -214,7 +336,7 @@ func TestMessages_Merge(t *testing.T) {
 			NSCOUNT: 0,
 			ARCOUNT: 0,
 		},
-		Questions: Questions{NewQuestion("google.com", 1, 1), NewQuestion("google.com", 1, 1)},
+		Questions: Questions{NewQuestion("google.com", TypeA, ClassIN), NewQuestion("google.com", TypeA, ClassIN)},
 		Answers:   Answers{},
 	}
 
@@ -230,7 +352,7 @@ func TestMessages_Merge(t *testing.T) {
 				NSCOUNT: 0,
 				ARCOUNT: 0,
 			},
-			Questions: Questions{NewQuestion("google.com", 1, 1)},
+			Questions: Questions{NewQuestion("google.com", TypeA, ClassIN)},
 			Answers:   Answers{},
 		},
 		Message{
@@ -244,10 +366,266 @@ func TestMessages_Merge(t *testing.T) {
 				NSCOUNT: 0,
 				ARCOUNT: 0,
 			},
-			Questions: Questions{NewQuestion("google.com", 1, 1)},
+			Questions: Questions{NewQuestion("google.com", TypeA, ClassIN)},
 			Answers:   Answers{},
 		},
 	}
 
 	require.Equal(t, expected, messages.Merge(), "Merged message should match expected value")
 }
+
+func TestMessages_MergeWithAuthorityAndAdditional(t *testing.T) {
+	soa := NewAnswer(Name{"com"}, TypeSOA, ClassIN, 60, 4, []byte{1, 2, 3, 4})
+	glue := NewAnswer(Name{"ns", "com"}, TypeA, ClassIN, 60, 4, []byte{5, 6, 7, 8})
+
+	messages := Messages{
+		Message{
+			Header:    Header{ID: 1234, Flags: HeaderFlags{QR: 1}, QDCOUNT: 1, NSCOUNT: 1},
+			Questions: Questions{NewQuestion("abc.com", TypeA, ClassIN)},
+			Authority: Answers{soa},
+		},
+		Message{
+			Header:     Header{ID: 1234, Flags: HeaderFlags{QR: 1}, QDCOUNT: 1, ARCOUNT: 1},
+			Questions:  Questions{NewQuestion("def.com", TypeA, ClassIN)},
+			Additional: Answers{glue},
+		},
+	}
+
+	merged := messages.Merge()
+
+	require.Equal(t, uint16(1), merged.Header.NSCOUNT)
+	require.Equal(t, uint16(1), merged.Header.ARCOUNT)
+	require.Equal(t, Answers{soa}, merged.Authority)
+	require.Equal(t, Answers{glue}, merged.Additional)
+}
+
+func TestMessages_MergePartialResults(t *testing.T) {
+	answered := Message{
+		Header:    Header{ID: 1234, Flags: HeaderFlags{QR: 1, RD: 1, RA: 1}},
+		Questions: Questions{NewQuestion("abc.com", TypeA, ClassIN)},
+		Answers:   Answers{NewRecord(Name{"abc", "com"}, ClassIN, 60, A{A: net.IP{192, 0, 2, 1}})},
+	}
+	failed := *new(Message).SetReply(&Message{
+		Header:    Header{ID: 1234, Flags: HeaderFlags{RD: 1}},
+		Questions: Questions{NewQuestion("def.com", TypeA, ClassIN)},
+	}).SetRcode(RcodeServFail)
+	truncated := Message{
+		Header:    Header{ID: 1234, Flags: HeaderFlags{QR: 1, TC: 1, RCODE: RcodeNXDomain}},
+		Questions: Questions{NewQuestion("ghi.com", TypeA, ClassIN)},
+	}
+
+	merged := Messages{answered, failed, truncated}.Merge()
+	require.Equal(t, RcodeServFail, merged.Rcode(), "the first RCODE other than NOERROR should win")
+	require.Equal(t, uint16(1), merged.Header.Flags.TC)
+	require.Equal(t, uint16(1), merged.Header.Flags.RA, "flags should be those of the first message")
+	require.Len(t, merged.Questions, 3)
+	require.Equal(t, answered.Answers, merged.Answers)
+
+	merged = Messages{truncated, failed}.Merge()
+	require.Equal(t, RcodeNXDomain, merged.Rcode(), "the result should follow the order of the messages")
+
+	badCookie := *new(Message).SetReply(&answered).SetRcode(RcodeBadCookie)
+	merged = Messages{answered, badCookie}.Merge()
+	require.Equal(t, RcodeBadCookie, merged.Rcode(), "an extended RCODE should add an OPT record")
+}
+
+func TestMessages_MergeEmpty(t *testing.T) {
+	require.NotPanics(t, func() {
+		require.Equal(t, Message{}, Messages{}.Merge())
+		require.Equal(t, Message{}, Messages(nil).Merge())
+	})
+}
+
+func TestMessage_Truncate(t *testing.T) {
+	name := Name{"example", "com"}
+	a := func(i byte) Answer { return NewRecord(name, ClassIN, 60, A{A: net.IP{192, 0, 2, i}}) }
+	txt := func(s string) Answer { return NewRecord(name, ClassIN, 60, TXT{Text: []string{s}}) }
+	ns := NewRecord(name, ClassIN, 60, NS{Host: Name{"ns", "example", "com"}})
+	glue := NewRecord(Name{"ns", "example", "com"}, ClassIN, 60, A{A: net.IP{192, 0, 2, 53}})
+
+	message := func() Message {
+		return Message{
+			Header:     Header{ID: 1234, Flags: HeaderFlags{QR: 1}},
+			Questions:  Questions{NewQuestion("example.com", TypeANY, ClassIN)},
+			Answers:    Answers{a(1), a(2), txt(strings.Repeat("x", 200)), txt(strings.Repeat("y", 200))},
+			Authority:  Answers{ns},
+			Additional: Answers{glue},
+			EDNS:       &EDNS{UDPSize: 1232},
+		}
+	}
+
+	m := message()
+	m.Truncate(1232)
+	require.Equal(t, message().Answers, m.Answers, "a message that fits should be left alone")
+	require.Equal(t, uint16(0), m.Header.Flags.TC)
+
+	m = message()
+	size := len(m.Serialize())
+	m.Truncate(size - 1)
+	require.Empty(t, m.Additional)
+	require.Equal(t, Answers{ns}, m.Authority)
+	require.Len(t, m.Answers, 4)
+	require.Equal(t, uint16(0), m.Header.Flags.TC, "dropping additional records should not set TC")
+
+	m = message()
+	m.Truncate(size - 300)
+	require.Empty(t, m.Additional)
+	require.Empty(t, m.Authority)
+	require.Equal(t, Answers{a(1), a(2)}, m.Answers, "the TXT RRset should be dropped as a whole")
+	require.Equal(t, uint16(1), m.Header.Flags.TC)
+	require.NotNil(t, m.EDNS, "the OPT record should be kept")
+	require.LessOrEqual(t, len(m.Serialize()), size-300)
+
+	m = message()
+	m.Truncate(0)
+	require.Empty(t, m.Answers)
+	require.Len(t, m.Questions, 1, "questions should be kept")
+	require.Equal(t, uint16(1), m.Header.Flags.TC)
+
+	parsed, err := RawMessage(m.Serialize()).Parse()
+	require.NoError(t, err)
+	require.Equal(t, uint16(0), parsed.Header.ANCOUNT)
+	require.Equal(t, uint16(1), parsed.Header.ARCOUNT)
+}
+
+// benchmarkMessage returns a typical response: one question, a few answers
+// sharing the question name and an OPT record.
+func benchmarkMessage() Message {
+	name := Name{"www", "example", "com"}
+	return Message{
+		Header:    Header{ID: 1234, Flags: HeaderFlags{QR: 1, RD: 1, RA: 1}},
+		Questions: Questions{{NAME: name, TYPE: 1, CLASS: 1}},
+		Answers: Answers{
+			NewRecord(name, ClassIN, 300, CNAME{Target: Name{"cdn", "example", "net"}}),
+			NewRecord(Name{"cdn", "example", "net"}, ClassIN, 60, A{A: net.IPv4(192, 0, 2, 1).To4()}),
+			NewRecord(Name{"cdn", "example", "net"}, ClassIN, 60, A{A: net.IPv4(192, 0, 2, 2).To4()}),
+		},
+		EDNS: &EDNS{UDPSize: 1232, Options: []EDNSOption{Cookie{Client: [8]byte{1, 2, 3, 4, 5, 6, 7, 8}}}},
+	}
+}
+
+func TestMessage_Pack(t *testing.T) {
+	m := benchmarkMessage()
+
+	buf := make([]byte, 0, 512)
+	actual, err := m.Pack(buf)
+	require.NoError(t, err)
+	require.Equal(t, m.Serialize(), actual)
+	require.Equal(t, &buf[:1][0], &actual[0], "Pack should write into buf")
+
+	if raceEnabled {
+		t.Skip("allocations are not counted reliably under the race detector")
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		_, _ = m.Pack(buf)
+	})
+	require.Zero(t, allocs)
+}
+
+func TestNewQuestion(t *testing.T) {
+	require.Equal(t, Question{NAME: Name{"a.b", "example"}, TYPE: TypeA, CLASS: ClassIN}, NewQuestion(`a\.b.example.`, TypeA, ClassIN))
+	for _, name := range []string{"", "a..b", ".a"} {
+		require.Panics(t, func() { NewQuestion(name, TypeA, ClassIN) }, name)
+	}
+}
+
+func TestMessage_PackErrors(t *testing.T) {
+	long := Message{Questions: Questions{{NAME: Name{Label(make([]byte, 64))}, TYPE: 1, CLASS: 1}}}
+	_, err := long.Pack(nil)
+	require.ErrorIs(t, err, ErrLabelTooLong)
+
+	empty := Message{Questions: Questions{{NAME: Name{"a", "", "b"}, TYPE: 1, CLASS: 1}}}
+	_, err = empty.Pack(nil)
+	require.ErrorIs(t, err, ErrInvalidName)
+
+	for _, data := range []RData{A{A: net.ParseIP("2001:db8::1")}, A{}, AAAA{AAAA: net.IP{1, 2, 3}}, AAAA{}} {
+		invalid := Message{Answers: Answers{NewRecord(Name{"example"}, ClassIN, 60, data)}}
+		_, err = invalid.Pack(nil)
+		require.ErrorIs(t, err, ErrInvalidRDATA, "%#v", data)
+	}
+
+	var name Name
+	for i := 0; i < 26; i++ {
+		name = append(name, "abcdefghi")
+	}
+	tooLong := Message{Answers: Answers{NewRecord(Name{"example"}, ClassIN, 60, CNAME{Target: name})}}
+	_, err = tooLong.Pack(nil)
+	require.ErrorIs(t, err, ErrNameTooLong)
+
+	huge := Message{DisableCompression: true}
+	for i := 0; i < 300; i++ {
+		huge.Answers = append(huge.Answers, NewRecord(Name{"example"}, ClassIN, 60, TXT{Text: []string{string(make([]byte, 255))}}))
+	}
+	_, err = huge.Pack(nil)
+	require.ErrorIs(t, err, ErrMessageTooLarge)
+}
+
+func TestMessage_Unpack(t *testing.T) {
+	first := benchmarkMessage()
+	second := Message{
+		Header:    Header{ID: 99, QDCOUNT: 1},
+		Questions: Questions{{NAME: Name{"example", "org"}, TYPE: 28, CLASS: 1}},
+	}
+
+	var m Message
+	require.NoError(t, m.Unpack(first.Serialize()))
+	require.Equal(t, first.Answers, m.Answers)
+	questions := m.Questions
+
+	require.NoError(t, m.Unpack(second.Serialize()))
+	require.Equal(t, second.Questions, m.Questions)
+	require.Empty(t, m.Answers)
+	require.Nil(t, m.EDNS)
+	require.Equal(t, &questions[0], &m.Questions[0], "Unpack should reuse the sections of m")
+
+	require.Error(t, m.Unpack([]byte{0x00}))
+	require.Equal(t, Message{}, m)
+
+	if raceEnabled {
+		t.Skip("allocations are not counted reliably under the race detector")
+	}
+	msg := first.Serialize()
+	require.NoError(t, m.Unpack(msg))
+	allocs := testing.AllocsPerRun(100, func() {
+		_ = m.Unpack(msg)
+	})
+	// The copy of msg the labels refer to, and the CNAME, the two A and the
+	// OPT RDATA and the cookie boxed into interfaces.
+	require.Equal(t, float64(6), allocs)
+	require.Equal(t, first.Answers, m.Answers)
+	require.Equal(t, first.EDNS, m.EDNS)
+}
+
+func BenchmarkMessage_Pack(b *testing.B) {
+	m := benchmarkMessage()
+	buf := make([]byte, 0, 512)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := m.Pack(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMessage_Serialize(b *testing.B) {
+	m := benchmarkMessage()
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		m.Serialize()
+	}
+}
+
+func BenchmarkMessage_Unpack(b *testing.B) {
+	source := benchmarkMessage()
+	msg := source.Serialize()
+
+	var m Message
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := m.Unpack(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package dns
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ParseName parses a domain name in presentation format. The trailing dot is
+// optional, as every name is taken as fully qualified, and "." is the root.
+// A label may contain "\." and "\DDD" escapes (RFC 1035, section 5.1), and
+// labels written in non-ASCII text are converted to their IDNA form.
+func ParseName(s string) (Name, error) {
+	if s == "" {
+		return nil, fmt.Errorf("%w: empty name", ErrInvalidName)
+	}
+	if s == "." {
+		return Name{}, nil
+	}
+
+	var name Name
+	var label []byte
+	unicode := false
+	length := 1
+
+	endLabel := func() error {
+		if len(label) == 0 {
+			return fmt.Errorf("%w: empty label in %q", ErrInvalidName, s)
+		}
+		text := string(label)
+		if unicode {
+			ascii, err := labelToASCII(text)
+			if err != nil {
+				return fmt.Errorf("%w: %q is not a valid internationalized label", ErrInvalidName, text)
+			}
+			text = ascii
+		}
+		if len(text) > maxLabelLength {
+			return &lengthError{Err: ErrLabelTooLong}
+		}
+		length += 1 + len(text)
+		if length > maxNameLength {
+			return &lengthError{Err: ErrNameTooLong}
+		}
+		name = append(name, Label(text))
+		label, unicode = nil, false
+		return nil
+	}
+
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '.':
+			if err := endLabel(); err != nil {
+				return nil, err
+			}
+		case c == '\\':
+			if i+1 >= len(s) {
+				return nil, fmt.Errorf("%w: dangling escape in %q", ErrInvalidName, s)
+			}
+			if !isDigit(s[i+1]) {
+				label = append(label, s[i+1])
+				i++
+				continue
+			}
+			if i+3 >= len(s) || !isDigit(s[i+2]) || !isDigit(s[i+3]) {
+				return nil, fmt.Errorf("%w: short decimal escape in %q", ErrInvalidName, s)
+			}
+			value := int(s[i+1]-'0')*100 + int(s[i+2]-'0')*10 + int(s[i+3]-'0')
+			if value > 255 {
+				return nil, fmt.Errorf("%w: decimal escape above 255 in %q", ErrInvalidName, s)
+			}
+			label = append(label, byte(value))
+			i += 3
+		default:
+			if c >= 0x80 {
+				unicode = true
+			}
+			label = append(label, c)
+		}
+	}
+	if len(label) > 0 {
+		if err := endLabel(); err != nil {
+			return nil, err
+		}
+	}
+
+	return name, nil
+}
+
+// lengthError is an ErrInvalidName for a label or name that is too long, and
+// errors.Is also finds ErrLabelTooLong or ErrNameTooLong in it.
+type lengthError struct {
+	Err error
+}
+
+func (e *lengthError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrInvalidName, e.Err)
+}
+
+func (e *lengthError) Unwrap() error {
+	return e.Err
+}
+
+func (e *lengthError) Is(target error) bool {
+	return target == ErrInvalidName
+}
+
+// String returns the label in presentation format, escaping the characters
+// that would otherwise end or change the meaning of the label.
+func (l Label) String() string {
+	var b strings.Builder
+	for i := 0; i < len(l); i++ {
+		switch c := l[i]; {
+		case strings.IndexByte(`."\();@$`, c) >= 0:
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c <= ' ' || c > '~':
+			fmt.Fprintf(&b, "\\%03d", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String()
+}
+
+// String returns the name in presentation format, fully qualified with a
+// trailing dot. The root is ".".
+func (n Name) String() string {
+	if len(n) == 0 {
+		return "."
+	}
+
+	var b strings.Builder
+	for _, label := range n {
+		b.WriteString(label.String())
+		b.WriteByte('.')
+	}
+
+	return b.String()
+}
+
+// ToUnicode is like String, but shows labels in IDNA form as Unicode text.
+func (n Name) ToUnicode() string {
+	if len(n) == 0 {
+		return "."
+	}
+
+	var b strings.Builder
+	for _, label := range n {
+		if decoded := labelToUnicode(string(label)); decoded != string(label) {
+			b.WriteString(decoded)
+		} else {
+			b.WriteString(label.String())
+		}
+		b.WriteByte('.')
+	}
+
+	return b.String()
+}
+
+// Canonical returns the name with ASCII letters in lower case, which is the
+// canonical form of RFC 4034, section 6.2.
+func (n Name) Canonical() Name {
+	canonical := make(Name, len(n))
+	for i, label := range n {
+		canonical[i] = Label(toLowerASCII(string(label)))
+	}
+
+	return canonical
+}
+
+// Equal reports whether n and other are the same name. Names are compared
+// case-insensitively, as RFC 4343 requires, and only for ASCII letters.
+func (n Name) Equal(other Name) bool {
+	if len(n) != len(other) {
+		return false
+	}
+	for i := range n {
+		if toLowerASCII(string(n[i])) != toLowerASCII(string(other[i])) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Compare returns -1, 0 or +1 depending on whether n sorts before, with or
+// after other in the canonical order of RFC 4034, section 6.1.
+func (n Name) Compare(other Name) int {
+	for i, j := len(n)-1, len(other)-1; i >= 0 || j >= 0; i, j = i-1, j-1 {
+		if i < 0 {
+			return -1
+		}
+		if j < 0 {
+			return 1
+		}
+		if c := strings.Compare(toLowerASCII(string(n[i])), toLowerASCII(string(other[j]))); c != 0 {
+			return c
+		}
+	}
+
+	return 0
+}
+
+// IsSubdomainOf reports whether n is parent or a name below it.
+func (n Name) IsSubdomainOf(parent Name) bool {
+	return len(n) >= len(parent) && n[len(n)-len(parent):].Equal(parent)
+}
+
+// Parent returns the name with its first label removed. It returns false for
+// the root, which has no parent.
+func (n Name) Parent() (Name, bool) {
+	if len(n) == 0 {
+		return nil, false
+	}
+
+	return n[1:], true
+}
+
+// Parents returns the names above n, nearest first and ending with the root.
+func (n Name) Parents() []Name {
+	parents := make([]Name, 0, len(n))
+	for i := 1; i <= len(n); i++ {
+		parents = append(parents, n[i:])
+	}
+
+	return parents
+}
+
+func toLowerASCII(s string) string {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 'A' && s[i] <= 'Z' {
+			b := []byte(s)
+			for j := i; j < len(b); j++ {
+				if b[j] >= 'A' && b[j] <= 'Z' {
+					b[j] += 'a' - 'A'
+				}
+			}
+			return string(b)
+		}
+	}
+
+	return s
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
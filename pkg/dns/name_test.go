@@ -0,0 +1,144 @@
+package dns
+
+import (
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestParseName(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected Name
+	}{
+		{".", Name{}},
+		{"example.com", Name{"example", "com"}},
+		{"example.com.", Name{"example", "com"}},
+		{`a\.b.example.`, Name{"a.b", "example"}},
+		{`a\032b\\c.example`, Name{"a b\\c", "example"}},
+		{`\000\255.`, Name{"\x00\xff"}},
+		{"bücher.example", Name{"xn--bcher-kva", "example"}},
+		{"MÜNCHEN.de", Name{"xn--mnchen-3ya", "de"}},
+	}
+
+	for _, test := range tests {
+		actual, err := ParseName(test.text)
+		require.NoError(t, err, test.text)
+		require.Equal(t, test.expected, actual, test.text)
+	}
+}
+
+func TestParseName_Errors(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected error
+	}{
+		{"", ErrInvalidName},
+		{"..", ErrInvalidName},
+		{"a..b", ErrInvalidName},
+		{".a", ErrInvalidName},
+		{`a\`, ErrInvalidName},
+		{`a\25`, ErrInvalidName},
+		{`a\256`, ErrInvalidName},
+		{"\xff\xfe.example", ErrInvalidName},
+		{string(make([]byte, 64)) + ".example", ErrLabelTooLong},
+		{strings.Repeat("abcdefghi.", 26), ErrNameTooLong},
+	}
+
+	for _, test := range tests {
+		_, err := ParseName(test.text)
+		require.ErrorIs(t, err, test.expected, test.text)
+		require.ErrorIs(t, err, ErrInvalidName, test.text)
+	}
+}
+
+func FuzzParseName(f *testing.F) {
+	for _, seed := range []string{".", "example.com.", `a\.b\032c.example`, "bücher.example", "a..b"} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, text string) {
+		name, err := ParseName(text)
+		if err != nil {
+			require.ErrorIs(t, err, ErrInvalidName)
+			return
+		}
+
+		again, err := ParseName(name.String())
+		require.NoError(t, err, "A formatted name should parse again")
+		require.Equal(t, name, again)
+	})
+}
+
+func TestName_String(t *testing.T) {
+	require.Equal(t, ".", Name{}.String())
+	require.Equal(t, "example.com.", Name{"example", "com"}.String())
+	require.Equal(t, `a\.b\;c\032d\\\000.example.`, Name{"a.b;c d\\\x00", "example"}.String())
+
+	for _, name := range []Name{{"a.b", "c\\d"}, {"\x00\x7f\xff", "$@()"}, {"xn--bcher-kva"}} {
+		parsed, err := ParseName(name.String())
+		require.NoError(t, err)
+		require.Equal(t, name, parsed)
+	}
+}
+
+func TestName_ToUnicode(t *testing.T) {
+	require.Equal(t, "bücher.example.", Name{"xn--bcher-kva", "example"}.ToUnicode())
+	require.Equal(t, "xn--invalid-.example.", Name{"xn--invalid-", "example"}.ToUnicode())
+	require.Equal(t, `a\.b.`, Name{"a.b"}.ToUnicode())
+}
+
+func TestName_Equal(t *testing.T) {
+	require.True(t, Name{"Example", "COM"}.Equal(Name{"example", "com"}))
+	require.False(t, Name{"example", "com"}.Equal(Name{"example", "org"}))
+	require.False(t, Name{"www", "example", "com"}.Equal(Name{"example", "com"}))
+	require.False(t, Name{"\xc3"}.Equal(Name{"\xe3"}), "only ASCII letters fold")
+	require.Equal(t, Name{"www", "example", "com"}, Name{"WWW", "Example", "com"}.Canonical())
+}
+
+func TestName_Compare(t *testing.T) {
+	// The example of RFC 4034, section 6.1, in canonical order.
+	ordered := []Name{
+		{"example"},
+		{"a", "example"},
+		{"yljkjljk", "a", "example"},
+		{"Z", "a", "example"},
+		{"zABC", "a", "EXAMPLE"},
+		{"z", "example"},
+		{"\x01", "z", "example"},
+		{"*", "z", "example"},
+		{"\xc8", "z", "example"},
+	}
+
+	for i := range ordered {
+		require.Equal(t, 0, ordered[i].Compare(ordered[i]))
+		for j := i + 1; j < len(ordered); j++ {
+			require.Equal(t, -1, ordered[i].Compare(ordered[j]), "%s < %s", ordered[i], ordered[j])
+			require.Equal(t, 1, ordered[j].Compare(ordered[i]), "%s > %s", ordered[j], ordered[i])
+		}
+	}
+}
+
+func TestName_IsSubdomainOf(t *testing.T) {
+	name := Name{"www", "Example", "com"}
+
+	require.True(t, name.IsSubdomainOf(Name{"example", "COM"}))
+	require.True(t, name.IsSubdomainOf(name))
+	require.True(t, name.IsSubdomainOf(Name{}))
+	require.False(t, name.IsSubdomainOf(Name{"ample", "com"}))
+	require.False(t, Name{"com"}.IsSubdomainOf(Name{"example", "com"}))
+}
+
+func TestName_Parents(t *testing.T) {
+	name := Name{"www", "example", "com"}
+
+	parent, ok := name.Parent()
+	require.True(t, ok)
+	require.Equal(t, Name{"example", "com"}, parent)
+
+	_, ok = Name{}.Parent()
+	require.False(t, ok)
+
+	require.Equal(t, []Name{{"example", "com"}, {"com"}, {}}, name.Parents())
+	require.Empty(t, Name{}.Parents())
+}
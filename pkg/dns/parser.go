@@ -0,0 +1,232 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// ErrSectionDone is returned by Parser when the section asked for has no more
+// entries.
+var ErrSectionDone = errors.New("no more entries in section")
+
+// Message sections, in the order they appear on the wire.
+const (
+	sectionQuestion = iota
+	sectionAnswer
+	sectionAuthority
+	sectionAdditional
+	sectionEnd
+)
+
+var sectionNames = [...]string{"question", "answer", "authority", "additional"}
+
+// Parser decodes a message lazily, one entry at a time. Entries that are not
+// needed can be skipped without being decoded, e.g. to route a query on its
+// first question:
+//
+//	var p Parser
+//	header, err := p.Start(msg)
+//	...
+//	question, err := p.Question()
+//
+// Asking for an entry of a later section skips what is left of the earlier
+// ones; asking for one of an earlier section returns ErrSectionDone. Unlike
+// Parse, the OPT record is returned by Additional like any other record.
+type Parser struct {
+	msg     RawMessage
+	header  Header
+	section int
+	index   int
+	offset  int
+}
+
+// Start resets the parser to the beginning of msg and returns its header.
+func (p *Parser) Start(msg []byte) (Header, error) {
+	*p = Parser{msg: msg, section: sectionEnd}
+
+	header, err := p.msg.ParseHeader()
+	if err != nil {
+		return Header{}, err
+	}
+
+	p.header = header
+	p.section = sectionQuestion
+	p.offset = headerLength
+	return header, nil
+}
+
+// Question decodes the next question.
+func (p *Parser) Question() (Question, error) {
+	if err := p.seek(sectionQuestion); err != nil {
+		return Question{}, err
+	}
+
+	question, end, err := (&decoder{msg: p.msg}).readQuestion(p.offset)
+	if err != nil {
+		return Question{}, p.fail(err)
+	}
+
+	p.next(end)
+	return question, nil
+}
+
+// Answer decodes the next record of the answer section.
+func (p *Parser) Answer() (Answer, error) {
+	return p.record(sectionAnswer)
+}
+
+// Authority decodes the next record of the authority section.
+func (p *Parser) Authority() (Answer, error) {
+	return p.record(sectionAuthority)
+}
+
+// Additional decodes the next record of the additional section.
+func (p *Parser) Additional() (Answer, error) {
+	return p.record(sectionAdditional)
+}
+
+// SkipQuestions skips the remaining questions.
+func (p *Parser) SkipQuestions() error {
+	return p.skipSection(sectionQuestion)
+}
+
+// SkipAnswers skips the remaining records of the answer section.
+func (p *Parser) SkipAnswers() error {
+	return p.skipSection(sectionAnswer)
+}
+
+// SkipAuthority skips the remaining records of the authority section.
+func (p *Parser) SkipAuthority() error {
+	return p.skipSection(sectionAuthority)
+}
+
+// SkipAdditional skips the remaining records of the additional section.
+func (p *Parser) SkipAdditional() error {
+	return p.skipSection(sectionAdditional)
+}
+
+func (p *Parser) record(section int) (Answer, error) {
+	if err := p.seek(section); err != nil {
+		return Answer{}, err
+	}
+
+	answer, end, err := (&decoder{msg: p.msg}).readAnswer(p.offset)
+	if err != nil {
+		return Answer{}, p.fail(err)
+	}
+
+	p.next(end)
+	return answer, nil
+}
+
+// seek skips entries up to the first remaining one of section.
+func (p *Parser) seek(section int) error {
+	for p.section < section {
+		if err := p.skip(); err != nil {
+			return err
+		}
+	}
+	if p.section > section || p.index >= p.count() {
+		return ErrSectionDone
+	}
+
+	return nil
+}
+
+// skipSection skips the remaining entries of section and of any earlier one.
+func (p *Parser) skipSection(section int) error {
+	for p.section <= section {
+		if err := p.skip(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// skip moves past the next entry, or to the next section if the current one
+// has no entries left, checking only that the entry fits in the message.
+func (p *Parser) skip() error {
+	if p.index >= p.count() {
+		p.section++
+		p.index = 0
+		return nil
+	}
+
+	end, err := p.msg.skipName(p.offset)
+	if err != nil {
+		return p.fail(err)
+	}
+	end += 4
+	if p.section != sectionQuestion {
+		if end+6 > len(p.msg) {
+			return p.fail(errorAt(len(p.msg), ErrTruncatedMessage))
+		}
+		end += 6 + int(binary.BigEndian.Uint16(p.msg[end+4:end+6]))
+	}
+	if end > len(p.msg) {
+		return p.fail(errorAt(len(p.msg), ErrTruncatedMessage))
+	}
+
+	p.next(end)
+	return nil
+}
+
+// next moves past an entry ending at end, and past its section if that was
+// the last entry.
+func (p *Parser) next(end int) {
+	p.offset = end
+	p.index++
+	if p.index >= p.count() {
+		p.section++
+		p.index = 0
+	}
+}
+
+// count returns the number of entries of the current section.
+func (p *Parser) count() int {
+	switch p.section {
+	case sectionQuestion:
+		return int(p.header.QDCOUNT)
+	case sectionAnswer:
+		return int(p.header.ANCOUNT)
+	case sectionAuthority:
+		return int(p.header.NSCOUNT)
+	case sectionAdditional:
+		return int(p.header.ARCOUNT)
+	default:
+		return 0
+	}
+}
+
+// fail stops the parser on an error found in the current entry.
+func (p *Parser) fail(err error) error {
+	err = inSection(err, sectionNames[p.section], p.index)
+	p.section = sectionEnd
+	return err
+}
+
+// skipName returns the offset just past the name at offset, without following
+// compression pointers.
+func (rm RawMessage) skipName(offset int) (int, error) {
+	for {
+		if offset >= len(rm) {
+			return 0, errorAt(offset, ErrTruncatedMessage)
+		}
+
+		labelLength := int(rm[offset])
+		switch {
+		case labelLength == 0:
+			return offset + 1, nil
+		case labelLength&0xC0 == 0xC0:
+			if offset+1 >= len(rm) {
+				return 0, errorAt(offset, ErrTruncatedMessage)
+			}
+			return offset + 2, nil
+		case labelLength > maxLabelLength:
+			return 0, errorAt(offset, ErrLabelTooLong)
+		default:
+			offset += 1 + labelLength
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package dns
+
+import (
+	"errors"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestParser(t *testing.T) {
+	m := benchmarkMessage()
+	m.Authority = Answers{NewRecord(Name{"example", "com"}, ClassIN, 60, NS{Host: Name{"ns", "example", "com"}})}
+	msg := m.Serialize()
+
+	var p Parser
+	header, err := p.Start(msg)
+	require.NoError(t, err)
+	require.Equal(t, uint16(1234), header.ID)
+	require.Equal(t, uint16(3), header.ANCOUNT)
+
+	question, err := p.Question()
+	require.NoError(t, err)
+	require.Equal(t, m.Questions[0], question)
+	_, err = p.Question()
+	require.ErrorIs(t, err, ErrSectionDone)
+
+	answer, err := p.Answer()
+	require.NoError(t, err)
+	require.Equal(t, m.Answers[0], answer)
+
+	// Authority skips the rest of the answer section.
+	authority, err := p.Authority()
+	require.NoError(t, err)
+	require.Equal(t, m.Authority[0], authority)
+	_, err = p.Answer()
+	require.ErrorIs(t, err, ErrSectionDone)
+
+	// The OPT record is not turned into EDNS.
+	opt, err := p.Additional()
+	require.NoError(t, err)
+	require.Equal(t, TypeOPT, opt.TYPE)
+	_, err = p.Additional()
+	require.ErrorIs(t, err, ErrSectionDone)
+}
+
+func TestParser_Skip(t *testing.T) {
+	m := benchmarkMessage()
+	msg := m.Serialize()
+
+	var p Parser
+	_, err := p.Start(msg)
+	require.NoError(t, err)
+
+	require.NoError(t, p.SkipQuestions())
+	require.NoError(t, p.SkipAnswers())
+	require.NoError(t, p.SkipAuthority())
+	opt, err := p.Additional()
+	require.NoError(t, err)
+	require.Equal(t, TypeOPT, opt.TYPE)
+
+	_, err = p.Start(msg)
+	require.NoError(t, err)
+	require.NoError(t, p.SkipAdditional())
+	_, err = p.Question()
+	require.ErrorIs(t, err, ErrSectionDone)
+}
+
+func TestParser_Errors(t *testing.T) {
+	m := benchmarkMessage()
+	msg := m.Serialize()
+
+	var p Parser
+	_, err := p.Start(msg[:5])
+	require.ErrorIs(t, err, ErrTruncatedMessage)
+
+	// Cut the message in the middle of the second answer.
+	_, err = p.Start(msg[:70])
+	require.NoError(t, err)
+	err = p.SkipAnswers()
+	var parseErr *ParseError
+	require.ErrorAs(t, err, &parseErr)
+	require.Equal(t, "answer", parseErr.Section)
+	require.Equal(t, 1, parseErr.Index)
+	require.ErrorIs(t, err, ErrTruncatedMessage)
+
+	_, err = p.Additional()
+	require.ErrorIs(t, err, ErrSectionDone, "the parser should stop after an error")
+}
+
+func TestParser_ZeroCounts(t *testing.T) {
+	var p Parser
+	_, err := p.Question()
+	require.ErrorIs(t, err, ErrSectionDone)
+
+	m := Message{Header: Header{ID: 1}}
+	_, err = p.Start(m.Serialize())
+	require.NoError(t, err)
+	_, err = p.Question()
+	require.ErrorIs(t, err, ErrSectionDone)
+	_, err = p.Additional()
+	require.ErrorIs(t, err, ErrSectionDone)
+}
+
+func FuzzParser(f *testing.F) {
+	m := benchmarkMessage()
+	f.Add(m.Serialize())
+	f.Add(new(Message).SetReply(NewQuery("example.com", TypeA)).Serialize())
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var p Parser
+		if _, err := p.Start(data); err != nil {
+			return
+		}
+		var questions Questions
+		var records [3]Answers
+		var err error
+		for err == nil {
+			var question Question
+			if question, err = p.Question(); err == nil {
+				questions = append(questions, question)
+			}
+		}
+		for section, next := range []func() (Answer, error){p.Answer, p.Authority, p.Additional} {
+			for err = nil; err == nil; {
+				var record Answer
+				if record, err = next(); err == nil && record.TYPE != TypeOPT {
+					records[section] = append(records[section], record)
+				}
+			}
+			if !errors.Is(err, ErrSectionDone) {
+				break
+			}
+		}
+
+		// Whatever Parse accepts, the parser decodes the same way.
+		expected, parseErr := RawMessage(data).Parse()
+		if parseErr != nil {
+			return
+		}
+		require.ErrorIs(t, err, ErrSectionDone)
+		require.Equal(t, expected.Questions, questions)
+		require.Equal(t, expected.Answers, records[0])
+		require.Equal(t, expected.Authority, records[1])
+		require.Equal(t, expected.Additional, records[2])
+	})
+}
+
+func BenchmarkParser_Question(b *testing.B) {
+	m := benchmarkMessage()
+	msg := m.Serialize()
+
+	var p Parser
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := p.Start(msg); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := p.Question(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/netip"
+	"sync"
+)
+
+// socketPool is a set of long-lived UDP sockets shared by all the queries of
+// a forwarder, a few per upstream, each bound to its own random port by the
+// system. The sockets are connected, so that an upstream that cannot be
+// reached is reported at once by an ICMP error rather than by a timeout.
+// Responses are dispatched to the waiting queries by an in-flight table per
+// socket.
+type socketPool struct {
+	sockets map[*upstream][]*pooledSocket
+}
+
+// pooledSocket is one of the sockets of a socketPool, connected to upstream u.
+type pooledSocket struct {
+	u    *upstream
+	conn *net.UDPConn
+
+	mu       sync.Mutex
+	inflight map[uint16]chan udpResult
+}
+
+// udpResult is what a socket dispatches to a query waiting on it: a datagram
+// with the ID of the query, or an error reading from the socket.
+type udpResult struct {
+	response []byte
+	err      error
+}
+
+// newSocketPool opens size sockets to each of upstreams and starts reading
+// from them.
+func newSocketPool(size int, upstreams []*upstream) (*socketPool, error) {
+	p := &socketPool{sockets: make(map[*upstream][]*pooledSocket, len(upstreams))}
+	for _, u := range upstreams {
+		for i := 0; i < size; i++ {
+			conn, err := net.DialUDP("udp", nil, u.addr)
+			if err != nil {
+				p.close()
+				return nil, fmt.Errorf("error dialing UDP: %w", err)
+			}
+			s := &pooledSocket{u: u, conn: conn, inflight: make(map[uint16]chan udpResult)}
+			p.sockets[u] = append(p.sockets[u], s)
+			go s.read()
+		}
+	}
+
+	return p, nil
+}
+
+// close closes the sockets of the pool.
+func (p *socketPool) close() {
+	for _, sockets := range p.sockets {
+		for _, s := range sockets {
+			s.conn.Close()
+		}
+	}
+}
+
+// pick returns a random socket of the pool to upstream u, so that the source
+// port of successive queries cannot be predicted.
+func (p *socketPool) pick(u *upstream) *pooledSocket {
+	sockets := p.sockets[u]
+	return sockets[rand.Intn(len(sockets))]
+}
+
+// register reserves a random ID not outstanding on s, and returns it with the
+// channel the datagrams with that ID are dispatched to.
+func (s *pooledSocket) register() (uint16, <-chan udpResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		id := randomID()
+		if _, ok := s.inflight[id]; ok {
+			continue
+		}
+		results := make(chan udpResult, 4)
+		s.inflight[id] = results
+		return id, results
+	}
+}
+
+// unregister releases the ID reserved by register.
+func (s *pooledSocket) unregister(id uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.inflight, id)
+}
+
+// read dispatches the datagrams received on s until it is closed. Datagrams
+// that answer no outstanding query are counted as mismatches, and errors,
+// e.g. the upstream refusing the previous datagram, fail every outstanding
+// query.
+func (s *pooledSocket) read() {
+	buffer := make([]byte, upstreamUDPSize)
+	for {
+		length, source, err := s.conn.ReadFromUDPAddrPort(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			s.fail(err)
+			continue
+		}
+		if unmap(source) != addrPort(s.u.addr) || !s.dispatch(buffer[:length]) {
+			s.u.mismatches.Add(1)
+		}
+	}
+}
+
+// dispatch hands a copy of datagram to the query waiting for it, and reports
+// whether there is one with room for it.
+func (s *pooledSocket) dispatch(datagram []byte) bool {
+	header, err := RawMessage(datagram).ParseHeader()
+	if err != nil {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	results, ok := s.inflight[header.ID]
+	if !ok {
+		return false
+	}
+	select {
+	case results <- udpResult{response: append([]byte(nil), datagram...)}:
+		return true
+	default:
+		return false
+	}
+}
+
+// fail hands err to every query waiting on s.
+func (s *pooledSocket) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, results := range s.inflight {
+		select {
+		case results <- udpResult{err: err}:
+		default:
+		}
+	}
+}
+
+// exchange sends query from s under an ID reserved for it and returns the
+// first datagram dispatched back that answers it before ctx is done, together
+// with the query as sent. Other datagrams are counted as mismatches and
+// dropped.
+func (s *pooledSocket) exchange(ctx context.Context, query Message) ([]byte, Message, error) {
+	id, results := s.register()
+	defer s.unregister(id)
+
+	query.Header.ID = id
+	_, err := s.conn.Write(query.Serialize())
+	if err != nil {
+		return nil, query, fmt.Errorf("error sending DNS request: %w", err)
+	}
+
+	for {
+		select {
+		case result := <-results:
+			if result.err != nil {
+				return nil, query, fmt.Errorf("error reading UDP response: %w", result.err)
+			}
+			if answers(result.response, query) {
+				return result.response, query, nil
+			}
+			s.u.mismatches.Add(1)
+		case <-ctx.Done():
+			return nil, query, fmt.Errorf("error reading UDP response: %w", ctx.Err())
+		}
+	}
+}
+
+// addrPort returns addr as a netip.AddrPort, IPv4 addresses unmapped.
+func addrPort(addr *net.UDPAddr) netip.AddrPort {
+	return unmap(addr.AddrPort())
+}
+
+func unmap(addr netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+}
@@ -0,0 +1,97 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPooledSocket_register(t *testing.T) {
+	u := testUpstreams(1)[0]
+	pool, err := newSocketPool(1, []*upstream{u})
+	require.NoError(t, err)
+	defer pool.close()
+
+	s := pool.pick(u)
+	ids := make(map[uint16]bool)
+	for i := 0; i < 1000; i++ {
+		id, _ := s.register()
+		require.False(t, ids[id], "An ID should not be reserved twice")
+		ids[id] = true
+	}
+	require.Len(t, s.inflight, 1000)
+
+	for id := range ids {
+		s.unregister(id)
+	}
+	require.Empty(t, s.inflight)
+}
+
+func TestPooledSocket_dispatch(t *testing.T) {
+	u := testUpstreams(1)[0]
+	pool, err := newSocketPool(1, []*upstream{u})
+	require.NoError(t, err)
+	defer pool.close()
+
+	s := pool.pick(u)
+	id, results := s.register()
+
+	response := Message{Header: Header{ID: id, Flags: HeaderFlags{QR: 1}}}
+	require.True(t, s.dispatch(response.Serialize()))
+	require.Equal(t, udpResult{response: response.Serialize()}, <-results)
+
+	response.Header.ID++
+	require.False(t, s.dispatch(response.Serialize()), "A response with another ID should not be dispatched")
+
+	s.fail(errors.New("connection refused"))
+	require.Error(t, (<-results).err, "An error should be handed to the waiting queries")
+}
+
+func TestForwarder_ForwardSharesSockets(t *testing.T) {
+	ports := make(chan int, 20)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			size, source, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			query, err := RawMessage(buf[:size]).Parse()
+			if err != nil {
+				continue
+			}
+			ports <- source.Port
+			conn.WriteToUDP(new(Message).SetReply(&query).Serialize(), source)
+		}
+	}()
+
+	forwarder, err := NewForwarder([]string{conn.LocalAddr().String()}, WithSocketPool(2), WithCookies(false))
+	require.NoError(t, err)
+	defer forwarder.Close()
+
+	for i := 0; i < 20; i++ {
+		_, err := forwarder.Forward(context.Background(), Message{
+			Header:    Header{ID: 1234, Flags: HeaderFlags{RD: 1}},
+			Questions: Questions{NewQuestion("example.com", TypeA, ClassIN)},
+		})
+		require.NoError(t, err)
+	}
+
+	seen := make(map[int]bool)
+	for i := 0; i < 20; i++ {
+		seen[<-ports] = true
+	}
+	require.LessOrEqual(t, len(seen), 2, "Queries should be sent from the sockets of the pool")
+}
+
+func TestNewForwarder_RejectsEmptySocketPool(t *testing.T) {
+	_, err := NewForwarder([]string{"127.0.0.1:53"}, WithSocketPool(0))
+	require.Error(t, err)
+}
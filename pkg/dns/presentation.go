@@ -0,0 +1,414 @@
+package dns
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// String returns the question as dig shows it, e.g. "example.com.	IN	A".
+func (q Question) String() string {
+	return fmt.Sprintf("%s\t%s\t%s", q.NAME, q.CLASS, q.TYPE)
+}
+
+func (q Question) MarshalText() ([]byte, error) {
+	return []byte(q.String()), nil
+}
+
+// String returns the record in presentation format, with tabs between the
+// fields as dig writes them: "example.com.	60	IN	A	192.0.2.1".
+func (a Answer) String() string {
+	return fmt.Sprintf("%s\t%d\t%s\t%s\t%s", a.NAME, a.TTL, a.CLASS, a.TYPE, a.data())
+}
+
+func (a Answer) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// UnmarshalText parses a record written by MarshalText, or any other record
+// accepted by ParseRecord.
+func (a *Answer) UnmarshalText(text []byte) error {
+	record, err := ParseRecord(string(text))
+	if err != nil {
+		return err
+	}
+
+	*a = record
+	return nil
+}
+
+// data returns Data, or RDATA decoded when only the raw form is set.
+func (a Answer) data() RData {
+	if a.Data != nil {
+		return a.Data
+	}
+
+	data, err := (&decoder{msg: a.RDATA}).readRData(a.TYPE, 0, len(a.RDATA), a.RDATA)
+	if err != nil {
+		return RawRData{RRType: a.TYPE, Data: a.RDATA}
+	}
+	return data
+}
+
+// String returns the message laid out like the output of dig: the header,
+// the OPT pseudo-section and every non-empty section. Counts are those
+// Serialize would write.
+func (m *Message) String() string {
+	flags := m.Header.Flags
+	var flagNames string
+	for _, flag := range []struct {
+		name string
+		set  uint16
+	}{{"qr", flags.QR}, {"aa", flags.AA}, {"tc", flags.TC}, {"rd", flags.RD}, {"ra", flags.RA}, {"ad", flags.AD}, {"cd", flags.CD}} {
+		if flag.set != 0 {
+			flagNames += " " + flag.name
+		}
+	}
+	additional := m.Additional.Count()
+	if m.EDNS != nil {
+		additional++
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, ";; ->>HEADER<<- opcode: %s, status: %s, id: %d\n", flags.OPCODE, m.Rcode(), m.Header.ID)
+	fmt.Fprintf(&b, ";; flags:%s; QUERY: %d, ANSWER: %d, AUTHORITY: %d, ADDITIONAL: %d\n",
+		flagNames, m.Questions.Count(), m.Answers.Count(), m.Authority.Count(), additional)
+
+	if m.EDNS != nil {
+		fmt.Fprintf(&b, "\n;; OPT PSEUDOSECTION:\n%s\n", m.EDNS)
+	}
+	if len(m.Questions) > 0 {
+		b.WriteString("\n;; QUESTION SECTION:\n")
+		for _, question := range m.Questions {
+			fmt.Fprintf(&b, ";%s\n", question)
+		}
+	}
+	for _, section := range []struct {
+		name    string
+		answers Answers
+	}{{"ANSWER", m.Answers}, {"AUTHORITY", m.Authority}, {"ADDITIONAL", m.Additional}} {
+		if len(section.answers) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "\n;; %s SECTION:\n", section.name)
+		for _, answer := range section.answers {
+			fmt.Fprintf(&b, "%s\n", answer)
+		}
+	}
+
+	return b.String()
+}
+
+func (m *Message) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// ParseRecord parses one resource record in the presentation format of
+// RFC 1035, section 5.1, such as
+//
+//	example.com. 60 IN A 192.0.2.1
+//
+// The TTL and class are optional and may come in either order; they default to
+// 0 and IN. As there is no $ORIGIN, every name is taken as fully qualified,
+// with or without its trailing dot. The RDATA of any type may also be given in
+// the generic form of RFC 3597, section 5 ("\# 4 c0000201").
+func ParseRecord(s string) (Answer, error) {
+	tokens, err := tokenize(s)
+	if err != nil {
+		return Answer{}, err
+	}
+	if len(tokens) < 2 {
+		return Answer{}, fmt.Errorf("%w: missing type", ErrInvalidRecord)
+	}
+
+	name, err := parseName(tokens[0].text)
+	if err != nil {
+		return Answer{}, err
+	}
+
+	var ttl uint32
+	class := ClassIN
+	var ttlSet, classSet bool
+	i := 1
+	for ; i < len(tokens); i++ {
+		if !ttlSet {
+			if n, err := strconv.ParseUint(tokens[i].text, 10, 32); err == nil {
+				ttl, ttlSet = uint32(n), true
+				continue
+			}
+		}
+		if !classSet {
+			if c, err := ParseClass(tokens[i].text); err == nil {
+				class, classSet = c, true
+				continue
+			}
+		}
+		break
+	}
+	if i == len(tokens) {
+		return Answer{}, fmt.Errorf("%w: missing type", ErrInvalidRecord)
+	}
+
+	rrType, err := ParseType(tokens[i].text)
+	if err != nil {
+		return Answer{}, fmt.Errorf("%w: unknown type %q", ErrInvalidRecord, tokens[i].text)
+	}
+
+	data, err := parseRData(rrType, tokens[i+1:])
+	if err != nil {
+		return Answer{}, err
+	}
+
+	return NewRecord(name, class, ttl, data), nil
+}
+
+// token is one field of a presentation format line. Escapes are left in text.
+type token struct {
+	text   string
+	quoted bool
+}
+
+// tokenize splits a line into fields, honouring quoted strings and escapes.
+// Comments are dropped, and so are parentheses, as a single line has no need
+// for them.
+func tokenize(s string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '(' || c == ')':
+			i++
+		case c == ';':
+			return tokens, nil
+		case c == '"':
+			start := i + 1
+			for i = start; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(s) {
+				return nil, fmt.Errorf("%w: unterminated quoted string", ErrInvalidRecord)
+			}
+			tokens = append(tokens, token{text: s[start:i], quoted: true})
+			i++
+		default:
+			start := i
+			for ; i < len(s) && !strings.ContainsRune(" \t\r\n();\"", rune(s[i])); i++ {
+				if s[i] == '\\' {
+					i++
+				}
+			}
+			if i > len(s) {
+				i = len(s)
+			}
+			tokens = append(tokens, token{text: s[start:i]})
+		}
+	}
+
+	return tokens, nil
+}
+
+// parseName parses a name of a record, reporting errors as ErrInvalidRecord.
+func parseName(s string) (Name, error) {
+	name, err := ParseName(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRecord, err)
+	}
+
+	return name, nil
+}
+
+// parseRData parses the RDATA fields of a record of type rrType.
+func parseRData(rrType Type, tokens []token) (RData, error) {
+	if len(tokens) > 0 && tokens[0].text == `\#` && !tokens[0].quoted {
+		return parseGenericRData(rrType, tokens[1:])
+	}
+
+	fields := map[Type]int{
+		TypeA: 1, TypeNS: 1, TypeCNAME: 1, TypeSOA: 7, TypePTR: 1, TypeMX: 2, TypeAAAA: 1, TypeSRV: 4,
+	}
+	if count, ok := fields[rrType]; ok && len(tokens) != count {
+		return nil, fmt.Errorf("%w: %s RDATA needs %d fields, got %d", ErrInvalidRecord, rrType, count, len(tokens))
+	}
+
+	switch rrType {
+	case TypeA:
+		ip := net.ParseIP(tokens[0].text).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("%w: invalid IPv4 address %q", ErrInvalidRecord, tokens[0].text)
+		}
+		return A{A: ip}, nil
+	case TypeAAAA:
+		ip := net.ParseIP(tokens[0].text)
+		if ip == nil || !strings.Contains(tokens[0].text, ":") {
+			return nil, fmt.Errorf("%w: invalid IPv6 address %q", ErrInvalidRecord, tokens[0].text)
+		}
+		return AAAA{AAAA: ip}, nil
+	case TypeNS, TypeCNAME, TypePTR:
+		name, err := parseName(tokens[0].text)
+		if err != nil {
+			return nil, err
+		}
+		switch rrType {
+		case TypeNS:
+			return NS{Host: name}, nil
+		case TypeCNAME:
+			return CNAME{Target: name}, nil
+		default:
+			return PTR{Target: name}, nil
+		}
+	case TypeSOA:
+		mName, err := parseName(tokens[0].text)
+		if err != nil {
+			return nil, err
+		}
+		rName, err := parseName(tokens[1].text)
+		if err != nil {
+			return nil, err
+		}
+		var values [5]uint32
+		for i := range values {
+			n, err := strconv.ParseUint(tokens[2+i].text, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("%w: invalid SOA field %q", ErrInvalidRecord, tokens[2+i].text)
+			}
+			values[i] = uint32(n)
+		}
+		return SOA{
+			MName:   mName,
+			RName:   rName,
+			Serial:  values[0],
+			Refresh: values[1],
+			Retry:   values[2],
+			Expire:  values[3],
+			Minimum: values[4],
+		}, nil
+	case TypeMX:
+		preference, err := strconv.ParseUint(tokens[0].text, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid MX preference %q", ErrInvalidRecord, tokens[0].text)
+		}
+		exchange, err := parseName(tokens[1].text)
+		if err != nil {
+			return nil, err
+		}
+		return MX{Preference: uint16(preference), Exchange: exchange}, nil
+	case TypeTXT:
+		if len(tokens) == 0 {
+			return nil, fmt.Errorf("%w: TXT RDATA needs at least one string", ErrInvalidRecord)
+		}
+		text := make([]string, len(tokens))
+		for i, t := range tokens {
+			s, err := unescapeCharacterString(t.text)
+			if err != nil {
+				return nil, err
+			}
+			text[i] = s
+		}
+		return TXT{Text: text}, nil
+	case TypeSRV:
+		var values [3]uint16
+		for i := range values {
+			n, err := strconv.ParseUint(tokens[i].text, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("%w: invalid SRV field %q", ErrInvalidRecord, tokens[i].text)
+			}
+			values[i] = uint16(n)
+		}
+		target, err := parseName(tokens[3].text)
+		if err != nil {
+			return nil, err
+		}
+		return SRV{Priority: values[0], Weight: values[1], Port: values[2], Target: target}, nil
+	default:
+		return nil, fmt.Errorf(`%w: %s RDATA must use the \# form`, ErrInvalidRecord, rrType)
+	}
+}
+
+// parseGenericRData parses the fields following "\#": the RDATA length and the
+// RDATA in hexadecimal, possibly split into several fields. The RDATA of
+// well-known types is decoded as if it came from the wire.
+func parseGenericRData(rrType Type, tokens []token) (RData, error) {
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf(`%w: missing \# RDATA length`, ErrInvalidRecord)
+	}
+	length, err := strconv.ParseUint(tokens[0].text, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf(`%w: invalid \# RDATA length %q`, ErrInvalidRecord, tokens[0].text)
+	}
+
+	var encoded strings.Builder
+	for _, t := range tokens[1:] {
+		encoded.WriteString(t.text)
+	}
+	rdata, err := hex.DecodeString(encoded.String())
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid hexadecimal RDATA", ErrInvalidRecord)
+	}
+	if len(rdata) != int(length) {
+		return nil, fmt.Errorf(`%w: \# RDATA length %d does not match %d octets`, ErrInvalidRecord, length, len(rdata))
+	}
+
+	data, err := (&decoder{msg: rdata}).readRData(rrType, 0, len(rdata), rdata)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRecord, err)
+	}
+	return data, nil
+}
+
+// quoteCharacterString returns s as a quoted character-string, escaping
+// quotes, backslashes and non-printable octets.
+func quoteCharacterString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&b, "\\%03d", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+
+	return b.String()
+}
+
+// unescapeCharacterString resolves the "\X" and "\DDD" escapes of a
+// character-string (RFC 1035, section 5.1).
+func unescapeCharacterString(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+1 >= len(s) {
+			return "", fmt.Errorf("%w: dangling escape in %q", ErrInvalidRecord, s)
+		}
+		if !isDigit(s[i+1]) {
+			b.WriteByte(s[i+1])
+			i++
+			continue
+		}
+		if i+4 > len(s) {
+			return "", fmt.Errorf("%w: short decimal escape in %q", ErrInvalidRecord, s)
+		}
+		n, err := strconv.ParseUint(s[i+1:i+4], 10, 8)
+		if err != nil {
+			return "", fmt.Errorf("%w: invalid decimal escape in %q", ErrInvalidRecord, s)
+		}
+		b.WriteByte(byte(n))
+		i += 3
+	}
+	if b.Len() > 255 {
+		return "", fmt.Errorf("%w: character-string longer than 255 octets", ErrInvalidRecord)
+	}
+
+	return b.String(), nil
+}
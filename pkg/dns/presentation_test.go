@@ -0,0 +1,145 @@
+package dns
+
+import (
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+)
+
+func TestAnswer_String(t *testing.T) {
+	name := Name{"example", "com"}
+	tests := []struct {
+		answer   Answer
+		expected string
+	}{
+		{NewRecord(name, ClassIN, 60, A{A: net.IPv4(192, 0, 2, 1)}), "example.com.\t60\tIN\tA\t192.0.2.1"},
+		{NewRecord(name, ClassIN, 60, AAAA{AAAA: net.ParseIP("2001:db8::1")}), "example.com.\t60\tIN\tAAAA\t2001:db8::1"},
+		{NewRecord(name, ClassIN, 60, NS{Host: Name{"ns1", "example", "com"}}), "example.com.\t60\tIN\tNS\tns1.example.com."},
+		{NewRecord(name, ClassIN, 60, MX{Preference: 10, Exchange: Name{"mail", "example", "com"}}), "example.com.\t60\tIN\tMX\t10 mail.example.com."},
+		{NewRecord(name, ClassIN, 60, TXT{Text: []string{`say "hi"`, "tab\there"}}), "example.com.\t60\tIN\tTXT\t\"say \\\"hi\\\"\" \"tab\\009here\""},
+		{NewRecord(name, ClassIN, 60, SRV{Priority: 1, Weight: 2, Port: 443, Target: Name{}}), "example.com.\t60\tIN\tSRV\t1 2 443 ."},
+		{NewRecord(name, ClassCH, 0, RawRData{RRType: 65280, Data: []byte{0xde, 0xad}}), "example.com.\t0\tCH\tTYPE65280\t\\# 2 dead"},
+		{NewAnswer(name, TypeA, ClassIN, 60, 4, []byte{192, 0, 2, 1}), "example.com.\t60\tIN\tA\t192.0.2.1"},
+	}
+
+	for _, test := range tests {
+		require.Equal(t, test.expected, test.answer.String())
+	}
+}
+
+func TestParseRecord(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected Answer
+	}{
+		{"example.com. 60 IN A 192.0.2.1", NewRecord(Name{"example", "com"}, ClassIN, 60, A{A: net.IPv4(192, 0, 2, 1).To4()})},
+		{"example.com IN 60 AAAA 2001:db8::1", NewRecord(Name{"example", "com"}, ClassIN, 60, AAAA{AAAA: net.ParseIP("2001:db8::1")})},
+		{"example.com. CNAME www.example.com. ; comment", NewRecord(Name{"example", "com"}, ClassIN, 0, CNAME{Target: Name{"www", "example", "com"}})},
+		{"example.com. 3600 IN SOA ns1.example.com. admin.example.com. ( 1 7200 3600 1209600 300 )", NewRecord(Name{"example", "com"}, ClassIN, 3600, SOA{
+			MName: Name{"ns1", "example", "com"}, RName: Name{"admin", "example", "com"},
+			Serial: 1, Refresh: 7200, Retry: 3600, Expire: 1209600, Minimum: 300,
+		})},
+		{`example.com. 60 IN TXT "v=spf1 -all" plain "\065\"\\"`, NewRecord(Name{"example", "com"}, ClassIN, 60, TXT{Text: []string{"v=spf1 -all", "plain", `A"\`}})},
+		{`example.com. 60 IN A \# 4 c0000201`, NewRecord(Name{"example", "com"}, ClassIN, 60, A{A: net.IPv4(192, 0, 2, 1).To4()})},
+		{`. 0 CLASS3 TYPE65280 \# 3 01 0203`, NewRecord(Name{}, ClassCH, 0, RawRData{RRType: 65280, Data: []byte{1, 2, 3}})},
+	}
+
+	for _, test := range tests {
+		actual, err := ParseRecord(test.line)
+		require.NoError(t, err, test.line)
+		require.Equal(t, test.expected, actual, test.line)
+	}
+}
+
+func TestParseRecord_RoundTrip(t *testing.T) {
+	records := []Answer{
+		NewRecord(Name{"example", "com"}, ClassIN, 60, MX{Preference: 10, Exchange: Name{"mail", "example", "com"}}),
+		NewRecord(Name{"_https", "_tcp", "example", "com"}, ClassIN, 60, SRV{Priority: 1, Weight: 2, Port: 443, Target: Name{"example", "com"}}),
+		NewRecord(Name{"example", "com"}, ClassIN, 60, TXT{Text: []string{"a \"quoted\" \\ string\x00"}}),
+		NewRecord(Name{"1", "2", "0", "192", "in-addr", "arpa"}, ClassIN, 60, PTR{Target: Name{"example", "com"}}),
+	}
+
+	for _, record := range records {
+		text, err := record.MarshalText()
+		require.NoError(t, err)
+
+		var actual Answer
+		require.NoError(t, actual.UnmarshalText(text), string(text))
+		require.Equal(t, record, actual)
+	}
+}
+
+func FuzzParseRecord(f *testing.F) {
+	for _, seed := range []string{
+		"example.com. 60 IN A 192.0.2.1",
+		"example.com. 3600 IN SOA ns1.example.com. admin.example.com. ( 1 7200 3600 1209600 300 )",
+		`example.com. 60 IN TXT "v=spf1 -all" plain "\065\"\\"`,
+		`. 0 CLASS3 TYPE65280 \# 3 01 0203`,
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, line string) {
+		record, err := ParseRecord(line)
+		if err != nil {
+			return
+		}
+
+		again, err := ParseRecord(record.String())
+		require.NoError(t, err, "A formatted record should parse again")
+		require.Equal(t, record, again)
+	})
+}
+
+func TestParseRecord_Errors(t *testing.T) {
+	lines := []string{
+		"",
+		"example.com.",
+		"example.com. 60 IN",
+		"example.com. 60 IN BOGUS x",
+		"example.com. 60 IN A 2001:db8::1",
+		"example.com. 60 IN AAAA 192.0.2.1",
+		"example.com. 60 IN MX mail.example.com.",
+		"example.com. 60 IN TXT \"unterminated",
+		"example..com. 60 IN A 192.0.2.1",
+		"example.com. 60 IN HINFO cpu os",
+		`example.com. 60 IN A \# 3 c00002`,
+		`example.com. 60 IN A \# 3 c0000201`,
+	}
+
+	for _, line := range lines {
+		_, err := ParseRecord(line)
+		require.ErrorIs(t, err, ErrInvalidRecord, line)
+	}
+}
+
+func TestMessage_String(t *testing.T) {
+	m := Message{
+		Header:    Header{ID: 1234, Flags: HeaderFlags{QR: 1, RD: 1, RA: 1, RCODE: 0}},
+		Questions: Questions{NewQuestion("example.com", TypeA, ClassIN)},
+		Answers:   Answers{NewRecord(Name{"example", "com"}, ClassIN, 60, A{A: net.IPv4(192, 0, 2, 1)})},
+		EDNS: &EDNS{
+			UDPSize: 1232,
+			DO:      true,
+			Options: []EDNSOption{ExtendedError{InfoCode: ExtendedErrorStaleAnswer}},
+		},
+	}
+
+	expected := `;; ->>HEADER<<- opcode: QUERY, status: NOERROR, id: 1234
+;; flags: qr rd ra; QUERY: 1, ANSWER: 1, AUTHORITY: 0, ADDITIONAL: 1
+
+;; OPT PSEUDOSECTION:
+; EDNS: version: 0, flags: do; udp: 1232
+; EDE: 3 (Stale Answer)
+
+;; QUESTION SECTION:
+;example.com.	IN	A
+
+;; ANSWER SECTION:
+example.com.	60	IN	A	192.0.2.1
+`
+	require.Equal(t, expected, m.String())
+
+	m.EDNS.ExtendedRcode = 1
+	require.Contains(t, m.String(), "status: BADVERS")
+}
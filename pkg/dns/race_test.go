@@ -0,0 +1,7 @@
+//go:build race
+
+package dns
+
+// raceEnabled is set when the race detector is on, under which sync.Pool
+// drops items at random and allocation counts are meaningless.
+const raceEnabled = true
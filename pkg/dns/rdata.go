@@ -0,0 +1,328 @@
+package dns
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// RData is the decoded RDATA of a resource record.
+type RData interface {
+	// Type returns the TYPE of the records that carry this data.
+	Type() Type
+	// String returns the RDATA in presentation format (RFC 1035, section 5.1).
+	String() string
+
+	pack(buf []byte, ct *compressionTable) []byte
+}
+
+// A is the RDATA of an A record (RFC 1035, section 3.4.1).
+type A struct {
+	A net.IP
+}
+
+// AAAA is the RDATA of an AAAA record (RFC 3596).
+type AAAA struct {
+	AAAA net.IP
+}
+
+// NS is the RDATA of an NS record (RFC 1035, section 3.3.11).
+type NS struct {
+	Host Name
+}
+
+// CNAME is the RDATA of a CNAME record (RFC 1035, section 3.3.1).
+type CNAME struct {
+	Target Name
+}
+
+// SOA is the RDATA of an SOA record (RFC 1035, section 3.3.13).
+type SOA struct {
+	MName   Name
+	RName   Name
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	Minimum uint32
+}
+
+// PTR is the RDATA of a PTR record (RFC 1035, section 3.3.12).
+type PTR struct {
+	Target Name
+}
+
+// MX is the RDATA of an MX record (RFC 1035, section 3.3.9).
+type MX struct {
+	Preference uint16
+	Exchange   Name
+}
+
+// TXT is the RDATA of a TXT record (RFC 1035, section 3.3.14). Each element
+// of Text is one character-string.
+type TXT struct {
+	Text []string
+}
+
+// SRV is the RDATA of an SRV record (RFC 2782).
+type SRV struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   Name
+}
+
+// RawRData holds the RDATA of a type without a dedicated decoder, in the
+// generic form of RFC 3597. Names in it are already decompressed.
+type RawRData struct {
+	RRType Type
+	Data   []byte
+}
+
+func (A) Type() Type          { return TypeA }
+func (NS) Type() Type         { return TypeNS }
+func (CNAME) Type() Type      { return TypeCNAME }
+func (SOA) Type() Type        { return TypeSOA }
+func (PTR) Type() Type        { return TypePTR }
+func (MX) Type() Type         { return TypeMX }
+func (TXT) Type() Type        { return TypeTXT }
+func (AAAA) Type() Type       { return TypeAAAA }
+func (SRV) Type() Type        { return TypeSRV }
+func (r RawRData) Type() Type { return r.RRType }
+
+func (r A) String() string     { return r.A.String() }
+func (r AAAA) String() string  { return r.AAAA.String() }
+func (r NS) String() string    { return r.Host.String() }
+func (r CNAME) String() string { return r.Target.String() }
+func (r PTR) String() string   { return r.Target.String() }
+
+func (r SOA) String() string {
+	return fmt.Sprintf("%s %s %d %d %d %d %d", r.MName, r.RName, r.Serial, r.Refresh, r.Retry, r.Expire, r.Minimum)
+}
+
+func (r MX) String() string {
+	return fmt.Sprintf("%d %s", r.Preference, r.Exchange)
+}
+
+func (r TXT) String() string {
+	quoted := make([]string, len(r.Text))
+	for i, text := range r.Text {
+		quoted[i] = quoteCharacterString(text)
+	}
+	return strings.Join(quoted, " ")
+}
+
+func (r SRV) String() string {
+	return fmt.Sprintf("%d %d %d %s", r.Priority, r.Weight, r.Port, r.Target)
+}
+
+// String returns the RDATA in the generic form of RFC 3597, section 5.
+func (r RawRData) String() string {
+	if len(r.Data) == 0 {
+		return `\# 0`
+	}
+	return fmt.Sprintf(`\# %d %s`, len(r.Data), hex.EncodeToString(r.Data))
+}
+
+func (r A) pack(buf []byte, ct *compressionTable) []byte {
+	ip := r.A.To4()
+	if ip == nil {
+		ct.fail(errInvalidA)
+	}
+	return append(buf, ip...)
+}
+
+func (r AAAA) pack(buf []byte, ct *compressionTable) []byte {
+	ip := r.AAAA.To16()
+	if ip == nil {
+		ct.fail(errInvalidAAAA)
+	}
+	return append(buf, ip...)
+}
+
+func (r NS) pack(buf []byte, ct *compressionTable) []byte {
+	return r.Host.pack(buf, ct)
+}
+
+func (r CNAME) pack(buf []byte, ct *compressionTable) []byte {
+	return r.Target.pack(buf, ct)
+}
+
+func (r SOA) pack(buf []byte, ct *compressionTable) []byte {
+	buf = r.MName.pack(buf, ct)
+	buf = r.RName.pack(buf, ct)
+	buf = binary.BigEndian.AppendUint32(buf, r.Serial)
+	buf = binary.BigEndian.AppendUint32(buf, r.Refresh)
+	buf = binary.BigEndian.AppendUint32(buf, r.Retry)
+	buf = binary.BigEndian.AppendUint32(buf, r.Expire)
+	buf = binary.BigEndian.AppendUint32(buf, r.Minimum)
+
+	return buf
+}
+
+func (r PTR) pack(buf []byte, ct *compressionTable) []byte {
+	return r.Target.pack(buf, ct)
+}
+
+func (r MX) pack(buf []byte, ct *compressionTable) []byte {
+	buf = appendUint16ToSlice(buf, r.Preference)
+	return r.Exchange.pack(buf, ct)
+}
+
+// pack writes each element of Text as one or more character-strings, since a
+// character-string holds at most 255 octets.
+func (r TXT) pack(buf []byte, _ *compressionTable) []byte {
+	for _, text := range r.Text {
+		for len(text) > 255 {
+			buf = append(buf, 255)
+			buf = append(buf, text[:255]...)
+			text = text[255:]
+		}
+		buf = append(buf, byte(len(text)))
+		buf = append(buf, text...)
+	}
+
+	return buf
+}
+
+// pack never compresses the target, as RFC 2782 forbids it.
+func (r SRV) pack(buf []byte, _ *compressionTable) []byte {
+	buf = appendUint16ToSlice(buf, r.Priority)
+	buf = appendUint16ToSlice(buf, r.Weight)
+	buf = appendUint16ToSlice(buf, r.Port)
+	return r.Target.pack(buf, nil)
+}
+
+func (r RawRData) pack(buf []byte, ct *compressionTable) []byte {
+	return packRDATA(buf, ct, r.RRType, r.Data)
+}
+
+// NewRecord returns a resource record carrying data, with TYPE, RDLENGTH and
+// the raw RDATA derived from it.
+func NewRecord(name Name, class Class, ttl uint32, data RData) Answer {
+	rdata := data.pack(nil, nil)
+	return Answer{
+		NAME:    name,
+		TYPE:    data.Type(),
+		CLASS:   class,
+		TTL:     ttl,
+		RDLENGH: uint16(len(rdata)),
+		RDATA:   rdata,
+		Data:    data,
+	}
+}
+
+// readRData decodes the RDATA of a record of type rrType found between offset
+// and end. Names are read from the whole message so that compression pointers
+// can be followed. rdata is the already decompressed RDATA, which is kept for
+// types without a dedicated decoder.
+func (d *decoder) readRData(rrType Type, offset int, end int, rdata []byte) (RData, error) {
+	switch rrType {
+	case TypeA:
+		if end-offset != net.IPv4len {
+			return nil, errorAt(offset, fmt.Errorf("%w: A RDATA length %d", ErrInvalidRDATA, end-offset))
+		}
+		return A{A: net.IP(d.copyRDATA(d.msg[offset:end]))}, nil
+	case TypeAAAA:
+		if end-offset != net.IPv6len {
+			return nil, errorAt(offset, fmt.Errorf("%w: AAAA RDATA length %d", ErrInvalidRDATA, end-offset))
+		}
+		return AAAA{AAAA: net.IP(d.copyRDATA(d.msg[offset:end]))}, nil
+	case TypeNS:
+		name, err := d.readRDataName(offset, end)
+		if err != nil {
+			return nil, err
+		}
+		return NS{Host: name}, nil
+	case TypeCNAME:
+		name, err := d.readRDataName(offset, end)
+		if err != nil {
+			return nil, err
+		}
+		return CNAME{Target: name}, nil
+	case TypePTR:
+		name, err := d.readRDataName(offset, end)
+		if err != nil {
+			return nil, err
+		}
+		return PTR{Target: name}, nil
+	case TypeSOA:
+		mName, offset, err := d.readName(offset)
+		if err != nil {
+			return nil, err
+		}
+		rName, offset, err := d.readName(offset)
+		if err != nil {
+			return nil, err
+		}
+		if end-offset != 20 {
+			return nil, errorAt(offset, fmt.Errorf("%w: SOA RDATA length", ErrInvalidRDATA))
+		}
+		return SOA{
+			MName:   mName,
+			RName:   rName,
+			Serial:  binary.BigEndian.Uint32(d.msg[offset : offset+4]),
+			Refresh: binary.BigEndian.Uint32(d.msg[offset+4 : offset+8]),
+			Retry:   binary.BigEndian.Uint32(d.msg[offset+8 : offset+12]),
+			Expire:  binary.BigEndian.Uint32(d.msg[offset+12 : offset+16]),
+			Minimum: binary.BigEndian.Uint32(d.msg[offset+16 : offset+20]),
+		}, nil
+	case TypeMX:
+		if end-offset < 3 {
+			return nil, errorAt(offset, fmt.Errorf("%w: MX RDATA length", ErrInvalidRDATA))
+		}
+		name, err := d.readRDataName(offset+2, end)
+		if err != nil {
+			return nil, err
+		}
+		return MX{
+			Preference: binary.BigEndian.Uint16(d.msg[offset : offset+2]),
+			Exchange:   name,
+		}, nil
+	case TypeTXT:
+		var text []string
+		for offset < end {
+			length := int(d.msg[offset])
+			if offset+1+length > end {
+				return nil, errorAt(offset, fmt.Errorf("%w: TXT character-string length", ErrInvalidRDATA))
+			}
+			text = append(text, d.substring(offset+1, offset+1+length))
+			offset += 1 + length
+		}
+		return TXT{Text: text}, nil
+	case TypeSRV:
+		if end-offset < 7 {
+			return nil, errorAt(offset, fmt.Errorf("%w: SRV RDATA length", ErrInvalidRDATA))
+		}
+		name, err := d.readRDataName(offset+6, end)
+		if err != nil {
+			return nil, err
+		}
+		return SRV{
+			Priority: binary.BigEndian.Uint16(d.msg[offset : offset+2]),
+			Weight:   binary.BigEndian.Uint16(d.msg[offset+2 : offset+4]),
+			Port:     binary.BigEndian.Uint16(d.msg[offset+4 : offset+6]),
+			Target:   name,
+		}, nil
+	case TypeOPT:
+		return d.readOPT(offset, end)
+	default:
+		return RawRData{RRType: rrType, Data: d.copyRDATA(rdata)}, nil
+	}
+}
+
+// readRDataName reads the name that makes up the rest of the RDATA from offset
+// up to end.
+func (d *decoder) readRDataName(offset int, end int) (Name, error) {
+	name, nameEndOffset, err := d.readName(offset)
+	if err != nil {
+		return nil, err
+	}
+	if nameEndOffset != end {
+		return nil, errorAt(nameEndOffset, ErrInvalidRDATA)
+	}
+
+	return name, nil
+}
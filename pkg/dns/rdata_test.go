@@ -0,0 +1,98 @@
+package dns
+
+import (
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+)
+
+func TestRData_RoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		data RData
+	}{
+		{"A", A{A: net.IP{1, 2, 3, 4}}},
+		{"AAAA", AAAA{AAAA: net.ParseIP("2001:db8::1")}},
+		{"NS", NS{Host: Name{"ns1", "example", "com"}}},
+		{"CNAME", CNAME{Target: Name{"www", "example", "com"}}},
+		{"SOA", SOA{
+			MName:   Name{"ns1", "example", "com"},
+			RName:   Name{"hostmaster", "example", "com"},
+			Serial:  2024010101,
+			Refresh: 7200,
+			Retry:   3600,
+			Expire:  1209600,
+			Minimum: 300,
+		}},
+		{"PTR", PTR{Target: Name{"host", "example", "com"}}},
+		{"MX", MX{Preference: 10, Exchange: Name{"mail", "example", "com"}}},
+		{"TXT", TXT{Text: []string{"v=spf1 -all", "second"}}},
+		{"SRV", SRV{Priority: 1, Weight: 2, Port: 443, Target: Name{"svc", "example", "com"}}},
+		{"Unknown", RawRData{RRType: 65280, Data: []byte{0xde, 0xad, 0xbe, 0xef}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			record := NewRecord(Name{"example", "com"}, ClassIN, 60, tt.data)
+			message := Message{
+				Header:    Header{ID: 1234, Flags: HeaderFlags{QR: 1}, QDCOUNT: 1, ANCOUNT: 1},
+				Questions: Questions{NewQuestion("example.com", tt.data.Type(), ClassIN)},
+				Answers:   Answers{record},
+			}
+
+			actual, err := RawMessage(message.Serialize()).Parse()
+
+			require.NoError(t, err)
+			require.Equal(t, Answers{record}, actual.Answers, "Parsed record should match the serialized one")
+		})
+	}
+}
+
+func TestNewRecord(t *testing.T) {
+	expected := Answer{
+		NAME:    Name{"example", "com"},
+		TYPE:    15,
+		CLASS:   1,
+		TTL:     60,
+		RDLENGH: 8,
+		RDATA:   []byte{0x00, 0x0a, 0x02, 0x6d, 0x78, 0x01, 0x78, 0x00},
+		Data:    MX{Preference: 10, Exchange: Name{"mx", "x"}},
+	}
+
+	actual := NewRecord(Name{"example", "com"}, ClassIN, 60, MX{Preference: 10, Exchange: Name{"mx", "x"}})
+
+	require.Equal(t, expected, actual, "Record should match expected value")
+}
+
+func TestTXT_packSplitsLongStrings(t *testing.T) {
+	text := string(make([]byte, 300))
+
+	packed := TXT{Text: []string{text}}.pack(nil, nil)
+
+	require.Len(t, packed, 302)
+	require.Equal(t, byte(255), packed[0])
+	require.Equal(t, byte(45), packed[256])
+}
+
+func TestRawMessage_readRDataRejectsInvalidLength(t *testing.T) {
+	data := []byte{
+		// Header
+		0x04, 0xd2, // ID
+		0x80, 0x00, // Flags
+		0x00, 0x00, // QDCOUNT
+		0x00, 0x01, // ANCOUNT
+		0x00, 0x00, // NSCOUNT
+		0x00, 0x00, // ARCOUNT
+		// Answer
+		0x00,       // root
+		0x00, 0x01, // TYPE A
+		0x00, 0x01, // CLASS IN
+		0x00, 0x00, 0x00, 0x3c, // TTL
+		0x00, 0x03, // RDLENGTH
+		0x01, 0x02, 0x03, // RDATA
+	}
+
+	_, err := RawMessage(data).Parse()
+
+	require.Error(t, err)
+}
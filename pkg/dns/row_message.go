@@ -2,11 +2,44 @@ package dns
 
 import (
 	"encoding/binary"
-	"fmt"
+	"strings"
 )
 
 var headerLength = 12
 
+const (
+	// maxLabelLength and maxNameLength are the limits of RFC 1035, section
+	// 2.3.4. maxNameLength includes the length octets and the root label.
+	maxLabelLength = 63
+	maxNameLength  = 255
+
+	// maxMessageLength is the largest message the two-octet length prefix of
+	// TCP can frame (RFC 1035, section 4.2.2).
+	maxMessageLength = 65535
+
+	// maxPointers bounds the compression pointers followed within one name. A
+	// name of at most 255 octets cannot legitimately need more.
+	maxPointers = 127
+)
+
+// compressibleRDATA lists the well-known types whose RDATA may carry compressed
+// domain names (RFC 3597, section 4). Each entry is the sequence of RDATA
+// fields, where 0 stands for a domain name and any other value for a fixed
+// number of octets.
+var compressibleRDATA = map[Type][]int{
+	TypeNS:    {0},
+	TypeMD:    {0},
+	TypeMF:    {0},
+	TypeCNAME: {0},
+	TypeSOA:   {0, 0, 20},
+	TypeMB:    {0},
+	TypeMG:    {0},
+	TypeMR:    {0},
+	TypePTR:   {0},
+	TypeMINFO: {0, 0},
+	TypeMX:    {2, 0},
+}
+
 type RowHeaderFlags []byte
 
 type RowHeader []byte
@@ -24,17 +57,23 @@ func (h RowHeaderFlags) parse() HeaderFlags {
 
 	return HeaderFlags{
 		QR:     flags >> 15,
-		OPCODE: (flags >> 11) & 0x0F,
+		OPCODE: Opcode(flags>>11) & 0x0F,
 		AA:     (flags >> 10) & 0x01,
 		TC:     (flags >> 9) & 0x01,
 		RD:     (flags >> 8) & 0x01,
 		RA:     (flags >> 7) & 0x01,
-		Z:      (flags >> 4) & 0x07,
-		RCODE:  flags & 0x0F,
+		Z:      (flags >> 6) & 0x01,
+		AD:     (flags >> 5) & 0x01,
+		CD:     (flags >> 4) & 0x01,
+		RCODE:  Rcode(flags) & 0x0F,
 	}
 }
 
-func (h RowHeader) parse() Header {
+func (h RowHeader) parse() (Header, error) {
+	if len(h) < headerLength {
+		return Header{}, ErrTruncatedMessage
+	}
+
 	return Header{
 		ID:      binary.BigEndian.Uint16(h[0:2]),
 		Flags:   RowHeaderFlags(h[2:4]).parse(),
@@ -42,159 +81,446 @@ func (h RowHeader) parse() Header {
 		ANCOUNT: binary.BigEndian.Uint16(h[6:8]),
 		NSCOUNT: binary.BigEndian.Uint16(h[8:10]),
 		ARCOUNT: binary.BigEndian.Uint16(h[10:12]),
-	}
+	}, nil
 }
 
-func (l RowLabel) parse() Label {
-	length := l[0]
-	return Label(l[1 : 1+length])
+func (l RowLabel) parse() (Label, error) {
+	if len(l) == 0 {
+		return "", ErrTruncatedMessage
+	}
+	length := int(l[0])
+	if length > maxLabelLength {
+		return "", ErrLabelTooLong
+	}
+	if 1+length > len(l) {
+		return "", ErrTruncatedMessage
+	}
+	return Label(l[1 : 1+length]), nil
 }
 
-func (n RowName) parse() Name {
+// parse decodes an uncompressed name. Use RawMessage.readName for names that
+// may contain compression pointers.
+func (n RowName) parse() (Name, error) {
 	var name Name
 	offset := 0
 
-	for offset < len(n) {
-		length := int(n[offset])
-		if length == 0 {
-			break
+	for {
+		if offset >= len(n) {
+			return nil, errorAt(offset, ErrTruncatedMessage)
+		}
+		if n[offset] == 0 {
+			return name, nil
+		}
+		label, err := RowLabel(n[offset:]).parse()
+		if err != nil {
+			return nil, errorAt(offset, err)
 		}
-		offset++
-		label := Label(n[offset : offset+length])
 		name = append(name, label)
-		offset += length
+		offset += 1 + len(label)
+		if offset+1 > maxNameLength {
+			return nil, errorAt(offset, ErrNameTooLong)
+		}
 	}
-
-	return name
 }
 
-func (q RowQuestion) parse() Question {
+func (q RowQuestion) parse() (Question, error) {
 	length := len(q)
-	qType := binary.BigEndian.Uint16(q[length-4 : length-2])
-	qClass := binary.BigEndian.Uint16(q[length-2 : length])
+	if length < 5 {
+		return Question{}, errorAt(length, ErrTruncatedMessage)
+	}
+
+	name, err := RowName(q[0 : length-4]).parse()
+	if err != nil {
+		return Question{}, err
+	}
 
 	return Question{
-		NAME:  RowName(q[0 : length-4]).parse(),
-		TYPE:  qType,
-		CLASS: qClass,
+		NAME:  name,
+		TYPE:  Type(binary.BigEndian.Uint16(q[length-4 : length-2])),
+		CLASS: Class(binary.BigEndian.Uint16(q[length-2 : length])),
+	}, nil
+}
+
+// ParseHeader decodes only the header of the message, which is enough to
+// answer a message whose body cannot be parsed.
+func (rm RawMessage) ParseHeader() (Header, error) {
+	header, err := RowHeader(rm).parse()
+	if err != nil {
+		return Header{}, inSection(errorAt(len(rm), err), "header", 0)
 	}
+
+	return header, nil
 }
 
+// Parse decodes the message. It never panics on malformed input; any problem
+// is reported as a *ParseError.
 func (rm RawMessage) Parse() (Message, error) {
-	header := RowHeader(rm[0:headerLength]).parse()
+	var m Message
+	if err := m.Unpack(rm); err != nil {
+		return Message{}, err
+	}
+
+	// The storage is only worth keeping for a later Unpack into m.
+	m.buffers = unpackBuffers{}
+	return m, nil
+}
+
+// Unpack decodes msg into m like RawMessage.Parse, reusing the storage of the
+// message m held before, so that a Message can serve many messages in turn:
+// the capacity of the sections, of the EDNS options, and of the labels,
+// decompressed RDATA and addresses of the records. Whatever an earlier Unpack
+// into m, or into a copy of m, returned is overwritten.
+//
+// Labels refer to a single copy of msg, the RDATA of types without compressed
+// names to msg itself. Once m has grown to the size of the messages, Unpack
+// allocates that copy and one value per typed RDATA and EDNS option, which
+// the RData and EDNSOption interfaces box (see BenchmarkMessage_Unpack). Use a
+// Parser to read the header and questions with next to none. On error m is
+// reset.
+func (m *Message) Unpack(msg []byte) error {
+	d := decoder{msg: msg, unpackBuffers: m.buffers.reset()}
+	header, err := d.msg.ParseHeader()
+	if err != nil {
+		*m = Message{}
+		return err
+	}
+	if len(msg) > headerLength {
+		d.text = string(msg)
+	}
 
 	offset := headerLength
 
 	// Parse questions
-	var questions Questions
+	questions := m.Questions[:0]
 	for i := 0; i < int(header.QDCOUNT); i++ {
-		labelOffset, err := findNameEndOrPointerOffset(offset, rm[offset:])
-		if labelOffset.labelEndOffset > 0 {
-			endOfName := labelOffset.labelEndOffset
-			endOfQuestion := offset + endOfName + 5
+		question, endOfQuestion, err := d.readQuestion(offset)
+		if err != nil {
+			*m = Message{}
+			return inSection(err, "question", i)
+		}
 
-			if endOfQuestion > len(rm) {
-				return Message{}, fmt.Errorf("invalid question length")
-			}
+		questions = append(questions, question)
+		offset = endOfQuestion
+	}
 
-			questions = append(questions, RowQuestion(rm[offset:endOfQuestion]).parse())
+	answers, offset, err := d.parseAnswers(m.Answers[:0], offset, header.ANCOUNT, "answer")
+	if err != nil {
+		*m = Message{}
+		return err
+	}
 
-			offset = endOfQuestion
+	authority, offset, err := d.parseAnswers(m.Authority[:0], offset, header.NSCOUNT, "authority")
+	if err != nil {
+		*m = Message{}
+		return err
+	}
 
-			continue
-		}
-		if labelOffset.compressionPointerOffset > 0 {
-			pointerOffset := labelOffset.compressionPointerOffset
-			endOfName, _ := findNullOffset(rm[pointerOffset:])
+	additional, edns, err := d.parseAdditional(m.Additional[:0], offset, header.ARCOUNT, m.EDNS)
+	if err != nil {
+		*m = Message{}
+		return err
+	}
+
+	*m = Message{
+		Header:     header,
+		Questions:  questions,
+		Answers:    answers,
+		Authority:  authority,
+		Additional: additional,
+		EDNS:       edns,
+		buffers:    d.unpackBuffers,
+	}
+	return nil
+}
 
-			var name RowName
-			name = append(name, rm[offset:labelOffset.value-1]...)
-			name = append(name, rm[pointerOffset:pointerOffset+endOfName+1]...)
+// unpackBuffers is the storage that Unpack decodes names and RDATA into, kept
+// in the Message for the next Unpack to reuse.
+type unpackBuffers struct {
+	labels []Label
+	rdata  []byte
+}
 
-			endOfQuestion := labelOffset.value + 5
+// reset empties the buffers for a new message, keeping their capacity.
+func (b unpackBuffers) reset() unpackBuffers {
+	return unpackBuffers{labels: b.labels[:0], rdata: b.rdata[:0]}
+}
 
-			var rq RowQuestion
-			rq = append(rq, name...)
-			rq = append(rq, rm[labelOffset.value+1:endOfQuestion]...)
-			questions = append(questions, rq.parse())
+// decoder decodes the entries of a message. Names and copied RDATA are
+// appended to its buffers, which start out empty unless Unpack hands it those
+// of an earlier message.
+type decoder struct {
+	msg RawMessage
+	// text is msg as a string, which the labels of every name are cut from.
+	// If it is empty, each name gets a string of its own.
+	text string
+	// options is the storage the options of the OPT record are appended to.
+	options []EDNSOption
+	unpackBuffers
+}
 
-			offset = endOfQuestion
+func (d *decoder) readQuestion(offset int) (Question, int, error) {
+	name, nameEndOffset, err := d.readName(offset)
+	if err != nil {
+		return Question{}, 0, err
+	}
 
-			continue
+	endOfQuestion := nameEndOffset + 4
+	if endOfQuestion > len(d.msg) {
+		return Question{}, 0, errorAt(len(d.msg), ErrTruncatedMessage)
+	}
+
+	return Question{
+		NAME:  name,
+		TYPE:  Type(binary.BigEndian.Uint16(d.msg[nameEndOffset : nameEndOffset+2])),
+		CLASS: Class(binary.BigEndian.Uint16(d.msg[nameEndOffset+2 : endOfQuestion])),
+	}, endOfQuestion, nil
+}
+
+// parseAnswers appends count resource records starting at offset to answers.
+// It is used for the answer, authority and additional sections, which share
+// the same format.
+func (d *decoder) parseAnswers(answers Answers, offset int, count uint16, section string) (Answers, int, error) {
+	for i := 0; i < int(count); i++ {
+		answer, endOfRecord, err := d.readAnswer(offset)
+		if err != nil {
+			return nil, 0, inSection(err, section, i)
 		}
-		return Message{}, err
+
+		answers = append(answers, answer)
+		offset = endOfRecord
+	}
+
+	return answers, offset, nil
+}
+
+func (d *decoder) readAnswer(offset int) (Answer, int, error) {
+	name, nameEndOffset, err := d.readName(offset)
+	if err != nil {
+		return Answer{}, 0, err
+	}
+
+	rdataOffset := nameEndOffset + 10
+	if rdataOffset > len(d.msg) {
+		return Answer{}, 0, errorAt(len(d.msg), ErrTruncatedMessage)
 	}
 
-	// Parse answers
-	var answers Answers
-	for i := 0; i < int(header.ANCOUNT); i++ {
-		nameEndOrPointerOffset, err := findNameEndOrPointerOffset(offset, rm[offset:])
-		if nameEndOrPointerOffset.compressionPointerOffset > 0 {
-			panic("not implemented")
+	typeClassOffset := nameEndOffset
+	qType := Type(binary.BigEndian.Uint16(d.msg[typeClassOffset : typeClassOffset+2]))
+	qClass := Class(binary.BigEndian.Uint16(d.msg[typeClassOffset+2 : typeClassOffset+4]))
+
+	ttlOffset := typeClassOffset + 4
+	ttl := binary.BigEndian.Uint32(d.msg[ttlOffset : ttlOffset+4])
+
+	rdLengthOffset := ttlOffset + 4
+	rdLength := binary.BigEndian.Uint16(d.msg[rdLengthOffset : rdLengthOffset+2])
+
+	endOfRecord := rdataOffset + int(rdLength)
+	if endOfRecord > len(d.msg) {
+		return Answer{}, 0, errorAt(rdLengthOffset, ErrTruncatedMessage)
+	}
+
+	// RDATA formats are those of class IN, and UPDATE messages carry empty
+	// RDATA with CLASS ANY or NONE (RFC 2136, section 2.5), so any other RDATA
+	// is kept undecoded rather than rejected. The CLASS of OPT is no class.
+	raw := qType != TypeOPT && (qClass != ClassIN || rdLength == 0)
+
+	rdata := d.msg[rdataOffset:endOfRecord]
+	if rdLength > 0 {
+		rdata, err = d.readRDATA(qType, rdataOffset, endOfRecord)
+		if err != nil {
+			return Answer{}, 0, err
 		}
+	}
+
+	var data RData
+	if raw {
+		data = RawRData{RRType: qType, Data: d.copyRDATA(rdata)}
+	} else {
+		data, err = d.readRData(qType, rdataOffset, endOfRecord, rdata)
 		if err != nil {
-			return Message{}, err
+			return Answer{}, 0, err
+		}
+	}
+
+	return Answer{
+		NAME:    name,
+		TYPE:    qType,
+		CLASS:   qClass,
+		TTL:     ttl,
+		RDLENGH: uint16(len(rdata)),
+		RDATA:   rdata,
+		Data:    data,
+	}, endOfRecord, nil
+}
+
+// readName decodes the domain name starting at offset, following compression
+// pointers to anywhere earlier in the message. The returned offset points just
+// past the name as it appears at offset, i.e. past the first pointer if any.
+//
+// Pointers must point backwards and may not revisit an offset, and the decoded
+// name must respect the label and name length limits, so that a crafted
+// message can neither make the decoder loop nor allocate without bound.
+//
+// The labels are first located, then cut from the text of the message, or
+// copied into a single string they all share, and appended to the labels of
+// the decoder, so that a name costs at most two allocations however many
+// labels it has.
+func (d *decoder) readName(offset int) (Name, int, error) {
+	var starts [maxNameLength / 2]int
+	labels := starts[:0]
+	var seen [maxPointers]int
+	visited := seen[:0]
+	end := -1
+	length := 1
+
+	for {
+		if offset >= len(d.msg) {
+			return nil, 0, errorAt(offset, ErrTruncatedMessage)
 		}
-		nameEndOffset := nameEndOrPointerOffset.value
-		name := RowName(rm[offset:nameEndOffset]).parse()
 
-		typeClassOffset := nameEndOffset + 1
-		qType := binary.BigEndian.Uint16(rm[typeClassOffset : typeClassOffset+2])
-		qClass := binary.BigEndian.Uint16(rm[typeClassOffset+2 : typeClassOffset+4])
+		labelLength := int(d.msg[offset])
+		switch {
+		case labelLength == 0:
+			if end < 0 {
+				end = offset + 1
+			}
+			return d.collectLabels(labels, length), end, nil
+		case labelLength&0xC0 == 0xC0:
+			if offset+1 >= len(d.msg) {
+				return nil, 0, errorAt(offset, ErrTruncatedMessage)
+			}
+			if end < 0 {
+				end = offset + 2
+			}
+			target := int(binary.BigEndian.Uint16(d.msg[offset:offset+2]) & 0x3FFF)
+			if target >= offset {
+				return nil, 0, errorAt(offset, ErrForwardPointer)
+			}
+			if len(visited) >= maxPointers || containsOffset(visited, target) {
+				return nil, 0, errorAt(offset, ErrPointerLoop)
+			}
+			visited = append(visited, target)
+			offset = target
+		default:
+			if labelLength > maxLabelLength {
+				return nil, 0, errorAt(offset, ErrLabelTooLong)
+			}
+			if offset+1+labelLength > len(d.msg) {
+				return nil, 0, errorAt(offset, ErrTruncatedMessage)
+			}
+			length += 1 + labelLength
+			if length > maxNameLength {
+				return nil, 0, errorAt(offset, ErrNameTooLong)
+			}
+			labels = append(labels, offset)
+			offset += 1 + labelLength
+		}
+	}
+}
 
-		ttlOffset := typeClassOffset + 4
-		ttl := binary.BigEndian.Uint32(rm[ttlOffset : ttlOffset+4])
+// collectLabels returns the name made of the labels starting at the given
+// offsets, whose wire form is length octets long.
+func (d *decoder) collectLabels(starts []int, length int) Name {
+	if len(starts) == 0 {
+		return nil
+	}
 
-		rdLengthOffset := ttlOffset + 4
-		rdLength := binary.BigEndian.Uint16(rm[rdLengthOffset : rdLengthOffset+2])
+	if cap(d.labels)-len(d.labels) < len(starts) {
+		// Names decoded so far keep the old array.
+		d.labels = make([]Label, 0, 2*cap(d.labels)+len(starts))
+	}
+	first := len(d.labels)
 
-		rdata := rm[rdLengthOffset+2 : rdLengthOffset+2+int(rdLength)]
+	if d.text != "" {
+		for _, start := range starts {
+			d.labels = append(d.labels, Label(d.text[start+1:start+1+int(d.msg[start])]))
+		}
+	} else {
+		var b strings.Builder
+		b.Grow(length)
+		for _, start := range starts {
+			b.Write(d.msg[start+1 : start+1+int(d.msg[start])])
+		}
+		text := b.String()
 
-		answer := Answer{
-			NAME:    name,
-			TYPE:    qType,
-			CLASS:   qClass,
-			TTL:     ttl,
-			RDLENGH: rdLength,
-			RDATA:   rdata,
+		position := 0
+		for _, start := range starts {
+			labelLength := int(d.msg[start])
+			d.labels = append(d.labels, Label(text[position:position+labelLength]))
+			position += labelLength
 		}
+	}
 
-		answers = append(answers, answer)
-		offset += len(answer.serialize())
+	return Name(d.labels[first:len(d.labels):len(d.labels)])
+}
+
+func containsOffset(offsets []int, offset int) bool {
+	for _, o := range offsets {
+		if o == offset {
+			return true
+		}
 	}
 
-	return Message{
-		Header:    header,
-		Questions: questions,
-		Answers:   answers,
-	}, nil
+	return false
 }
 
-func findNameEndOrPointerOffset(context int, slice []byte) (LabelOffset, error) {
-	offset := 0
-	for offset < len(slice) {
-		b := slice[offset]
-		if b == 0 {
-			return LabelOffset{value: context + offset, labelEndOffset: offset}, nil
-		}
-		if b&0xC0 == 0xC0 {
-			if offset+1 >= len(slice) {
-				return LabelOffset{}, fmt.Errorf("invalid pointer in label")
+// readRDATA returns the RDATA between offset and end. For the well-known types
+// whose RDATA may contain compressed domain names, the names are expanded into
+// the buffers of the decoder, so that the returned bytes no longer refer to
+// the rest of the message.
+func (d *decoder) readRDATA(rrType Type, offset int, end int) ([]byte, error) {
+	layout, ok := compressibleRDATA[rrType]
+	if !ok {
+		return d.msg[offset:end], nil
+	}
+
+	d.grow(end - offset)
+	start := len(d.rdata)
+	for _, size := range layout {
+		if size == 0 {
+			name, nameEndOffset, err := d.readName(offset)
+			if err != nil {
+				return nil, err
 			}
-			return LabelOffset{value: context + offset + 1, compressionPointerOffset: int(b&0x3F)<<8 + int(slice[offset+1])}, nil
-		} else {
-			offset++
+			d.rdata = name.pack(d.rdata, nil)
+			offset = nameEndOffset
+			continue
+		}
+		if offset+size > end {
+			return nil, errorAt(offset, ErrInvalidRDATA)
 		}
+		d.rdata = append(d.rdata, d.msg[offset:offset+size]...)
+		offset += size
+	}
+
+	if offset != end {
+		return nil, errorAt(offset, ErrInvalidRDATA)
 	}
-	return LabelOffset{}, fmt.Errorf("null terminator not found")
+
+	return d.rdata[start:len(d.rdata):len(d.rdata)], nil
 }
 
-func findNullOffset(slice []byte) (int, error) {
-	for i, b := range slice {
-		if b == 0 {
-			return i, nil
-		}
+// copyRDATA returns a copy of b in the buffers of the decoder.
+func (d *decoder) copyRDATA(b []byte) []byte {
+	d.grow(len(b))
+	start := len(d.rdata)
+	d.rdata = append(d.rdata, b...)
+	return d.rdata[start:len(d.rdata):len(d.rdata)]
+}
+
+// grow makes room for n more octets of RDATA. RDATA decoded so far keeps the
+// old array.
+func (d *decoder) grow(n int) {
+	if cap(d.rdata)-len(d.rdata) < n {
+		d.rdata = make([]byte, 0, 2*cap(d.rdata)+n)
 	}
+}
 
-	return 0, fmt.Errorf("null terminator not found")
+// substring returns the text of msg between start and end, cut from the text of
+// the decoder if it has one.
+func (d *decoder) substring(start, end int) string {
+	if d.text != "" {
+		return d.text[start:end]
+	}
+	return string(d.msg[start:end])
 }
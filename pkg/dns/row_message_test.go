@@ -1,7 +1,9 @@
 package dns
 
 import (
+	"errors"
 	"github.com/stretchr/testify/require"
+	"net"
 	"testing"
 )
 
@@ -26,8 +28,9 @@ func TestRowHeader_parse(t *testing.T) {
 		0x00, 0x00, // NSCOUNT
 		0x00, 0x00, // ARCOUNT
 	}
-	actual := RowHeader(data).parse()
+	actual, err := RowHeader(data).parse()
 
+	require.NoError(t, err)
 	require.Equal(t, expected, actual, "Parsed header should match expected value")
 }
 
@@ -37,8 +40,9 @@ func TestRowLabel_Parse(t *testing.T) {
 	data := []byte{
 		0x06, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65,
 	}
-	actual := RowLabel(data).parse()
+	actual, err := RowLabel(data).parse()
 
+	require.NoError(t, err)
 	require.Equal(t, expected, actual, "Parsed label should match expected value")
 }
 
@@ -49,8 +53,9 @@ func TestRowName_Parse(t *testing.T) {
 		0x06, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65,
 		0x03, 0x63, 0x6f, 0x6d, 0x0,
 	}
-	actual := RowName(data).parse()
+	actual, err := RowName(data).parse()
 
+	require.NoError(t, err)
 	require.Equal(t, expected, actual, "Parsed name should match expected value")
 }
 
@@ -67,8 +72,9 @@ func TestRowQuestion_Parse(t *testing.T) {
 		0x00, 0x01,
 		0x00, 0x01,
 	}
-	actual := RowQuestion(data).parse()
+	actual, err := RowQuestion(data).parse()
 
+	require.NoError(t, err)
 	require.Equal(t, expected, actual, "Parsed question should match expected value")
 }
 
@@ -159,6 +165,7 @@ func TestRawMessage_ParseWithAnswers(t *testing.T) {
 				TTL:     60,
 				RDLENGH: 4,
 				RDATA:   []byte{1, 2, 3, 4},
+				Data:    A{A: net.IP{1, 2, 3, 4}},
 			},
 			Answer{
 				NAME:    Name{"def", "example", "com"},
@@ -167,6 +174,7 @@ func TestRawMessage_ParseWithAnswers(t *testing.T) {
 				TTL:     60,
 				RDLENGH: 4,
 				RDATA:   []byte{5, 6, 7, 8},
+				Data:    A{A: net.IP{5, 6, 7, 8}},
 			},
 		},
 	}
@@ -219,3 +227,383 @@ func TestRawMessage_ParseWithAnswers(t *testing.T) {
 
 	require.Equal(t, expected, actual, "Parsed message should match expected value")
 }
+
+func TestRawMessage_ParseWithAuthorityAndAdditional(t *testing.T) {
+	expected := Message{
+		Header: Header{
+			ID: 1234,
+			Flags: HeaderFlags{
+				QR:    1,
+				RCODE: 3,
+			},
+			QDCOUNT: 1,
+			ANCOUNT: 0,
+			NSCOUNT: 1,
+			ARCOUNT: 1,
+		},
+		Questions: Questions{
+			Question{
+				NAME:  Name{"abc", "com"},
+				TYPE:  1,
+				CLASS: 1,
+			},
+		},
+		Authority: Answers{
+			Answer{
+				NAME:    Name{"com"},
+				TYPE:    2,
+				CLASS:   1,
+				TTL:     60,
+				RDLENGH: 6,
+				RDATA:   []byte{0x02, 0x6e, 0x73, 0x01, 0x78, 0x00},
+				Data:    NS{Host: Name{"ns", "x"}},
+			},
+		},
+		Additional: Answers{
+			Answer{
+				NAME:    Name{"ns", "x"},
+				TYPE:    1,
+				CLASS:   1,
+				TTL:     60,
+				RDLENGH: 4,
+				RDATA:   []byte{1, 2, 3, 4},
+				Data:    A{A: net.IP{1, 2, 3, 4}},
+			},
+		},
+	}
+
+	data := []byte{
+		// Header
+		0x04, 0xd2, // ID
+		0x80, 0x03, // Flags
+		0x00, 0x01, // QDCOUNT
+		0x00, 0x00, // ANCOUNT
+		0x00, 0x01, // NSCOUNT
+		0x00, 0x01, // ARCOUNT
+
+		// Question
+		0x03, 0x61, 0x62, 0x63, // abc
+		0x03, 0x63, 0x6f, 0x6d, 0x00, // com
+		0x00, 0x01, // TYPE A
+		0x00, 0x01, // CLASS IN
+
+		// Authority
+		0x03, 0x63, 0x6f, 0x6d, 0x00, // com
+		0x00, 0x02, // TYPE NS
+		0x00, 0x01, // CLASS IN
+		0x00, 0x00, 0x00, 0x3c, // TTL
+		0x00, 0x06, // RDLENGTH
+		0x02, 0x6e, 0x73, 0x01, 0x78, 0x00, // ns.x
+
+		// Additional
+		0x02, 0x6e, 0x73, 0x01, 0x78, 0x00, // ns.x
+		0x00, 0x01, // TYPE A
+		0x00, 0x01, // CLASS IN
+		0x00, 0x00, 0x00, 0x3c, // TTL
+		0x00, 0x04, // RDLENGTH
+		0x01, 0x02, 0x03, 0x04, // RDATA
+	}
+
+	actual, err := RawMessage(data).Parse()
+
+	require.NoError(t, err)
+	require.Equal(t, expected, actual, "Parsed message should match expected value")
+
+	actual.DisableCompression = true
+	require.Equal(t, data, actual.Serialize(), "Serialized message should round trip")
+}
+
+func TestRawMessage_ParseWithCompressedQuestions(t *testing.T) {
+	expected := Questions{
+		Question{
+			NAME:  Name{"abc", "example", "com"},
+			TYPE:  1,
+			CLASS: 1,
+		},
+		Question{
+			NAME:  Name{"def", "example", "com"},
+			TYPE:  1,
+			CLASS: 1,
+		},
+	}
+
+	data := []byte{
+		// Header
+		0x04, 0xD2, // ID
+		0x00, 0x00, // Flags
+		0x00, 0x02, // QDCOUNT
+		0x00, 0x00, // ANCOUNT
+		0x00, 0x00, // NSCOUNT
+		0x00, 0x00, // ARCOUNT
+		// Question 1
+		0x03, 0x61, 0x62, 0x63, // abc
+		0x07, 0x65, 0x78, 0x61, 0x6d, 0x70, 0x6c, 0x65, // example
+		0x03, 0x63, 0x6f, 0x6d, // com
+		0x00,       // null terminator
+		0x00, 0x01, // TYPE
+		0x00, 0x01, // CLASS
+		// Question 2
+		0x03, 0x64, 0x65, 0x66, // def
+		0xc0, 0x10, // pointer to example.com
+		0x00, 0x01, // TYPE
+		0x00, 0x01, // CLASS
+	}
+
+	actual, err := RawMessage(data).Parse()
+
+	require.NoError(t, err)
+	require.Equal(t, expected, actual.Questions, "Parsed questions should match expected value")
+}
+
+func TestRawMessage_ParseWithCompressedAnswers(t *testing.T) {
+	expected := Answers{
+		Answer{
+			NAME:    Name{"www", "example", "com"},
+			TYPE:    5,
+			CLASS:   1,
+			TTL:     60,
+			RDLENGH: 17,
+			RDATA: []byte{
+				0x03, 0x77, 0x65, 0x62, // web
+				0x07, 0x65, 0x78, 0x61, 0x6d, 0x70, 0x6c, 0x65, // example
+				0x03, 0x63, 0x6f, 0x6d, 0x00, // com
+			},
+			Data: CNAME{Target: Name{"web", "example", "com"}},
+		},
+		Answer{
+			NAME:    Name{"web", "example", "com"},
+			TYPE:    1,
+			CLASS:   1,
+			TTL:     60,
+			RDLENGH: 4,
+			RDATA:   []byte{1, 2, 3, 4},
+			Data:    A{A: net.IP{1, 2, 3, 4}},
+		},
+		Answer{
+			NAME:    Name{"example", "com"},
+			TYPE:    15,
+			CLASS:   1,
+			TTL:     60,
+			RDLENGH: 18,
+			RDATA: []byte{
+				0x00, 0x0a, // PREFERENCE
+				0x02, 0x6d, 0x78, // mx
+				0x07, 0x65, 0x78, 0x61, 0x6d, 0x70, 0x6c, 0x65, // example
+				0x03, 0x63, 0x6f, 0x6d, 0x00, // com
+			},
+			Data: MX{Preference: 10, Exchange: Name{"mx", "example", "com"}},
+		},
+	}
+
+	data := []byte{
+		// Header
+		0x04, 0xd2, // ID
+		0x80, 0x00, // Flags
+		0x00, 0x01, // QDCOUNT
+		0x00, 0x03, // ANCOUNT
+		0x00, 0x00, // NSCOUNT
+		0x00, 0x00, // ARCOUNT
+
+		// Question
+		0x03, 0x77, 0x77, 0x77, // www
+		0x07, 0x65, 0x78, 0x61, 0x6d, 0x70, 0x6c, 0x65, // example
+		0x03, 0x63, 0x6f, 0x6d, 0x00, // com
+		0x00, 0x05, // TYPE CNAME
+		0x00, 0x01, // CLASS IN
+
+		// Answer 1 (offset 33)
+		0xc0, 0x0c, // pointer to www.example.com
+		0x00, 0x05, // TYPE CNAME
+		0x00, 0x01, // CLASS IN
+		0x00, 0x00, 0x00, 0x3c, // TTL
+		0x00, 0x06, // RDLENGTH
+		0x03, 0x77, 0x65, 0x62, 0xc0, 0x10, // web + pointer to example.com
+
+		// Answer 2 (offset 51)
+		0xc0, 0x2d, // pointer to web.example.com
+		0x00, 0x01, // TYPE A
+		0x00, 0x01, // CLASS IN
+		0x00, 0x00, 0x00, 0x3c, // TTL
+		0x00, 0x04, // RDLENGTH
+		0x01, 0x02, 0x03, 0x04, // RDATA
+
+		// Answer 3
+		0xc0, 0x10, // pointer to example.com
+		0x00, 0x0f, // TYPE MX
+		0x00, 0x01, // CLASS IN
+		0x00, 0x00, 0x00, 0x3c, // TTL
+		0x00, 0x07, // RDLENGTH
+		0x00, 0x0a, 0x02, 0x6d, 0x78, 0xc0, 0x10, // 10 mx + pointer to example.com
+	}
+
+	actual, err := RawMessage(data).Parse()
+
+	require.NoError(t, err)
+	require.Equal(t, expected, actual.Answers, "Parsed answers should match expected value")
+}
+
+func TestRawMessage_ParseKeepsRDATAOfOtherClasses(t *testing.T) {
+	name := Name{"example", "com"}
+	m := Message{
+		Header:    Header{ID: 1234, Flags: HeaderFlags{OPCODE: OpcodeUpdate}},
+		Questions: Questions{{NAME: name, TYPE: TypeSOA, CLASS: ClassIN}},
+		Authority: Answers{
+			// Delete all A records of the name (RFC 2136, section 2.5.2).
+			NewRecord(name, ClassANY, 0, RawRData{RRType: TypeA}),
+			// Delete an RRset, with empty RDATA of a type that has a decoder.
+			NewRecord(name, ClassNONE, 0, RawRData{RRType: TypeMX}),
+			// A Chaosnet address: a domain name and a 16-bit address.
+			NewRecord(name, ClassCH, 60, RawRData{RRType: TypeA, Data: []byte{0x03, 'c', 'o', 'm', 0x00, 0x00, 0x01}}),
+		},
+	}
+
+	actual, err := RawMessage(m.Serialize()).Parse()
+	require.NoError(t, err)
+	require.Len(t, actual.Authority, len(m.Authority))
+	for i, expected := range m.Authority {
+		require.Equal(t, expected.CLASS, actual.Authority[i].CLASS)
+		require.Equal(t, expected.Data, actual.Authority[i].Data)
+	}
+}
+
+func TestRawMessage_ParseErrors(t *testing.T) {
+	header := func(qd, an byte) []byte {
+		return []byte{0x04, 0xd2, 0x80, 0x00, 0x00, qd, 0x00, an, 0x00, 0x00, 0x00, 0x00}
+	}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		expected ParseError
+	}{
+		{
+			name:     "short header",
+			data:     []byte{0x04, 0xd2, 0x80},
+			expected: ParseError{Section: "header", Offset: 3, Err: ErrTruncatedMessage},
+		},
+		{
+			name:     "missing question",
+			data:     header(1, 0),
+			expected: ParseError{Section: "question", Offset: 12, Err: ErrTruncatedMessage},
+		},
+		{
+			name:     "label past end",
+			data:     append(header(1, 0), 0x05, 0x61, 0x62),
+			expected: ParseError{Section: "question", Offset: 12, Err: ErrTruncatedMessage},
+		},
+		{
+			name:     "label longer than 63 octets",
+			data:     append(header(1, 0), 0x01, 0x61, 0x40, 0x00, 0x00, 0x01, 0x00, 0x01),
+			expected: ParseError{Section: "question", Offset: 14, Err: ErrLabelTooLong},
+		},
+		{
+			name:     "forward pointer",
+			data:     append(header(1, 0), 0xc0, 0x20, 0x00, 0x01, 0x00, 0x01),
+			expected: ParseError{Section: "question", Offset: 12, Err: ErrForwardPointer},
+		},
+		{
+			name:     "pointer to itself",
+			data:     append(header(1, 0), 0xc0, 0x0c, 0x00, 0x01, 0x00, 0x01),
+			expected: ParseError{Section: "question", Offset: 12, Err: ErrForwardPointer},
+		},
+		{
+			name:     "pointer cycle",
+			data:     append(header(1, 0), 0x01, 0x61, 0xc0, 0x0c, 0x00, 0x01, 0x00, 0x01),
+			expected: ParseError{Section: "question", Offset: 14, Err: ErrPointerLoop},
+		},
+		{
+			name:     "name longer than 255 octets",
+			data:     append(header(1, 0), longName()...),
+			expected: ParseError{Section: "question", Offset: 204, Err: ErrNameTooLong},
+		},
+		{
+			name:     "truncated type and class",
+			data:     append(header(1, 0), 0x00, 0x00, 0x01),
+			expected: ParseError{Section: "question", Offset: 15, Err: ErrTruncatedMessage},
+		},
+		{
+			name: "RDLENGTH past end",
+			data: append(header(0, 2),
+				0x00, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x3c, 0x00, 0x04, 0x01, 0x02, 0x03, 0x04,
+				0x00, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x3c, 0xff, 0xff, 0x01,
+			),
+			expected: ParseError{Section: "answer", Index: 1, Offset: 36, Err: ErrTruncatedMessage},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := RawMessage(tt.data).Parse()
+
+			var pe *ParseError
+			require.ErrorAs(t, err, &pe)
+			require.Equal(t, tt.expected, *pe, "Parse error should match expected value")
+			require.ErrorIs(t, err, tt.expected.Err)
+		})
+	}
+}
+
+// longName returns an uncompressed name of five 63-octet labels, 321 octets in
+// total.
+func longName() []byte {
+	var name []byte
+	for i := 0; i < 5; i++ {
+		name = append(name, 63)
+		name = append(name, make([]byte, 63)...)
+	}
+	return append(name, 0x00, 0x00, 0x01, 0x00, 0x01)
+}
+
+func FuzzRawMessage_Parse(f *testing.F) {
+	f.Add([]byte{
+		0x04, 0xd2, 0x80, 0x00, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00,
+		0x03, 0x77, 0x77, 0x77, 0x07, 0x65, 0x78, 0x61, 0x6d, 0x70, 0x6c, 0x65, 0x03, 0x63, 0x6f, 0x6d, 0x00,
+		0x00, 0x05, 0x00, 0x01,
+		0xc0, 0x0c, 0x00, 0x05, 0x00, 0x01, 0x00, 0x00, 0x00, 0x3c, 0x00, 0x06,
+		0x03, 0x77, 0x65, 0x62, 0xc0, 0x10,
+	})
+	f.Add([]byte{
+		0x04, 0xd2, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x01,
+		0x00, 0x00, 0x06, 0x00, 0x01, 0x00, 0x00, 0x00, 0x3c, 0x00, 0x18,
+		0x01, 0x61, 0x00, 0x01, 0x62, 0x00,
+		0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x03,
+		0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00, 0x05,
+		0x00, 0x00, 0x10, 0x00, 0x01, 0x00, 0x00, 0x00, 0x3c, 0x00, 0x03, 0x02, 0x68, 0x69,
+	})
+
+	// A name repeating a label, in a question and in CNAME RDATA.
+	repeated := *NewQuery("www.www.example.com", TypeCNAME)
+	repeated.AddAnswer(NewRecord(Name{"www", "www", "example", "com"}, ClassIN, 60, CNAME{Target: Name{"a", "a", "example", "com"}}))
+	f.Add(repeated.Serialize())
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := RawMessage(data).Parse()
+		if err != nil {
+			var pe *ParseError
+			require.ErrorAs(t, err, &pe)
+			return
+		}
+
+		packed, err := m.Pack(nil)
+		if errors.Is(err, ErrMessageTooLarge) {
+			// Names compressed more tightly than we do may not fit again.
+			return
+		}
+		require.NoError(t, err, "A parsed message should pack")
+		again, err := RawMessage(packed).Parse()
+		require.NoError(t, err, "A packed message should parse again")
+		require.Equal(t, m, again, "A message should survive a round trip")
+	})
+}
+
+func BenchmarkRawMessage_Parse(b *testing.B) {
+	source := benchmarkMessage()
+	msg := RawMessage(source.Serialize())
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := msg.Parse(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
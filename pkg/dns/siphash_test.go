@@ -0,0 +1,22 @@
+package dns
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestSipHash24(t *testing.T) {
+	var key [16]byte
+	message := make([]byte, 15)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	for i := range message {
+		message[i] = byte(i)
+	}
+
+	// Test vectors from the SipHash paper, appendix A.
+	require.Equal(t, uint64(0x726fdb47dd0e0e31), sipHash24(key, nil))
+	require.Equal(t, uint64(0x74f839c593dc67fd), sipHash24(key, message[:1]))
+	require.Equal(t, uint64(0xa129ca6149be45e5), sipHash24(key, message))
+}
@@ -0,0 +1,303 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrUnknownMnemonic is returned when parsing text that is neither a known
+// mnemonic nor its generic numeric form.
+var ErrUnknownMnemonic = errors.New("unknown mnemonic")
+
+// Type is the TYPE of a resource record, or the QTYPE of a question.
+type Type uint16
+
+// Resource record TYPEs and QTYPEs from the IANA registry.
+const (
+	TypeA          Type = 1
+	TypeNS         Type = 2
+	TypeMD         Type = 3
+	TypeMF         Type = 4
+	TypeCNAME      Type = 5
+	TypeSOA        Type = 6
+	TypeMB         Type = 7
+	TypeMG         Type = 8
+	TypeMR         Type = 9
+	TypeNULL       Type = 10
+	TypeWKS        Type = 11
+	TypePTR        Type = 12
+	TypeHINFO      Type = 13
+	TypeMINFO      Type = 14
+	TypeMX         Type = 15
+	TypeTXT        Type = 16
+	TypeRP         Type = 17
+	TypeAFSDB      Type = 18
+	TypeX25        Type = 19
+	TypeISDN       Type = 20
+	TypeRT         Type = 21
+	TypeNSAP       Type = 22
+	TypeNSAPPTR    Type = 23
+	TypeSIG        Type = 24
+	TypeKEY        Type = 25
+	TypePX         Type = 26
+	TypeGPOS       Type = 27
+	TypeAAAA       Type = 28
+	TypeLOC        Type = 29
+	TypeNXT        Type = 30
+	TypeEID        Type = 31
+	TypeNIMLOC     Type = 32
+	TypeSRV        Type = 33
+	TypeATMA       Type = 34
+	TypeNAPTR      Type = 35
+	TypeKX         Type = 36
+	TypeCERT       Type = 37
+	TypeA6         Type = 38
+	TypeDNAME      Type = 39
+	TypeSINK       Type = 40
+	TypeOPT        Type = 41
+	TypeAPL        Type = 42
+	TypeDS         Type = 43
+	TypeSSHFP      Type = 44
+	TypeIPSECKEY   Type = 45
+	TypeRRSIG      Type = 46
+	TypeNSEC       Type = 47
+	TypeDNSKEY     Type = 48
+	TypeDHCID      Type = 49
+	TypeNSEC3      Type = 50
+	TypeNSEC3PARAM Type = 51
+	TypeTLSA       Type = 52
+	TypeSMIMEA     Type = 53
+	TypeHIP        Type = 55
+	TypeNINFO      Type = 56
+	TypeRKEY       Type = 57
+	TypeTALINK     Type = 58
+	TypeCDS        Type = 59
+	TypeCDNSKEY    Type = 60
+	TypeOPENPGPKEY Type = 61
+	TypeCSYNC      Type = 62
+	TypeZONEMD     Type = 63
+	TypeSVCB       Type = 64
+	TypeHTTPS      Type = 65
+	TypeDSYNC      Type = 66
+	TypeSPF        Type = 99
+	TypeUINFO      Type = 100
+	TypeUID        Type = 101
+	TypeGID        Type = 102
+	TypeUNSPEC     Type = 103
+	TypeNID        Type = 104
+	TypeL32        Type = 105
+	TypeL64        Type = 106
+	TypeLP         Type = 107
+	TypeEUI48      Type = 108
+	TypeEUI64      Type = 109
+	TypeTKEY       Type = 249
+	TypeTSIG       Type = 250
+	TypeIXFR       Type = 251
+	TypeAXFR       Type = 252
+	TypeMAILB      Type = 253
+	TypeMAILA      Type = 254
+	TypeANY        Type = 255
+	TypeURI        Type = 256
+	TypeCAA        Type = 257
+	TypeAVC        Type = 258
+	TypeDOA        Type = 259
+	TypeAMTRELAY   Type = 260
+	TypeRESINFO    Type = 261
+	TypeWALLET     Type = 262
+	TypeTA         Type = 32768
+	TypeDLV        Type = 32769
+)
+
+var typeNames = map[Type]string{
+	TypeA: "A", TypeNS: "NS", TypeMD: "MD", TypeMF: "MF", TypeCNAME: "CNAME",
+	TypeSOA: "SOA", TypeMB: "MB", TypeMG: "MG", TypeMR: "MR", TypeNULL: "NULL",
+	TypeWKS: "WKS", TypePTR: "PTR", TypeHINFO: "HINFO", TypeMINFO: "MINFO",
+	TypeMX: "MX", TypeTXT: "TXT", TypeRP: "RP", TypeAFSDB: "AFSDB",
+	TypeX25: "X25", TypeISDN: "ISDN", TypeRT: "RT", TypeNSAP: "NSAP",
+	TypeNSAPPTR: "NSAP-PTR", TypeSIG: "SIG", TypeKEY: "KEY", TypePX: "PX",
+	TypeGPOS: "GPOS", TypeAAAA: "AAAA", TypeLOC: "LOC", TypeNXT: "NXT",
+	TypeEID: "EID", TypeNIMLOC: "NIMLOC", TypeSRV: "SRV", TypeATMA: "ATMA",
+	TypeNAPTR: "NAPTR", TypeKX: "KX", TypeCERT: "CERT", TypeA6: "A6",
+	TypeDNAME: "DNAME", TypeSINK: "SINK", TypeOPT: "OPT", TypeAPL: "APL",
+	TypeDS: "DS", TypeSSHFP: "SSHFP", TypeIPSECKEY: "IPSECKEY",
+	TypeRRSIG: "RRSIG", TypeNSEC: "NSEC", TypeDNSKEY: "DNSKEY",
+	TypeDHCID: "DHCID", TypeNSEC3: "NSEC3", TypeNSEC3PARAM: "NSEC3PARAM",
+	TypeTLSA: "TLSA", TypeSMIMEA: "SMIMEA", TypeHIP: "HIP", TypeNINFO: "NINFO",
+	TypeRKEY: "RKEY", TypeTALINK: "TALINK", TypeCDS: "CDS",
+	TypeCDNSKEY: "CDNSKEY", TypeOPENPGPKEY: "OPENPGPKEY", TypeCSYNC: "CSYNC",
+	TypeZONEMD: "ZONEMD", TypeSVCB: "SVCB", TypeHTTPS: "HTTPS",
+	TypeDSYNC: "DSYNC", TypeSPF: "SPF", TypeUINFO: "UINFO", TypeUID: "UID",
+	TypeGID: "GID", TypeUNSPEC: "UNSPEC", TypeNID: "NID", TypeL32: "L32",
+	TypeL64: "L64", TypeLP: "LP", TypeEUI48: "EUI48", TypeEUI64: "EUI64",
+	TypeTKEY: "TKEY", TypeTSIG: "TSIG", TypeIXFR: "IXFR", TypeAXFR: "AXFR",
+	TypeMAILB: "MAILB", TypeMAILA: "MAILA", TypeANY: "ANY", TypeURI: "URI",
+	TypeCAA: "CAA", TypeAVC: "AVC", TypeDOA: "DOA", TypeAMTRELAY: "AMTRELAY",
+	TypeRESINFO: "RESINFO", TypeWALLET: "WALLET", TypeTA: "TA", TypeDLV: "DLV",
+}
+
+// String returns the mnemonic of t, or the generic form "TYPEnnn" of RFC 3597
+// for a type without one.
+func (t Type) String() string {
+	if name, ok := typeNames[t]; ok {
+		return name
+	}
+	return "TYPE" + strconv.Itoa(int(t))
+}
+
+// ParseType parses a mnemonic such as "AAAA", in any case, or the generic
+// form "TYPE65".
+func ParseType(s string) (Type, error) {
+	code, err := parseMnemonic(s, typeNames, "TYPE")
+	return Type(code), err
+}
+
+// Class is the CLASS of a resource record, or the QCLASS of a question.
+type Class uint16
+
+// Resource record CLASSes and QCLASSes from the IANA registry.
+const (
+	ClassIN   Class = 1
+	ClassCS   Class = 2
+	ClassCH   Class = 3
+	ClassHS   Class = 4
+	ClassNONE Class = 254
+	ClassANY  Class = 255
+)
+
+var classNames = map[Class]string{
+	ClassIN: "IN", ClassCS: "CS", ClassCH: "CH", ClassHS: "HS",
+	ClassNONE: "NONE", ClassANY: "ANY",
+}
+
+// String returns the mnemonic of c, or the generic form "CLASSnnn" of RFC 3597
+// for a class without one.
+func (c Class) String() string {
+	if name, ok := classNames[c]; ok {
+		return name
+	}
+	return "CLASS" + strconv.Itoa(int(c))
+}
+
+// ParseClass parses a mnemonic such as "IN", in any case, or the generic
+// form "CLASS3".
+func ParseClass(s string) (Class, error) {
+	code, err := parseMnemonic(s, classNames, "CLASS")
+	return Class(code), err
+}
+
+// Opcode is the kind of query of a message, in the 4-bit OPCODE field of its
+// header.
+type Opcode uint16
+
+// OPCODEs from the IANA registry.
+const (
+	OpcodeQuery  Opcode = 0
+	OpcodeIQuery Opcode = 1
+	OpcodeStatus Opcode = 2
+	OpcodeNotify Opcode = 4
+	OpcodeUpdate Opcode = 5
+	OpcodeDSO    Opcode = 6
+)
+
+var opcodeNames = map[Opcode]string{
+	OpcodeQuery: "QUERY", OpcodeIQuery: "IQUERY", OpcodeStatus: "STATUS",
+	OpcodeNotify: "NOTIFY", OpcodeUpdate: "UPDATE", OpcodeDSO: "DSO",
+}
+
+// String returns the mnemonic of o as dig shows it, or "OPCODEnn".
+func (o Opcode) String() string {
+	if name, ok := opcodeNames[o]; ok {
+		return name
+	}
+	return "OPCODE" + strconv.Itoa(int(o))
+}
+
+// ParseOpcode parses a mnemonic such as "NOTIFY", in any case, or the form
+// "OPCODE3".
+func ParseOpcode(s string) (Opcode, error) {
+	code, err := parseMnemonic(s, opcodeNames, "OPCODE")
+	if err == nil && code > 0x0F {
+		return 0, fmt.Errorf("%w: opcode %d does not fit in 4 bits", ErrUnknownMnemonic, code)
+	}
+	return Opcode(code), err
+}
+
+// Rcode is the response code of a message. Values above 15 only fit in the
+// 12 bits formed with the extended RCODE of EDNS (RFC 6891, section 6.1.3).
+type Rcode uint16
+
+// RCODEs from the IANA registry.
+const (
+	RcodeNoError   Rcode = 0
+	RcodeFormErr   Rcode = 1
+	RcodeServFail  Rcode = 2
+	RcodeNXDomain  Rcode = 3
+	RcodeNotImp    Rcode = 4
+	RcodeRefused   Rcode = 5
+	RcodeYXDomain  Rcode = 6
+	RcodeYXRRSet   Rcode = 7
+	RcodeNXRRSet   Rcode = 8
+	RcodeNotAuth   Rcode = 9
+	RcodeNotZone   Rcode = 10
+	RcodeDSOTypeNI Rcode = 11
+	RcodeBadVers   Rcode = 16
+	RcodeBadKey    Rcode = 17
+	RcodeBadTime   Rcode = 18
+	RcodeBadMode   Rcode = 19
+	RcodeBadName   Rcode = 20
+	RcodeBadAlg    Rcode = 21
+	RcodeBadTrunc  Rcode = 22
+
+	// RcodeBadCookie is returned for a query whose server cookie is missing
+	// or invalid (RFC 7873, section 5.2.3).
+	RcodeBadCookie Rcode = 23
+)
+
+var rcodeNames = map[Rcode]string{
+	RcodeNoError: "NOERROR", RcodeFormErr: "FORMERR", RcodeServFail: "SERVFAIL",
+	RcodeNXDomain: "NXDOMAIN", RcodeNotImp: "NOTIMP", RcodeRefused: "REFUSED",
+	RcodeYXDomain: "YXDOMAIN", RcodeYXRRSet: "YXRRSET", RcodeNXRRSet: "NXRRSET",
+	RcodeNotAuth: "NOTAUTH", RcodeNotZone: "NOTZONE",
+	RcodeDSOTypeNI: "DSOTYPENI", RcodeBadVers: "BADVERS", RcodeBadKey: "BADKEY",
+	RcodeBadTime: "BADTIME", RcodeBadMode: "BADMODE", RcodeBadName: "BADNAME",
+	RcodeBadAlg: "BADALG", RcodeBadTrunc: "BADTRUNC",
+	RcodeBadCookie: "BADCOOKIE",
+}
+
+// String returns the mnemonic of r as dig shows it, or "RCODEnnn".
+func (r Rcode) String() string {
+	if name, ok := rcodeNames[r]; ok {
+		return name
+	}
+	return "RCODE" + strconv.Itoa(int(r))
+}
+
+// ParseRcode parses a mnemonic such as "NXDOMAIN", in any case, or the form
+// "RCODE23".
+func ParseRcode(s string) (Rcode, error) {
+	code, err := parseMnemonic(s, rcodeNames, "RCODE")
+	if err == nil && code > 0x0FFF {
+		return 0, fmt.Errorf("%w: rcode %d does not fit in 12 bits", ErrUnknownMnemonic, code)
+	}
+	return Rcode(code), err
+}
+
+// parseMnemonic returns the code of s in names, also accepting the generic
+// form prefix followed by a decimal number.
+func parseMnemonic[T ~uint16](s string, names map[T]string, prefix string) (uint16, error) {
+	upper := strings.ToUpper(s)
+	for code, name := range names {
+		if name == upper {
+			return uint16(code), nil
+		}
+	}
+	if strings.HasPrefix(upper, prefix) {
+		if code, err := strconv.ParseUint(upper[len(prefix):], 10, 16); err == nil {
+			return uint16(code), nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w: %q", ErrUnknownMnemonic, s)
+}
@@ -0,0 +1,99 @@
+package dns
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestType_String(t *testing.T) {
+	require.Equal(t, "AAAA", TypeAAAA.String())
+	require.Equal(t, "NSAP-PTR", TypeNSAPPTR.String())
+	require.Equal(t, "HTTPS", TypeHTTPS.String())
+	require.Equal(t, "TYPE65280", Type(65280).String())
+}
+
+func TestParseType(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected Type
+	}{
+		{"AAAA", TypeAAAA},
+		{"aaaa", TypeAAAA},
+		{"nsap-ptr", TypeNSAPPTR},
+		{"TYPE65", TypeHTTPS},
+		{"type65280", Type(65280)},
+	}
+	for _, tt := range tests {
+		actual, err := ParseType(tt.input)
+		require.NoError(t, err, tt.input)
+		require.Equal(t, tt.expected, actual, tt.input)
+	}
+
+	for _, input := range []string{"", "BOGUS", "TYPE", "TYPE65536", "TYPE-1", "1"} {
+		_, err := ParseType(input)
+		require.True(t, errors.Is(err, ErrUnknownMnemonic), input)
+	}
+}
+
+func TestClass_String(t *testing.T) {
+	require.Equal(t, "IN", ClassIN.String())
+	require.Equal(t, "CH", ClassCH.String())
+	require.Equal(t, "CLASS1232", Class(1232).String())
+}
+
+func TestParseClass(t *testing.T) {
+	class, err := ParseClass("ch")
+	require.NoError(t, err)
+	require.Equal(t, ClassCH, class)
+
+	class, err = ParseClass("CLASS254")
+	require.NoError(t, err)
+	require.Equal(t, ClassNONE, class)
+
+	_, err = ParseClass("A")
+	require.True(t, errors.Is(err, ErrUnknownMnemonic))
+}
+
+func TestOpcode_String(t *testing.T) {
+	require.Equal(t, "QUERY", OpcodeQuery.String())
+	require.Equal(t, "UPDATE", OpcodeUpdate.String())
+	require.Equal(t, "OPCODE3", Opcode(3).String())
+}
+
+func TestParseOpcode(t *testing.T) {
+	opcode, err := ParseOpcode("notify")
+	require.NoError(t, err)
+	require.Equal(t, OpcodeNotify, opcode)
+
+	opcode, err = ParseOpcode("OPCODE3")
+	require.NoError(t, err)
+	require.Equal(t, Opcode(3), opcode)
+
+	_, err = ParseOpcode("OPCODE16")
+	require.True(t, errors.Is(err, ErrUnknownMnemonic))
+}
+
+func TestRcode_String(t *testing.T) {
+	require.Equal(t, "NXDOMAIN", RcodeNXDomain.String())
+	require.Equal(t, "BADCOOKIE", RcodeBadCookie.String())
+	require.Equal(t, "RCODE12", Rcode(12).String())
+}
+
+func TestParseRcode(t *testing.T) {
+	rcode, err := ParseRcode("NXDOMAIN")
+	require.NoError(t, err)
+	require.Equal(t, RcodeNXDomain, rcode)
+
+	rcode, err = ParseRcode("badvers")
+	require.NoError(t, err)
+	require.Equal(t, RcodeBadVers, rcode)
+
+	rcode, err = ParseRcode("RCODE23")
+	require.NoError(t, err)
+	require.Equal(t, RcodeBadCookie, rcode)
+
+	_, err = ParseRcode("RCODE4096")
+	require.True(t, errors.Is(err, ErrUnknownMnemonic))
+}
@@ -0,0 +1,127 @@
+package dns
+
+import (
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Strategy selects the order in which a forwarder tries its upstream
+// resolvers. Whatever the strategy, a query moves on to the next upstream
+// when one cannot be reached or does not answer in time.
+type Strategy int
+
+const (
+	// StrategyFailover tries the upstreams in the order they were given.
+	StrategyFailover Strategy = iota
+	// StrategyRoundRobin starts each query at the upstream after the one the
+	// previous query started at.
+	StrategyRoundRobin
+	// StrategyRandom tries the upstreams in a random order.
+	StrategyRandom
+	// StrategyLowestLatency tries the upstreams by increasing smoothed
+	// round-trip time, those not measured yet first.
+	StrategyLowestLatency
+)
+
+// rttWeight is the weight of a new sample in the smoothed round-trip time, an
+// exponentially weighted moving average.
+const rttWeight = 0.3
+
+// upstream is one of the resolvers a forwarder sends queries to.
+type upstream struct {
+	addr    *net.UDPAddr
+	cookies *clientCookies
+
+	// mismatches counts the responses dropped because they did not answer
+	// the query they were received for.
+	mismatches atomic.Uint64
+
+	mu       sync.Mutex
+	rtt      time.Duration
+	measured bool
+
+	// Circuit breaker state, see health.go.
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	lastErr  error
+}
+
+// observe adds the time taken by an exchange to the smoothed round-trip time.
+// Failed exchanges count too, as given by rttSample, so that an upstream that
+// fails falls behind the others.
+func (u *upstream) observe(sample time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if !u.measured {
+		u.rtt, u.measured = sample, true
+		return
+	}
+	u.rtt = time.Duration(rttWeight*float64(sample) + (1-rttWeight)*float64(u.rtt))
+}
+
+// rttSample returns the round-trip time to record for an exchange that took
+// elapsed and failed with err, if not nil. A failure counts as taking at least
+// the read timeout: an upstream that refuses queries fails fast, and must not
+// look faster than one that answers.
+func (f *Forwarder) rttSample(elapsed time.Duration, err error) time.Duration {
+	if err != nil && elapsed < f.readTimeout {
+		return f.readTimeout
+	}
+	return elapsed
+}
+
+// smoothedRTT returns the smoothed round-trip time, or false if no exchange
+// has been made with the upstream yet.
+func (u *upstream) smoothedRTT() (time.Duration, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.rtt, u.measured
+}
+
+// order returns the upstreams of f in the order to try them for one query.
+func (f *Forwarder) order() []*upstream {
+	upstreams := f.upstreams
+	order := make([]*upstream, len(upstreams))
+	switch f.strategy {
+	case StrategyRoundRobin:
+		// The modulo is taken before converting to int, which would turn
+		// negative once the counter wraps on 32-bit platforms.
+		start := int((f.next.Add(1) - 1) % uint32(len(upstreams)))
+		for i := range order {
+			order[i] = upstreams[(start+i)%len(upstreams)]
+		}
+	case StrategyRandom:
+		for i, j := range rand.Perm(len(upstreams)) {
+			order[i] = upstreams[j]
+		}
+	case StrategyLowestLatency:
+		type measurement struct {
+			rtt      time.Duration
+			measured bool
+		}
+		rtts := make(map[*upstream]measurement, len(upstreams))
+		for _, u := range upstreams {
+			rtt, measured := u.smoothedRTT()
+			rtts[u] = measurement{rtt, measured}
+		}
+		copy(order, upstreams)
+		sort.SliceStable(order, func(i, j int) bool {
+			a, b := rtts[order[i]], rtts[order[j]]
+			if a.measured != b.measured {
+				return !a.measured
+			}
+			return a.rtt < b.rtt
+		})
+	default:
+		copy(order, upstreams)
+	}
+
+	return order
+}
@@ -0,0 +1,80 @@
+package dns
+
+import (
+	"errors"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testUpstreams(count int) []*upstream {
+	var upstreams []*upstream
+	for i := 0; i < count; i++ {
+		upstreams = append(upstreams, &upstream{addr: &net.UDPAddr{IP: net.IPv4(192, 0, 2, byte(i+1)), Port: 53}})
+	}
+	return upstreams
+}
+
+func TestUpstream_observe(t *testing.T) {
+	u := testUpstreams(1)[0]
+	_, measured := u.smoothedRTT()
+	require.False(t, measured)
+
+	u.observe(100 * time.Millisecond)
+	rtt, measured := u.smoothedRTT()
+	require.True(t, measured)
+	require.Equal(t, 100*time.Millisecond, rtt, "The first sample should be taken as is")
+
+	u.observe(200 * time.Millisecond)
+	rtt, _ = u.smoothedRTT()
+	require.Equal(t, 130*time.Millisecond, rtt)
+}
+
+func TestForwarder_rttSample(t *testing.T) {
+	f := &Forwarder{readTimeout: 2 * time.Second}
+	require.Equal(t, 30*time.Millisecond, f.rttSample(30*time.Millisecond, nil))
+	require.Equal(t, 2*time.Second, f.rttSample(80*time.Microsecond, errors.New("connection refused")), "A fast failure should count as the read timeout")
+	require.Equal(t, 3*time.Second, f.rttSample(3*time.Second, errors.New("timeout")))
+
+	// An upstream that refuses every query must not end up first.
+	upstreams := testUpstreams(2)
+	for i := 0; i < 10; i++ {
+		upstreams[0].observe(f.rttSample(80*time.Microsecond, errors.New("connection refused")))
+		upstreams[1].observe(f.rttSample(30*time.Millisecond, nil))
+	}
+	f.upstreams, f.strategy = upstreams, StrategyLowestLatency
+	require.Equal(t, []*upstream{upstreams[1], upstreams[0]}, f.order())
+}
+
+func TestForwarder_order(t *testing.T) {
+	upstreams := testUpstreams(3)
+
+	f := &Forwarder{upstreams: upstreams, strategy: StrategyFailover}
+	require.Equal(t, upstreams, f.order())
+	require.Equal(t, upstreams, f.order())
+
+	f = &Forwarder{upstreams: upstreams, strategy: StrategyRoundRobin}
+	require.Equal(t, []*upstream{upstreams[0], upstreams[1], upstreams[2]}, f.order())
+	require.Equal(t, []*upstream{upstreams[1], upstreams[2], upstreams[0]}, f.order())
+	require.Equal(t, []*upstream{upstreams[2], upstreams[0], upstreams[1]}, f.order())
+	require.Equal(t, []*upstream{upstreams[0], upstreams[1], upstreams[2]}, f.order())
+
+	// 2^32-1 is a multiple of 3, and the counter wraps to 0 after it.
+	f.next.Store(math.MaxUint32)
+	require.Equal(t, []*upstream{upstreams[0], upstreams[1], upstreams[2]}, f.order())
+	require.Equal(t, []*upstream{upstreams[0], upstreams[1], upstreams[2]}, f.order())
+	require.Equal(t, []*upstream{upstreams[1], upstreams[2], upstreams[0]}, f.order())
+
+	f = &Forwarder{upstreams: upstreams, strategy: StrategyRandom}
+	require.ElementsMatch(t, upstreams, f.order())
+
+	upstreams = testUpstreams(4)
+	upstreams[0].observe(300 * time.Millisecond)
+	upstreams[1].observe(10 * time.Millisecond)
+	upstreams[3].observe(50 * time.Millisecond)
+	f = &Forwarder{upstreams: upstreams, strategy: StrategyLowestLatency}
+	require.Equal(t, []*upstream{upstreams[2], upstreams[1], upstreams[3], upstreams[0]}, f.order(), "Unmeasured upstreams should come first, then the fastest")
+}